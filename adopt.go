@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/pagination"
+	log "github.com/sirupsen/logrus"
+)
+
+// Stands for the containers that were using a volume mounted before the plugin started,
+// when it has no record of them: one reference per container, adoptedRef-<n>
+const adoptedRef = "adopted"
+
+// Reconcile the recorded state with the kernel after a plugin restart:
+// keep the volumes still mounted, forget the ones that are gone (i.e. after a reboot),
+// finish interrupted unmounts, and adopt mounts the plugin has no record of.
+// Docker mounts volumes again when needed, only missing steps are then re-done.
+func (d *plugin) adoptMounts() error {
+	logger := log.WithContext(context.Background()).WithFields(log.Fields{"action": "adoptMounts"})
+
+	states, err := d.state.all()
+	if err != nil {
+		return err
+	}
+
+	for name, state := range states {
+		logger := logger.WithField("name", name)
+		if !d.isLive(name) {
+			logger.Info("Recorded volume is not mounted anymore, forgetting it")
+			d.mutex.Lock()
+			delete(d.mounts, name)
+			delete(d.mountpoints, name)
+			d.mutex.Unlock()
+			if err = d.state.delete(name); err != nil {
+				logger.WithError(err).Error("Error removing volume state")
+			}
+			continue
+		}
+		if len(state.Refs) == 0 {
+			logger.Info("Finishing interrupted unmount")
+			if err = d.unmountVolume(logger, name); err != nil {
+				logger.WithError(err).Error("Error unmounting volume")
+			}
+			continue
+		}
+		logger.Infof("Volume still mounted, used by %d mount(s)", len(state.Refs))
+	}
+
+	// volumes attached here, at their mount path: mount directory names don't always
+	// lead back to volume names (shortened names, custom mountpoints)
+	pager := volumes.List(d.block(logger.Context), volumes.ListOpts{})
+	return pager.EachPage(func(page pagination.Page) (bool, error) {
+		vList, err := volumes.ExtractVolumes(page)
+		if err != nil {
+			return false, err
+		}
+		for i := range vList {
+			vol := &vList[i]
+			if !d.isPluginVolume(vol) || isTrashed(vol) || !d.hasAttachmentHere(vol) {
+				continue
+			}
+			name, ok := d.dockerName(vol)
+			if !ok || states[name] != nil {
+				continue
+			}
+			if path := d.volumeMountPath(name, vol); isLiveAt(path) {
+				d.adoptMount(logger.WithField("name", name), name, vol, path)
+			}
+		}
+		return true, nil
+	})
+}
+
+func (d plugin) hasAttachmentHere(vol *volumes.Volume) bool {
+	for _, att := range vol.Attachments {
+		if d.isAttachedHere(att) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a volume is mounted, or exposed as a raw device
+func (d plugin) isLive(name string) bool {
+	return isLiveAt(d.mountPath(name, nil))
+}
+
+func isLiveAt(path string) bool {
+	if isBlockDevice(filepath.Join(path, rawDeviceName)) {
+		return true
+	}
+	mounted, _ := isMounted(path)
+	return mounted
+}
+
+// Record a volume mounted without the plugin knowing, i.e. by a version without local state
+func (d plugin) adoptMount(logger *log.Entry, name string, vol *volumes.Volume, path string) {
+	state := &volumeState{VolumeID: vol.ID, Path: path, Mountpoint: path}
+
+	if isBlockDevice(filepath.Join(path, rawDeviceName)) {
+		state.Raw = true
+		luksName := luksMapperName(name)
+		if baseDevice, err := getLuksBaseDevice(luksName); err == nil && baseDevice != "" {
+			state.LuksName, state.Device = luksName, baseDevice
+		}
+	} else {
+		state.Mountpoint = filepath.Join(path, d.volumeOptions(vol).SubDir)
+		mountDevice, _ := getMountDevice(path)
+		if strings.HasPrefix(mountDevice, "/dev/mapper/") {
+			if _, luksName, baseDevice, err := getLuksInfo(path); err == nil {
+				state.LuksName, state.Device = luksName, baseDevice
+			}
+		} else {
+			state.Device = mountDevice
+		}
+	}
+
+	users := 1
+	if !state.Raw {
+		if n := countMountUsers(path); n > 1 {
+			users = n
+		}
+	}
+
+	d.mutex.Lock()
+	d.recordMount(name, adoptedRef+"-0", state)
+	for i := 1; i < users; i++ {
+		d.mounts[name][adoptedRef+"-"+strconv.Itoa(i)] = true
+	}
+	d.saveRefs(name)
+	d.mutex.Unlock()
+	logger.WithFields(log.Fields{"device": state.Device, "users": users}).Info("Adopted volume mounted before the plugin started")
+}
+
+// One of the references standing for containers the plugin has no record of, if any
+func adoptedRefOf(refs map[string]bool) string {
+	for id := range refs {
+		if strings.HasPrefix(id, adoptedRef) {
+			return id
+		}
+	}
+	return ""
+}
+
+// Number of containers using the filesystem mounted on path: mount namespaces, other than the one of volumes
+// and the plugin's own, with a mount of it. 0 when they can't be seen (i.e. without the host PID namespace).
+func countMountUsers(path string) int {
+	device := mountinfoDevice(filepath.Join(procDir(), "mountinfo"), path)
+	if device == "" {
+		return 0
+	}
+
+	skip := make(map[string]bool)
+	for _, dir := range []string{procDir(), "/proc/self"} {
+		if ns, err := os.Readlink(filepath.Join(dir, "ns", "mnt")); err == nil {
+			skip[ns] = true
+		}
+	}
+
+	pids, _ := filepath.Glob("/proc/[0-9]*")
+	users := 0
+	for _, pid := range pids {
+		ns, err := os.Readlink(filepath.Join(pid, "ns", "mnt"))
+		if err != nil || skip[ns] {
+			continue
+		}
+		// one process per namespace is enough
+		skip[ns] = true
+		if mountinfoHasDevice(filepath.Join(pid, "mountinfo"), device) {
+			users++
+		}
+	}
+	return users
+}
+
+// major:minor of the filesystem mounted on path, from a mountinfo file
+func mountinfoDevice(mountinfo string, path string) string {
+	device := ""
+	scanMountinfo(mountinfo, func(fields []string) bool {
+		if fields[4] == path {
+			device = fields[2]
+		}
+		return true
+	})
+	return device
+}
+
+// Whether a mountinfo file has a mount of the major:minor device
+func mountinfoHasDevice(mountinfo string, device string) bool {
+	found := false
+	scanMountinfo(mountinfo, func(fields []string) bool {
+		found = fields[2] == device
+		return !found
+	})
+	return found
+}
+
+// Call fn with the fields of each mountinfo line ([id] [parent] [major:minor] [root] [mountpoint] ...), while it returns true
+func scanMountinfo(mountinfo string, fn func(fields []string) bool) {
+	f, err := os.Open(mountinfo)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 5 && !fn(fields) {
+			return
+		}
+	}
+}
+
+// Mountpoint of a volume in use on this host, if recorded
+func (d plugin) recordedMountpoint(name string) string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if len(d.mounts[name]) == 0 {
+		return ""
+	}
+	return d.mountpoints[name]
+}
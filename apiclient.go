@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+
+	"github.com/gophercloud/gophercloud"
+)
+
+// Copy of a service client whose requests are bound to ctx: cancelling the operation they serve
+// (timeoutOperation, Docker giving up, Ctrl-C on admin commands) aborts its calls in flight.
+// The copy shares the HTTP client and endpoints, and re-authenticates through the original
+// provider, so that a new token is shared with all calls.
+// This stands in for the context argument of gophercloud v2 calls, which this plugin isn't ported to.
+func withContext(ctx context.Context, client *gophercloud.ServiceClient) *gophercloud.ServiceClient {
+	if client == nil || ctx == nil {
+		return client
+	}
+
+	base := client.ProviderClient
+	provider := &gophercloud.ProviderClient{
+		IdentityBase:      base.IdentityBase,
+		IdentityEndpoint:  base.IdentityEndpoint,
+		TokenID:           base.Token(),
+		EndpointLocator:   base.EndpointLocator,
+		HTTPClient:        base.HTTPClient,
+		UserAgent:         base.UserAgent,
+		Context:           ctx,
+		RetryBackoffFunc:  base.RetryBackoffFunc,
+		MaxBackoffRetries: base.MaxBackoffRetries,
+		RetryFunc:         base.RetryFunc,
+	}
+	if base.ReauthFunc != nil {
+		provider.ReauthFunc = func() error {
+			// skipped when another call already got a new token
+			if err := base.Reauthenticate(provider.TokenID); err != nil {
+				return err
+			}
+			provider.TokenID = base.Token()
+			return nil
+		}
+	}
+
+	bound := *client
+	bound.ProviderClient = provider
+	return &bound
+}
+
+// Block storage client bound to ctx
+func (d plugin) block(ctx context.Context) *gophercloud.ServiceClient {
+	return withContext(ctx, d.blockClient)
+}
+
+// Compute client bound to ctx (nil without Nova)
+func (d plugin) compute(ctx context.Context) *gophercloud.ServiceClient {
+	return withContext(ctx, d.computeClient)
+}
+
+// Object storage client bound to ctx (nil unless LUKS headers are stored in Swift)
+func (d plugin) object(ctx context.Context) *gophercloud.ServiceClient {
+	return withContext(ctx, d.objectClient)
+}
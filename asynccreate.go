@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Volume creation completed in the background (backup restore, encryption)
+type pendingCreate struct {
+	VolumeID  string    `json:"volumeId"`
+	StartedAt time.Time `json:"startedAt"`
+	// set when it failed
+	Error string `json:"error,omitempty"`
+}
+
+// Background creations, in progress or failed, also recorded in the state store
+type createTracker struct {
+	mutex   sync.Mutex
+	pending map[string]*pendingCreate
+	state   *stateStore
+}
+
+func newCreateTracker() *createTracker {
+	return &createTracker{pending: make(map[string]*pendingCreate)}
+}
+
+func (t *createTracker) start(name string, volumeID string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	p := &pendingCreate{VolumeID: volumeID, StartedAt: time.Now().UTC()}
+	t.pending[name] = p
+	if err := t.state.putCreating(name, p); err != nil {
+		log.WithError(err).WithField("name", name).Error("Error saving volume creation state")
+	}
+}
+
+// Forget a completed creation, keep a failed one
+func (t *createTracker) end(name string, err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	p, ok := t.pending[name]
+	if !ok {
+		return
+	}
+	var stateErr error
+	if err == nil {
+		delete(t.pending, name)
+		stateErr = t.state.deleteCreating(name)
+	} else {
+		p.Error = err.Error()
+		stateErr = t.state.putCreating(name, p)
+	}
+	if stateErr != nil {
+		log.WithError(stateErr).WithField("name", name).Error("Error saving volume creation state")
+	}
+}
+
+// Forget a volume, i.e. removed
+func (t *createTracker) forget(name string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if _, ok := t.pending[name]; !ok {
+		return
+	}
+	delete(t.pending, name)
+	if err := t.state.deleteCreating(name); err != nil {
+		log.WithError(err).WithField("name", name).Error("Error saving volume creation state")
+	}
+}
+
+// In progress, failed, or empty when the volume is ready
+func (t *createTracker) status(name string) string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	p, ok := t.pending[name]
+	if !ok {
+		return ""
+	}
+	if p.Error != "" {
+		return "failed: " + p.Error
+	}
+	return fmt.Sprintf("in progress for %s", time.Since(p.StartedAt).Round(time.Second))
+}
+
+// Error when the volume can't be used because its creation failed
+func (t *createTracker) failed(name string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if p, ok := t.pending[name]; ok && p.Error != "" {
+		return fmt.Errorf("Creation of volume %s failed: %s. Remove it and create it again", name, p.Error)
+	}
+	return nil
+}
+
+// Load the creations recorded by a previous run: the ones in progress were interrupted
+func (t *createTracker) load(state *stateStore) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.state = state
+	pending, err := state.allCreating()
+	if err != nil {
+		return err
+	}
+	for name, p := range pending {
+		if p.Error == "" {
+			log.WithField("name", name).Warn("Volume creation interrupted by a plugin restart")
+			p.Error = "interrupted by a plugin restart"
+			if err = state.putCreating(name, p); err != nil {
+				return err
+			}
+		}
+		t.pending[name] = p
+	}
+	return nil
+}
+
+func (s *stateStore) putCreating(name string, p *pendingCreate) error {
+	if s == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(creatingBucket).Put([]byte(name), data)
+	})
+}
+
+func (s *stateStore) deleteCreating(name string) error {
+	if s == nil {
+		return nil
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(creatingBucket).Delete([]byte(name))
+	})
+}
+
+func (s *stateStore) allCreating() (map[string]*pendingCreate, error) {
+	pending := make(map[string]*pendingCreate)
+	if s == nil {
+		return pending, nil
+	}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(creatingBucket).ForEach(func(name, data []byte) error {
+			p := &pendingCreate{}
+			if err := json.Unmarshal(data, p); err != nil {
+				return err
+			}
+			pending[string(name)] = p
+			return nil
+		})
+	})
+	return pending, err
+}
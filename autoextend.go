@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/extensions/volumeactions"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	log "github.com/sirupsen/logrus"
+)
+
+// Extending attached volumes requires this Cinder API microversion
+const extendAttachedMicroversion = "3.42"
+
+// Watch the usage of the volumes mounted on this host, and extend the ones
+// running out of space: Cinder volume, LUKS device, then filesystem
+func (d plugin) autoExtendVolumes() {
+	if d.config.AutoExtendThreshold <= 0 {
+		return
+	}
+
+	for {
+		time.Sleep(time.Duration(d.config.AutoExtendInterval) * time.Second)
+
+		d.mutex.Lock()
+		names := make([]string, 0, len(d.mounts))
+		for name := range d.mounts {
+			names = append(names, name)
+		}
+		d.mutex.Unlock()
+
+		for _, name := range names {
+			logger := log.WithFields(log.Fields{"name": name, "action": "autoExtend"})
+			if err := d.autoExtend(logger, name); err != nil {
+				logger.WithError(err).Error("Error extending volume")
+			}
+		}
+	}
+}
+
+func (d plugin) autoExtend(logger *log.Entry, name string) error {
+	// mountpoint recorded when mounted: in the volume's filesystem, wherever it is mounted
+	mountpoint := d.recordedMountpoint(name)
+	if mountpoint == "" || isBlockDevice(filepath.Join(mountpoint, rawDeviceName)) {
+		return nil
+	}
+
+	usage, err := getDiskUsage(mountpoint)
+	if err != nil || usage.TotalBytes == 0 {
+		return nil
+	}
+	used := int(usage.UsedBytes * 100 / usage.TotalBytes)
+	if used < d.config.AutoExtendThreshold {
+		return nil
+	}
+
+	release, err := d.ops.acquire(name)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// unmounted meanwhile
+	d.mutex.Lock()
+	mounted := len(d.mounts[name]) > 0
+	d.mutex.Unlock()
+	if !mounted {
+		return nil
+	}
+
+	vol, err := d.getByName(logger.Context, name)
+	if err != nil {
+		return err
+	}
+	// snapshot copies are never written to
+	if !metadataBool(vol, metaAutoExtend, true) || metadataBool(vol, metaReadOnly, false) {
+		return nil
+	}
+
+	maxSize := d.config.AutoExtendMaxSize
+	if m, ok := vol.Metadata[metaAutoExtendMaxSize]; ok {
+		maxSize, _ = strconv.Atoi(m)
+	}
+	newSize := vol.Size + d.config.AutoExtendStep
+	if maxSize > 0 && newSize > maxSize {
+		newSize = maxSize
+	}
+	if newSize <= vol.Size {
+		logger.Warnf("Volume %d%% full, but already at its maximum size (%dGB)", used, vol.Size)
+		return nil
+	}
+
+	logger.Infof("Volume %d%% full, extending it from %dGB to %dGB", used, vol.Size, newSize)
+
+	client := *d.block(logger.Context)
+	if client.Microversion == "" {
+		client.Microversion = extendAttachedMicroversion
+	}
+	err = volumeactions.ExtendSize(&client, vol.ID, volumeactions.ExtendSizeOpts{NewSize: newSize}).ExtractErr()
+	if err != nil {
+		return err
+	}
+	if vol, err = volumes.Get(d.block(logger.Context), vol.ID).Extract(); err != nil {
+		return err
+	}
+	if vol, err = d.waitOnVolumeState(logger.Context, vol, "in-use"); err != nil {
+		return err
+	}
+
+	return d.growMounted(logger, vol, d.mountPath(name, vol))
+}
+
+// Grow the device stack of a mounted volume after it was extended:
+// rescan the disk, resize the LUKS mapping, grow the filesystem
+func (d plugin) growMounted(logger *log.Entry, vol *volumes.Volume, path string) error {
+	dev, err := getMountDevice(path)
+	if err != nil {
+		return err
+	}
+	baseDevice := dev
+	luksName := ""
+	if strings.HasPrefix(dev, "/dev/mapper/") {
+		luksName = strings.TrimPrefix(dev, "/dev/mapper/")
+		if baseDevice, err = getLuksBaseDevice(luksName); err != nil {
+			return err
+		}
+	}
+
+	// Nova has the guest rescan virtio disks, SCSI ones (i.e. iSCSI) must be told to
+	size, _ := getDeviceSize(baseDevice)
+	expected := int64(vol.Size) * 1024 * 1024 * 1024
+	if size < expected {
+		rescanDevice(baseDevice)
+	}
+	for deadline := time.Now().Add(time.Duration(d.config.TimeoutDeviceWait) * time.Second); size < expected && time.Now().Before(deadline); {
+		time.Sleep(time.Second)
+		size, _ = getDeviceSize(baseDevice)
+	}
+	if size < expected {
+		return fmt.Errorf("Device %s still %d bytes after extending volume to %dGB", baseDevice, size, vol.Size)
+	}
+
+	if luksName != "" {
+		if err = d.resizeLuks(logger, vol, luksName); err != nil {
+			return err
+		}
+	}
+
+	fsType, err := getFilesystemType(dev)
+	if err != nil {
+		return err
+	}
+	if spec, ok := filesystems[fsType]; !ok || !spec.growMounted {
+		logger.Infof("Volume extended, %s filesystem will be grown at next mount", fsType)
+		return nil
+	}
+	if _, err = growFilesystemIfNeeded(dev, path, fsType); err != nil {
+		return err
+	}
+	logger.Infof("Volume extended to %dGB, %s filesystem grown", vol.Size, fsType)
+	return nil
+}
+
+// Resize an open LUKS (or plain dm-crypt) mapping to its device, once the volume was extended
+func (d plugin) resizeLuks(logger *log.Entry, vol *volumes.Volume, luksName string) error {
+	keys := &keyFiles{}
+	defer keys.close()
+	header, removeHeader, err := d.fetchDetachedHeader(logger.Context, vol)
+	if err != nil {
+		return err
+	}
+	defer removeHeader()
+	args := append([]string{"resize", luksName}, headerArgs(header)...)
+	// plain dm-crypt of ephemeral keys needs no key to resize
+	if !metadataBool(vol, metaEphemeralKey, false) {
+		keyfile, err := d.keyFile(vol)
+		if err != nil {
+			return err
+		}
+		key, err := keys.path(keyfile)
+		if err != nil {
+			return err
+		}
+		args = append(args, "--key-file", key)
+	}
+	out, err := keys.attach(hostCommand("cryptsetup", args...)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cryptsetup resize %s failed: %s", luksName, out)
+	}
+	return nil
+}
+
+// Have the kernel read the size of a SCSI disk again
+func rescanDevice(dev string) {
+	target, err := filepath.EvalSymlinks(dev)
+	if err != nil {
+		return
+	}
+	rescan := filepath.Join("/sys/class/block", filepath.Base(target), "device", "rescan")
+	if _, err = os.Stat(rescan); err == nil {
+		os.WriteFile(rescan, []byte("1"), 0200)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/availabilityzones"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+	log "github.com/sirupsen/logrus"
+)
+
+// crossAZ modes
+const (
+	crossAZAllow   = "allow"
+	crossAZFail    = "fail"
+	crossAZMigrate = "migrate"
+)
+
+// Availability zone of this instance: from the metadata service, or from Nova
+func (d plugin) instanceAZ(ctx context.Context) (string, error) {
+	if metadata, err := getInstanceMetadata(); err == nil && metadata.AvailabilityZone != "" {
+		return metadata.AvailabilityZone, nil
+	}
+
+	var server struct {
+		servers.Server
+		availabilityzones.ServerAvailabilityZoneExt
+	}
+	if err := servers.Get(d.compute(ctx), d.machineID()).ExtractInto(&server); err != nil {
+		return "", err
+	}
+	return server.AvailabilityZone, nil
+}
+
+// With clouds refusing cross-AZ attachments (Nova cross_az_attach = False),
+// check the volume is in the instance's AZ before attaching it, instead of getting Nova's
+// opaque error, and with crossAZ "migrate", move it to azMigrationHosts' backend of the instance's AZ.
+func (d plugin) checkAvailabilityZone(logger *log.Entry, vol *volumes.Volume) (*volumes.Volume, error) {
+	if d.config.CrossAZ == crossAZAllow || d.local != nil || vol.AvailabilityZone == "" {
+		return vol, nil
+	}
+
+	az, err := d.instanceAZ(logger.Context)
+	if err != nil {
+		logger.WithError(err).Warn("Error looking up instance availability zone, not checking it")
+		return vol, nil
+	}
+	if az == vol.AvailabilityZone {
+		return vol, nil
+	}
+
+	host, ok := d.config.AZMigrationHosts[az]
+	if d.config.CrossAZ != crossAZMigrate || !ok {
+		return nil, fmt.Errorf("Volume %s is in availability zone %s, this instance in %s: it can't be attached here (cross-AZ attachments are disabled)",
+			vol.Name, vol.AvailabilityZone, az)
+	}
+
+	logger.Warnf("Volume is in availability zone %s, this instance in %s: migrating it to %s", vol.AvailabilityZone, az, host)
+	d.watchdog.step(d.volumeName(vol), "migrating to "+az)
+	if err = d.migrateVolume(logger.Context, logger, vol, host, false); err != nil {
+		return nil, err
+	}
+	return volumes.Get(d.block(logger.Context), vol.ID).Extract()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/extensions/backups"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/pagination"
+	log "github.com/sirupsen/logrus"
+)
+
+// Find a Cinder backup by ID or name
+func (d plugin) getBackup(ctx context.Context, ref string) (*backups.Backup, error) {
+	if uuidRegex.MatchString(ref) {
+		return backups.Get(d.block(ctx), ref).Extract()
+	}
+
+	// list only has names: get the details of the match
+	var found []backups.Backup
+	pager := backups.List(d.block(ctx), backups.ListOpts{Name: ref})
+	err := pager.EachPage(func(page pagination.Page) (bool, error) {
+		bList, err := backups.ExtractBackups(page)
+		if err != nil {
+			return false, err
+		}
+		for _, b := range bList {
+			if b.Name == ref {
+				found = append(found, b)
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(found) != 1 {
+		return nil, fmt.Errorf("Found %d backups named %s", len(found), ref)
+	}
+	return backups.Get(d.block(ctx), found[0].ID).Extract()
+}
+
+// Restore a backup into a new volume, once it is available.
+// Restoring goes on in Cinder: the volume can't be mounted until it is available again.
+func (d plugin) restoreBackup(logger *log.Entry, vol *volumes.Volume, backup *backups.Backup) error {
+	vol, err := d.waitOnVolumeState(logger.Context, vol, "available")
+	if err != nil {
+		return err
+	}
+
+	logger.WithField("backup", backup.ID).Infof("Restoring backup %s into volume", backup.Name)
+	_, err = backups.RestoreFromBackup(d.block(logger.Context), backup.ID, backups.RestoreOpts{VolumeID: vol.ID}).Extract()
+	return err
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	log "github.com/sirupsen/logrus"
+)
+
+// Steps of a benchmarked volume lifecycle, in order
+var benchSteps = []string{"create", "mount", "unmount", "remove"}
+
+// Durations of a benchmark step
+type benchTimings struct {
+	mutex     sync.Mutex
+	durations []time.Duration
+	failures  int
+}
+
+func (t *benchTimings) add(duration time.Duration, err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if err != nil {
+		t.failures++
+		return
+	}
+	t.durations = append(t.durations, duration)
+}
+
+// Duration under which p percent of the successful steps ran (nearest rank)
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// Create, mount, unmount and remove volumes against the configured cloud,
+// and report the latency of each step
+func cmdBench(ctx context.Context, d *plugin, args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	count := flags.Int("count", 10, "")
+	concurrency := flags.Int("concurrency", 1, "")
+	size := flags.Int("size", 1, "")
+	volumeType := flags.String("type", "", "")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 || *count <= 0 || *concurrency <= 0 || *size <= 0 {
+		return errUsage
+	}
+
+	// bench volumes are deleted for real, whatever the config and type profiles keep removed volumes for
+	options := map[string]string{"size": strconv.Itoa(*size), "snapshotBeforeDelete": "false"}
+	d.config.SnapshotBeforeDelete = false
+	var locked []string
+	for _, option := range d.config.LockedOptions {
+		if option != "snapshotBeforeDelete" {
+			locked = append(locked, option)
+		}
+	}
+	d.config.LockedOptions = locked
+	if *volumeType != "" {
+		options["type"] = *volumeType
+	}
+	prefix := fmt.Sprintf("%sbench-%d-", d.config.ListFilterPrefix, time.Now().Unix())
+
+	timings := make(map[string]*benchTimings)
+	for _, step := range benchSteps {
+		timings[step] = &benchTimings{}
+	}
+
+	start := time.Now()
+	names := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range names {
+				d.benchVolume(ctx, name, options, timings)
+			}
+		}()
+	}
+	for i := 0; i < *count && ctx.Err() == nil; i++ {
+		names <- fmt.Sprintf("%s%d", prefix, i)
+	}
+	close(names)
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "STEP\tOK\tFAILED\tMIN\tP50\tP90\tP99\tMAX")
+	failed := false
+	for _, step := range benchSteps {
+		t := timings[step]
+		sort.Slice(t.durations, func(i, j int) bool { return t.durations[i] < t.durations[j] })
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\n", step, len(t.durations), t.failures,
+			percentile(t.durations, 0).Round(time.Millisecond),
+			percentile(t.durations, 50).Round(time.Millisecond),
+			percentile(t.durations, 90).Round(time.Millisecond),
+			percentile(t.durations, 99).Round(time.Millisecond),
+			percentile(t.durations, 100).Round(time.Millisecond))
+		failed = failed || t.failures > 0
+	}
+	w.Flush()
+	fmt.Printf("\n%d volumes, concurrency %d, %s\n", *count, *concurrency, elapsed.Round(time.Millisecond))
+
+	if ctx.Err() != nil {
+		return errors.New("Benchmark interrupted")
+	}
+	if failed {
+		return errors.New("Some steps failed, see the log")
+	}
+	return nil
+}
+
+// Run the lifecycle of one benchmark volume, through the handlers Docker calls: with their
+// operation limits, tracking and timeouts. Once created, the volume is removed even when a step
+// fails or the benchmark is interrupted, which lets the step in progress finish.
+func (d plugin) benchVolume(ctx context.Context, name string, options map[string]string, timings map[string]*benchTimings) {
+	logger := log.WithFields(log.Fields{"name": name, "action": "bench"})
+
+	run := func(step string, op func() error) error {
+		start := time.Now()
+		err := op()
+		timings[step].add(time.Since(start), err)
+		if err != nil {
+			logger.WithError(err).Errorf("Benchmark %s failed", step)
+		}
+		return err
+	}
+
+	if err := run("create", func() error {
+		return d.Create(&volume.CreateRequest{Name: name, Options: options})
+	}); err != nil {
+		return
+	}
+	defer run("remove", func() error {
+		return d.Remove(&volume.RemoveRequest{Name: name})
+	})
+	if ctx.Err() != nil {
+		return
+	}
+
+	if err := run("mount", func() error {
+		_, err := d.Mount(&volume.MountRequest{Name: name, ID: "bench"})
+		return err
+	}); err != nil {
+		return
+	}
+	run("unmount", func() error {
+		return d.Unmount(&volume.UnmountRequest{Name: name, ID: "bench"})
+	})
+}
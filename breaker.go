@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// HTTP transport failing fast while OpenStack is down: after threshold consecutive
+// failures, requests fail immediately for cooldown, then a single request probes it again.
+type circuitBreaker struct {
+	transport http.RoundTripper
+	threshold int
+	cooldown  time.Duration
+
+	mutex     sync.Mutex
+	failures  int
+	downSince time.Time
+	openUntil time.Time
+	probing   bool
+}
+
+func newCircuitBreaker(transport http.RoundTripper, threshold int, cooldown time.Duration) *circuitBreaker {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return &circuitBreaker{transport: transport, threshold: threshold, cooldown: cooldown}
+}
+
+func (b *circuitBreaker) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+
+	resp, err := b.transport.RoundTrip(req)
+	b.record(err == nil && resp.StatusCode < http.StatusBadGateway)
+	return resp, err
+}
+
+func (b *circuitBreaker) allow() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.failures < b.threshold {
+		return nil
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return fmt.Errorf("OpenStack cloud unavailable since %s, next try after %s",
+			b.downSince.Format(time.RFC3339), b.openUntil.Format(time.RFC3339))
+	}
+
+	// cool-down over: let this request find out if it is back
+	b.probing = true
+	return nil
+}
+
+func (b *circuitBreaker) record(success bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.probing = false
+
+	if success {
+		if b.failures >= b.threshold {
+			log.Infof("OpenStack cloud available again, after an outage since %s", b.downSince.Format(time.RFC3339))
+		}
+		b.failures = 0
+		return
+	}
+
+	if b.failures == 0 {
+		b.downSince = time.Now()
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		if b.failures == b.threshold {
+			log.Errorf("OpenStack cloud unavailable: %d consecutive failures, failing fast for %s", b.failures, b.cooldown)
+		}
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
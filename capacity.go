@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Sent to capacityWebhook when a volume crosses a threshold
+type capacityEvent struct {
+	Volume      string     `json:"volume"`
+	VolumeID    string     `json:"volumeId,omitempty"`
+	Host        string     `json:"host"`
+	Threshold   int        `json:"threshold"`
+	UsedPercent int        `json:"usedPercent"`
+	Usage       *diskUsage `json:"usage"`
+	Time        time.Time  `json:"time"`
+}
+
+// Check the usage of the volumes mounted on this host every capacityInterval seconds,
+// and report the ones crossing capacityAlerts thresholds
+func (d plugin) watchCapacity() {
+	if len(d.config.CapacityAlerts) == 0 {
+		return
+	}
+
+	thresholds := append([]int{}, d.config.CapacityAlerts...)
+	sort.Ints(thresholds)
+	// highest threshold each mounted volume crossed
+	levels := make(map[string]int)
+
+	for {
+		time.Sleep(time.Duration(d.config.CapacityInterval) * time.Second)
+
+		d.mutex.Lock()
+		names := make([]string, 0, len(d.mounts))
+		for name := range d.mounts {
+			names = append(names, name)
+		}
+		d.mutex.Unlock()
+
+		// volumes not mounted anymore are forgotten
+		current := make(map[string]int)
+		for _, name := range names {
+			current[name] = d.checkCapacity(name, thresholds, levels[name])
+		}
+		levels = current
+	}
+}
+
+// Report a volume crossing a threshold upwards, and return the highest one it crossed
+func (d plugin) checkCapacity(name string, thresholds []int, level int) int {
+	logger := log.WithFields(log.Fields{"name": name, "action": "checkCapacity"})
+
+	mountpoint := d.recordedMountpoint(name)
+	if mountpoint == "" || isBlockDevice(filepath.Join(mountpoint, rawDeviceName)) {
+		return 0
+	}
+	usage, err := getDiskUsage(mountpoint)
+	if err != nil || usage.TotalBytes == 0 {
+		return level
+	}
+	used := int(usage.UsedBytes * 100 / usage.TotalBytes)
+
+	crossed := 0
+	for _, threshold := range thresholds {
+		if used >= threshold {
+			crossed = threshold
+		}
+	}
+	if crossed <= level {
+		// back below: alert again when crossing up
+		return crossed
+	}
+
+	event := capacityEvent{
+		Volume:      name,
+		Host:        d.hostname,
+		Threshold:   crossed,
+		UsedPercent: used,
+		Usage:       usage,
+		Time:        time.Now().UTC(),
+	}
+	if state, _ := d.state.get(name); state != nil {
+		event.VolumeID = state.VolumeID
+	}
+
+	logger.WithFields(log.Fields{"used": used, "threshold": crossed}).Warnf("Volume is %d%% full", used)
+	if d.config.CapacityWebhook != "" {
+		if err = postEvent(d.config.CapacityWebhook, &event); err != nil {
+			logger.WithError(err).Error("Error sending capacity alert")
+		}
+	}
+	return crossed
+}
+
+// POST an event to a webhook, as JSON
+func postEvent(url string, event interface{}) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Webhook returned %s", resp.Status)
+	}
+	return nil
+}
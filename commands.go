@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/snapshots"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/pagination"
+)
+
+// Admin commands, run instead of serving the plugin API:
+// docker-plugin-cinder -config cinder.json <command> [arguments]
+type command struct {
+	usage       string
+	description string
+	run         func(ctx context.Context, d *plugin, args []string) error
+}
+
+var commands = map[string]command{
+	"adopt": {
+		usage:       "<volume>",
+		description: "Mark a volume as managed by the plugin, for managedOnly mode, and as created by this Docker engine, for pruneProtection",
+		run:         cmdAdopt,
+	},
+	"bench": {
+		usage:       "[-count 10] [-concurrency 1] [-size 1] [-type <volume type>]",
+		description: "Create, mount, unmount and remove volumes, and report the latency percentiles of each step",
+		run:         cmdBench,
+	},
+	"doctor": {
+		usage:       "",
+		description: "Check required tools, mount directory, credentials, machine ID and volumes listing, and print a report",
+		run:         cmdDoctor,
+	},
+	"encrypt": {
+		usage:       "<volume>",
+		description: "Encrypt a plaintext volume in place with the current encryption key (ext filesystems; volume must not be in use)",
+		run:         cmdEncrypt,
+	},
+	"luks-check": {
+		usage:       "<volume>",
+		description: "Check the LUKS header and key of an encrypted volume, and report keyslots usage (volume must not be in use)",
+		run:         cmdLuksCheck,
+	},
+	"migrate": {
+		usage:       "<volume> <host@backend#pool> [--force-host-copy]",
+		description: "Move a volume to another Cinder backend, detaching it from this host first (volume must not be in use)",
+		run:         cmdMigrate,
+	},
+	"protect": {
+		usage:       "<volume>",
+		description: "Protect a volume against removal",
+		run:         cmdProtect,
+	},
+	"rekey": {
+		usage:       "<volume> [key ID]",
+		description: "Re-encrypt the LUKS key of a volume with another encryptionKeys key (default: encryptionKeyID; volume must not be in use)",
+		run:         cmdRekey,
+	},
+	"restore-luks-header": {
+		usage:       "<volume>",
+		description: "Restore the LUKS header of an encrypted volume from its backup (volume must not be in use)",
+		run:         cmdRestoreLuksHeader,
+	},
+	"unprotect": {
+		usage:       "<volume>",
+		description: "Allow removing a protected volume",
+		run:         cmdUnprotect,
+	},
+	"snapshot": {
+		usage:       "<volume> [snapshot name]",
+		description: "Take a snapshot of a volume, freezing its filesystem if mounted on this host",
+		run:         cmdSnapshot,
+	},
+}
+
+func printCommands() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "\nCommands:\n")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s %s\n    \t%s\n", name, commands[name].usage, commands[name].description)
+	}
+}
+
+func runCommand(d *plugin, args []string) error {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		printCommands()
+		return fmt.Errorf("Unknown command: %s", args[0])
+	}
+
+	// interrupting a command cancels its waits
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err := cmd.run(ctx, d, args[1:])
+	if err == errUsage {
+		return fmt.Errorf("Usage: %s %s", args[0], cmd.usage)
+	}
+	return err
+}
+
+var errUsage = errors.New("usage")
+
+func cmdSnapshot(ctx context.Context, d *plugin, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errUsage
+	}
+
+	logger := log.WithContext(ctx).WithFields(log.Fields{"name": args[0], "action": "snapshot"})
+
+	vol, err := d.getByName(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%s", vol.Name, time.Now().UTC().Format("20060102-150405"))
+	if len(args) == 2 {
+		name = args[1]
+	}
+
+	snap, err := d.takeSnapshot(logger, vol, snapshots.CreateOpts{
+		VolumeID: vol.ID,
+		Name:     name,
+		Force:    true,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s\t%s\t%s\n", snap.ID, snap.Name, snap.Status)
+	return nil
+}
+
+func cmdAdopt(ctx context.Context, d *plugin, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	// getByName would skip the volume we are looking for in managedOnly mode
+	var vol *volumes.Volume
+	name := d.cinderName(args[0])
+	pager := volumes.List(d.block(ctx), volumes.ListOpts{Name: name})
+	err := pager.EachPage(func(page pagination.Page) (bool, error) {
+		vList, err := volumes.ExtractVolumes(page)
+		if err != nil {
+			return false, err
+		}
+		for _, v := range vList {
+			if v.Name == name {
+				if vol != nil {
+					return false, fmt.Errorf("Several volumes named %s", args[0])
+				}
+				v := v
+				vol = &v
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	if vol == nil {
+		return fmt.Errorf("Volume %s not found", args[0])
+	}
+	if vol.Bootable == "true" {
+		return fmt.Errorf("Volume %s is bootable, refusing to manage it", args[0])
+	}
+
+	metadata := make(map[string]string)
+	for k, v := range vol.Metadata {
+		metadata[k] = v
+	}
+	metadata[metaManaged] = "true"
+	metadata[metaName] = args[0]
+	metadata[metaEngineID] = d.engineID
+
+	_, err = volumes.Update(d.block(ctx), vol.ID, volumes.UpdateOpts{Metadata: metadata}).Extract()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s\t%s\tmanaged\n", vol.ID, vol.Name)
+	return nil
+}
+
+func cmdRestoreLuksHeader(ctx context.Context, d *plugin, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	if d.config.LuksHeaderBackup == "" {
+		return errors.New("No luksHeaderBackup in config")
+	}
+
+	logger := log.WithContext(ctx).WithFields(log.Fields{"name": args[0], "action": "restore-luks-header"})
+
+	// rewriting the header of a volume in use corrupts it
+	vol, err := d.getByName(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	for _, att := range vol.Attachments {
+		if !d.isAttachedHere(att) {
+			return fmt.Errorf("Volume %s is attached to another host (%s%s), refusing to restore its LUKS header", args[0], att.ServerID, att.HostName)
+		}
+	}
+	if luksName := luksMapperName(args[0]); isBlockDevice("/dev/mapper/" + luksName) {
+		return fmt.Errorf("Volume %s is open on this host (/dev/mapper/%s), stop its containers first", args[0], luksName)
+	}
+
+	dev, vol, err := attachVolume(ctx, d, args[0])
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if _, err := d.detachVolume(logger.Context, vol); err != nil {
+			logger.WithError(err).Error("Error detaching volume")
+		}
+	}()
+
+	if err = d.restoreLuksHeader(ctx, dev, vol); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s\t%s\tLUKS header restored\n", vol.ID, vol.Name)
+	return nil
+}
+
+func cmdLuksCheck(ctx context.Context, d *plugin, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	logger := log.WithContext(ctx).WithFields(log.Fields{"name": args[0], "action": "luks-check"})
+
+	vol, err := d.getByName(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if len(vol.Attachments) > 0 {
+		return fmt.Errorf("Volume %s is attached to server %s, refusing to check it", args[0], vol.Attachments[0].ServerID)
+	}
+
+	keyfile, err := d.keyFile(vol)
+	if err != nil {
+		return err
+	}
+	if keyfile == "" {
+		return errors.New("No encryption key configured for this volume")
+	}
+
+	dev, vol, err := attachVolume(ctx, d, args[0])
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if _, err := d.detachVolume(logger.Context, vol); err != nil {
+			logger.WithError(err).Error("Error detaching volume")
+		}
+	}()
+
+	header, removeHeader, err := d.fetchDetachedHeader(ctx, vol)
+	if err != nil {
+		return err
+	}
+	defer removeHeader()
+
+	check, err := checkLuks(dev, keyfile, header)
+	if check != nil {
+		fmt.Printf("volume:\t%s (%s)\n", vol.Name, vol.ID)
+		fmt.Printf("LUKS version:\t%s\n", check.Version)
+		fmt.Printf("used keyslots:\t%s\n", strings.Join(check.UsedSlots, ", "))
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("key unlocks:\tkeyslot %s\n", check.UnlockedSlot)
+
+	return nil
+}
+
+func cmdRekey(ctx context.Context, d *plugin, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errUsage
+	}
+
+	logger := log.WithContext(ctx).WithFields(log.Fields{"name": args[0], "action": "rekey"})
+
+	newID := d.config.EncryptionKeyID
+	if len(args) == 2 {
+		newID = args[1]
+	}
+	newKey, ok := d.config.EncryptionKeys[newID]
+	if !ok {
+		return fmt.Errorf("Key %s not in encryptionKeys", newID)
+	}
+
+	vol, err := d.getByName(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if len(vol.Attachments) > 0 {
+		return fmt.Errorf("Volume %s is attached to server %s, refusing to rekey it", args[0], vol.Attachments[0].ServerID)
+	}
+	if _, secret := vol.Metadata[metaKeySecret]; secret {
+		return fmt.Errorf("Volume %s uses a key secret, refusing to rekey it", args[0])
+	}
+	// its header is shared with the volumes created from its snapshots
+	if hasDetachedHeader(vol) {
+		return fmt.Errorf("Volume %s has a detached LUKS header, refusing to rekey it", args[0])
+	}
+	if vol.Metadata[metaKeyID] == newID {
+		return fmt.Errorf("Volume %s already uses key %s", args[0], newID)
+	}
+
+	oldKey, err := d.keyFile(vol)
+	if err != nil {
+		return err
+	}
+	if oldKey == "" {
+		return errors.New("No encryption key configured for this volume")
+	}
+
+	// derived volumes get the key derived from the new master key
+	if vol.Metadata[metaKeyDerivation] == keyDerivationHKDF {
+		if newKey, err = derivedKeyFile(newKey, keyDerivationID(vol)); err != nil {
+			return err
+		}
+	}
+
+	dev, vol, err := attachVolume(ctx, d, args[0])
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if _, err := d.detachVolume(logger.Context, vol); err != nil {
+			logger.WithError(err).Error("Error detaching volume")
+		}
+	}()
+
+	// add the new key, record it, then remove the old one:
+	// whatever fails, the volume can still be opened with its recorded key
+	keys := &keyFiles{}
+	defer keys.close()
+	oldPath, err := keys.path(oldKey)
+	if err != nil {
+		return err
+	}
+	newPath, err := keys.path(newKey)
+	if err != nil {
+		return err
+	}
+	addKey := []string{"luksAddKey", "-q", "-d", oldPath}
+	if fipsMode {
+		addKey = append(addKey, fipsKeyslotArgs...)
+	}
+	out, err := keys.attach(hostCommand("cryptsetup", append(addKey, dev, newPath)...)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("luksAddKey command failed - %s", out)
+	}
+	keys.close()
+
+	metadata := make(map[string]string)
+	for k, v := range vol.Metadata {
+		metadata[k] = v
+	}
+	metadata[metaKeyID] = newID
+	if _, err = volumes.Update(d.block(ctx), vol.ID, volumes.UpdateOpts{Metadata: metadata}).Extract(); err != nil {
+		return err
+	}
+
+	if oldPath, err = keys.path(oldKey); err != nil {
+		return err
+	}
+	out, err = keys.attach(hostCommand("cryptsetup", "luksRemoveKey", "-q", dev, oldPath)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("luksRemoveKey command failed, old key still valid - %s", out)
+	}
+
+	if d.config.LuksHeaderBackup != "" {
+		if err = d.backupLuksHeader(ctx, dev, vol); err != nil {
+			logger.WithError(err).Error("Error backing up LUKS header")
+		}
+	}
+
+	fmt.Printf("%s\t%s\tnow uses key %s\n", vol.ID, vol.Name, newID)
+	return nil
+}
+
+func cmdMigrate(ctx context.Context, d *plugin, args []string) error {
+	if len(args) < 2 || len(args) > 3 || (len(args) == 3 && args[2] != "--force-host-copy") {
+		return errUsage
+	}
+
+	logger := log.WithContext(ctx).WithFields(log.Fields{"name": args[0], "action": "migrate"})
+
+	vol, err := d.getByName(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	logger = logger.WithField("id", vol.ID)
+
+	if mounted, _ := isMounted(d.mountPath(args[0], vol)); mounted {
+		return fmt.Errorf("Volume %s is mounted on this host, stop its containers first", args[0])
+	}
+
+	// leftover attachment to this host: release it, Cinder only migrates available volumes
+	// without Nova's help
+	for _, att := range vol.Attachments {
+		if !d.isAttachedHere(att) {
+			return fmt.Errorf("Volume %s is attached to another host (%s%s), refusing to migrate it", args[0], att.ServerID, att.HostName)
+		}
+	}
+	if len(vol.Attachments) > 0 {
+		logger.Info("Detaching volume from this host")
+		if _, err = d.detachVolume(logger.Context, vol); err != nil {
+			return err
+		}
+		if vol, err = volumes.Get(d.block(ctx), vol.ID).Extract(); err != nil {
+			return err
+		}
+		if vol, err = d.waitOnVolumeStateFor(logger.Context, vol, "available", d.config.detachTimeout()); err != nil {
+			return err
+		}
+	}
+
+	if err = d.migrateVolume(ctx, logger, vol, args[1], len(args) == 3); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s\t%s\tmigrated to %s\n", vol.ID, vol.Name, args[1])
+	return nil
+}
+
+func cmdProtect(ctx context.Context, d *plugin, args []string) error {
+	return setProtected(ctx, d, args, true)
+}
+
+func cmdUnprotect(ctx context.Context, d *plugin, args []string) error {
+	return setProtected(ctx, d, args, false)
+}
+
+func setProtected(ctx context.Context, d *plugin, args []string, protected bool) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	vol, err := d.getByName(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	metadata := make(map[string]string)
+	for k, v := range vol.Metadata {
+		metadata[k] = v
+	}
+	metadata[metaProtected] = strconv.FormatBool(protected)
+
+	if _, err = volumes.Update(d.block(ctx), vol.ID, volumes.UpdateOpts{Metadata: metadata}).Extract(); err != nil {
+		return err
+	}
+
+	state := "protected"
+	if !protected {
+		state = "unprotected"
+	}
+	fmt.Printf("%s\t%s\t%s\n", vol.ID, vol.Name, state)
+	return nil
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Version of the config file layout, bumped when keys are renamed
+const currentConfigVersion = 1
+
+// Keys renamed by each config version: old key -> new key
+var configRenames = map[int]map[string]string{
+	// Keystone v3 names, i.e. copied from an openrc file or clouds.yaml, were silently ignored
+	1: {
+		"projectName": "tenantName",
+		"projectId":   "tenantId",
+		"region_name": "region",
+		"auth_url":    "endpoint",
+	},
+}
+
+// Keys of the config file (lower case, JSON keys match case-insensitively)
+func configKeys() map[string]string {
+	keys := make(map[string]string)
+	t := reflect.TypeOf(tConfig{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = t.Field(i).Name
+		}
+		keys[strings.ToLower(name)] = name
+	}
+	return keys
+}
+
+// Read a config file, then the *.json files of its drop-in directory (cinder.json: cinder.d/)
+// in lexicographic order, each over the previous ones. Maps are merged, other keys replaced.
+// Returns the files read.
+func loadConfigFiles(path string, config *tConfig) ([]string, error) {
+	loaded := []string{}
+
+	// drop-in files may hold the whole config
+	mainErr := loadConfigFile(path, config)
+	if mainErr == nil {
+		loaded = append(loaded, path)
+	} else if !os.IsNotExist(mainErr) {
+		return loaded, mainErr
+	}
+
+	dir := strings.TrimSuffix(path, filepath.Ext(path)) + ".d"
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return loaded, err
+	}
+	// Glob sorts file names
+	for _, file := range files {
+		if err = loadConfigFile(file, config); err != nil {
+			return loaded, err
+		}
+		loaded = append(loaded, file)
+	}
+	if len(files) == 0 {
+		return loaded, mainErr
+	}
+	return loaded, nil
+}
+
+// Read a config file into config, over the values already set (flag defaults):
+// migrate the keys of older layouts, and check there is no unknown key
+func loadConfigFile(path string, config *tConfig) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var raw map[string]json.RawMessage
+	if err = json.Unmarshal(content, &raw); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	logger := log.WithField("config", path)
+
+	version := 0
+	for key, value := range raw {
+		if strings.EqualFold(key, "configVersion") {
+			if err = json.Unmarshal(value, &version); err != nil {
+				return fmt.Errorf("%s: invalid configVersion", path)
+			}
+		}
+	}
+	if version > currentConfigVersion {
+		return fmt.Errorf("%s: configVersion %d is newer than this plugin's (%d), upgrade the plugin", path, version, currentConfigVersion)
+	}
+
+	for v := version + 1; v <= currentConfigVersion; v++ {
+		for oldKey, newKey := range configRenames[v] {
+			value, ok := raw[oldKey]
+			if !ok {
+				continue
+			}
+			if _, ok = raw[newKey]; ok {
+				return fmt.Errorf("%s: both %s and %s are set, remove %s", path, oldKey, newKey, oldKey)
+			}
+			logger.Warnf("Config key %s is now %s, rename it and set configVersion %d", oldKey, newKey, currentConfigVersion)
+			raw[newKey] = value
+			delete(raw, oldKey)
+		}
+	}
+
+	// unversioned files may hold keys ignored so far: don't refuse to start over them
+	keys := configKeys()
+	unknown := []string{}
+	for key := range raw {
+		if _, ok := keys[strings.ToLower(key)]; !ok {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		msg := fmt.Sprintf("Unknown config key %s", key)
+		if suggestion := closestConfigKey(key, keys); suggestion != "" {
+			msg += fmt.Sprintf(", did you mean %s?", suggestion)
+		}
+		if version == 0 {
+			logger.Warnf("%s (ignored, an error once configVersion is set)", msg)
+			continue
+		}
+		return fmt.Errorf("%s: %s", path, msg)
+	}
+	if version == 0 {
+		logger.Warnf("No configVersion in config, set it to %d once the warnings above are fixed", currentConfigVersion)
+	}
+
+	if content, err = json.Marshal(raw); err != nil {
+		return err
+	}
+	if err = json.Unmarshal(content, config); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// Flag of a list or map config key, set as JSON like in config files
+type jsonFlag struct {
+	value interface{}
+}
+
+func (f jsonFlag) String() string {
+	if f.value == nil || reflect.ValueOf(f.value).Elem().Len() == 0 {
+		return ""
+	}
+	out, _ := json.Marshal(f.value)
+	return string(out)
+}
+
+func (f jsonFlag) Set(value string) error {
+	return json.Unmarshal([]byte(value), f.value)
+}
+
+// Prefix of the environment variables setting config keys, i.e. set with docker plugin set
+const configEnvPrefix = "OS_"
+
+// Usual OpenStack variables (openrc files), for the keys they stand for
+var configEnvAliases = map[string]string{
+	"OS_AUTH_URL":                      "endpoint",
+	"OS_USER_DOMAIN_NAME":              "domainName",
+	"OS_USER_DOMAIN_ID":                "domainID",
+	"OS_PROJECT_NAME":                  "tenantName",
+	"OS_PROJECT_ID":                    "tenantId",
+	"OS_REGION_NAME":                   "region",
+	"OS_APPLICATION_CREDENTIAL_ID":     "applicationCredentialId",
+	"OS_APPLICATION_CREDENTIAL_NAME":   "applicationCredentialName",
+	"OS_APPLICATION_CREDENTIAL_SECRET": "applicationCredentialSecret",
+}
+
+// Environment variable of a config key: OS_ and the key in upper snake case (timeoutAPI: OS_TIMEOUT_API)
+func configEnvName(key string) string {
+	var b strings.Builder
+	runes := []rune(key)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) && (unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+			b.WriteRune('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return configEnvPrefix + b.String()
+}
+
+// Set config keys from environment variables, over the config files.
+// Empty variables are ignored: managed plugins declare all the variables they accept, unset ones empty.
+// A variable changing a key the config files set (away from its default) is logged as a warning:
+// i.e. the OS_ variables of an openrc file sourced in the environment of a service would switch clouds.
+// Returns whether any key was set.
+func loadConfigEnv(config *tConfig, defaults *tConfig) (bool, error) {
+	v := reflect.ValueOf(config).Elem()
+	dv := reflect.ValueOf(defaults).Elem()
+	t := v.Type()
+	fields := make(map[string]int)
+	keys := make([]string, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = strings.ToLower(t.Field(i).Name[:1]) + t.Field(i).Name[1:]
+		}
+		fields[configEnvName(name)] = i
+		keys[i] = name
+	}
+	for env, key := range configEnvAliases {
+		fields[env] = fields[configEnvName(key)]
+	}
+
+	set := false
+	for _, variable := range os.Environ() {
+		parts := strings.SplitN(variable, "=", 2)
+		i, ok := fields[parts[0]]
+		if !ok || parts[1] == "" {
+			continue
+		}
+		field := v.Field(i)
+		fromFile := !reflect.DeepEqual(field.Interface(), dv.Field(i).Interface())
+		previous := fmt.Sprint(field.Interface())
+		value := parts[1]
+		var err error
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Bool:
+			var b bool
+			b, err = strconv.ParseBool(value)
+			field.SetBool(b)
+		case reflect.Int:
+			var n int
+			n, err = strconv.Atoi(value)
+			field.SetInt(int64(n))
+		default:
+			// lists and maps, as in config files
+			err = json.Unmarshal([]byte(value), field.Addr().Interface())
+		}
+		if err != nil {
+			return set, fmt.Errorf("Invalid %s: %w", parts[0], err)
+		}
+		if fromFile && fmt.Sprint(field.Interface()) != previous {
+			// values may be secrets
+			log.WithFields(log.Fields{"variable": parts[0], "key": keys[i]}).Warnf("Environment variable %s overrides %s of the config file", parts[0], keys[i])
+		}
+		set = true
+	}
+	return set, nil
+}
+
+// Known key a typo is likely to stand for, if any
+func closestConfigKey(key string, keys map[string]string) string {
+	best, bestDistance := "", 3
+	for lower, name := range keys {
+		d := editDistance(strings.ToLower(key), lower)
+		if d < bestDistance || (d == bestDistance && best != "" && name < best) {
+			best, bestDistance = name, d
+		}
+	}
+	return best
+}
+
+// Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
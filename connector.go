@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/extensions/volumeactions"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/attachments"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	connectorNova   = "nova"
+	connectorISCSI  = "iscsi"
+	connectorFC     = "fc"
+	connectorNVMeOF = "nvmeof"
+	connectorRBD    = "rbd"
+	connectorLocal  = "local"
+
+	// Cinder API version with attachments create and complete
+	attachmentsMicroversion = "3.44"
+)
+
+// Transport attaching volumes to this host without Nova
+type localConnector interface {
+	// driver_volume_type of the connections it handles
+	volumeType() string
+	// connector properties Cinder needs to export a volume to this host
+	properties(hostname string) (map[string]interface{}, error)
+	// connect to an exported volume and return its device, also when already connected
+	connect(ctx context.Context, data map[string]interface{}, timeout int) (string, error)
+	// disconnect from an exported volume
+	disconnect(data map[string]interface{}) error
+}
+
+// Local connector for a connector config value, nil for nova
+func newLocalConnector(name string) (localConnector, error) {
+	switch name {
+	case connectorNova:
+		return nil, nil
+	case connectorISCSI:
+		return iscsiConnector{}, nil
+	case connectorFC:
+		return fcConnector{}, nil
+	case connectorNVMeOF:
+		return nvmeofConnector{}, nil
+	case connectorRBD:
+		return rbdConnector{}, nil
+	case connectorLocal:
+		return localDeviceConnector{}, nil
+	}
+	return nil, fmt.Errorf("Invalid connector %s, use %s, %s, %s, %s, %s or %s", name, connectorNova, connectorISCSI, connectorFC, connectorNVMeOF, connectorRBD, connectorLocal)
+}
+
+func baseProperties(hostname string) map[string]interface{} {
+	return map[string]interface{}{
+		"host":      hostname,
+		"multipath": false,
+		"platform":  runtime.GOARCH,
+		"os_type":   runtime.GOOS,
+	}
+}
+
+// Connection data from Cinder's connection info
+func (d plugin) connectionData(info map[string]interface{}) (map[string]interface{}, error) {
+	if volumeType, _ := info["driver_volume_type"].(string); volumeType != d.local.volumeType() {
+		return nil, fmt.Errorf("Volume is exported with %v, but connector is %s", info["driver_volume_type"], d.local.volumeType())
+	}
+
+	data, ok := info["data"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("No connection data for volume")
+	}
+	return data, nil
+}
+
+// Ask Cinder to export a volume to this host.
+// Standalone, through an attachment, else reserving the volume.
+func (d plugin) exportVolume(ctx context.Context, vol *volumes.Volume, properties map[string]interface{}) (string, map[string]interface{}, error) {
+	if d.config.Standalone {
+		att, err := createAttachment(d.block(ctx), vol.ID, properties)
+		if err != nil {
+			return "", nil, err
+		}
+		data, err := d.connectionData(att.ConnectionInfo)
+		if err != nil {
+			// rollbacks run even when the operation was cancelled
+			attachments.Delete(d.blockClient, att.ID)
+		}
+		return att.ID, data, err
+	}
+
+	if err := volumeactions.Reserve(d.block(ctx), vol.ID).ExtractErr(); err != nil {
+		return "", nil, err
+	}
+	info, err := initializeConnection(d.block(ctx), vol.ID, properties)
+	if err == nil {
+		var data map[string]interface{}
+		if data, err = d.connectionData(info); err == nil {
+			return "", data, nil
+		}
+		terminateConnection(d.blockClient, vol.ID, properties)
+	}
+	volumeactions.Unreserve(d.blockClient, vol.ID)
+	return "", nil, err
+}
+
+// Connection data of a volume already exported to this host
+func (d plugin) exportedVolume(ctx context.Context, vol *volumes.Volume, att volumes.Attachment) (map[string]interface{}, error) {
+	var info map[string]interface{}
+
+	if d.config.Standalone {
+		attachment, err := attachments.Get(d.block(ctx), att.AttachmentID).Extract()
+		if err != nil {
+			return nil, err
+		}
+		info = attachment.ConnectionInfo
+	} else {
+		properties, err := d.local.properties(d.hostname)
+		if err != nil {
+			return nil, err
+		}
+		if info, err = initializeConnection(d.block(ctx), vol.ID, properties); err != nil {
+			return nil, err
+		}
+	}
+
+	return d.connectionData(info)
+}
+
+// Attach an available volume to this host without Nova
+func (d plugin) localAttach(logger *log.Entry, vol *volumes.Volume) (string, error) {
+	properties, err := d.local.properties(d.hostname)
+	if err != nil {
+		return "", err
+	}
+
+	attachmentID, data, err := d.exportVolume(logger.Context, vol, properties)
+	if err != nil {
+		return "", err
+	}
+
+	dev, err := d.local.connect(logger.Context, data, d.config.TimeoutDeviceWait)
+	if err == nil {
+		if d.config.Standalone {
+			err = attachments.Complete(d.block(logger.Context), attachmentID).ExtractErr()
+		} else {
+			mode := volumeactions.ReadWrite
+			if metadataBool(vol, metaReadOnly, false) {
+				mode = volumeactions.ReadOnly
+			}
+			err = volumeactions.Attach(d.block(logger.Context), vol.ID, volumeactions.AttachOpts{
+				MountPoint: dev,
+				HostName:   d.hostname,
+				Mode:       mode,
+			}).ExtractErr()
+		}
+	}
+	if err == nil {
+		return dev, nil
+	}
+
+	// back to available, even when the operation was cancelled
+	if disconnectErr := d.local.disconnect(data); disconnectErr != nil {
+		logger.WithError(disconnectErr).Warn("Error disconnecting volume")
+	}
+	if d.config.Standalone {
+		attachments.Delete(d.blockClient, attachmentID)
+	} else {
+		terminateConnection(d.blockClient, vol.ID, properties)
+		volumeactions.Unreserve(d.blockClient, vol.ID)
+	}
+	return "", err
+}
+
+// Device of a volume attached to this host without Nova, connecting again if needed
+// (i.e. iSCSI sessions don't survive reboots)
+func (d plugin) localReconnect(logger *log.Entry, vol *volumes.Volume, att volumes.Attachment) (string, error) {
+	data, err := d.exportedVolume(logger.Context, vol, att)
+	if err != nil {
+		return "", err
+	}
+	return d.local.connect(logger.Context, data, 0)
+}
+
+// Detach an attachment made without Nova: disconnect it if it is local,
+// and tell Cinder to stop exporting it
+func (d plugin) localDetach(logger *log.Entry, vol *volumes.Volume, att volumes.Attachment) error {
+	properties := map[string]interface{}{"host": att.HostName}
+
+	if att.HostName == d.hostname {
+		data, err := d.exportedVolume(logger.Context, vol, att)
+		if err != nil {
+			return err
+		}
+		if err = d.local.disconnect(data); err != nil {
+			return err
+		}
+		if properties, err = d.local.properties(d.hostname); err != nil {
+			return err
+		}
+	} else {
+		logger.Warnf("Volume attached to host %s without Nova, detaching it on the Cinder side only", att.HostName)
+	}
+
+	if d.config.Standalone {
+		return attachments.Delete(d.block(logger.Context), att.AttachmentID).ExtractErr()
+	}
+
+	if err := terminateConnection(d.block(logger.Context), vol.ID, properties); err != nil {
+		return err
+	}
+	return volumeactions.Detach(d.block(logger.Context), vol.ID, volumeactions.DetachOpts{AttachmentID: att.AttachmentID}).ExtractErr()
+}
+
+// Attachment of a volume to a host, not to a Nova server
+// (gophercloud always sends an instance_uuid)
+func createAttachment(client *gophercloud.ServiceClient, volumeID string, properties map[string]interface{}) (*attachments.Attachment, error) {
+	body := map[string]interface{}{
+		"attachment": map[string]interface{}{
+			"volume_uuid": volumeID,
+			"connector":   properties,
+		},
+	}
+
+	var result struct {
+		Attachment attachments.Attachment `json:"attachment"`
+	}
+	resp, err := client.Post(client.ServiceURL("attachments"), body, &result, &gophercloud.RequestOpts{
+		OkCodes: []int{200},
+	})
+	if _, _, err = gophercloud.ParseResponse(resp, err); err != nil {
+		return nil, err
+	}
+	return &result.Attachment, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// What the host's cryptsetup can do
+type cryptsetupInfo struct {
+	Path      string `json:"path"`
+	Version   string `json:"version"`
+	LUKS2     bool   `json:"luks2"`
+	Integrity bool   `json:"integrity"`
+	Reencrypt bool   `json:"reencrypt"`
+}
+
+var cryptsetupVersion = regexp.MustCompile(`(\d+)\.(\d+)\.(\d+)`)
+
+func detectCryptsetup() (*cryptsetupInfo, error) {
+	path, err := lookPath("cryptsetup")
+	if err != nil {
+		return nil, fmt.Errorf("cryptsetup not found: %w", err)
+	}
+	info := &cryptsetupInfo{Path: path}
+
+	out, err := hostCommand(path, "--version").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("cryptsetup --version failed - %s", out)
+	}
+	version := cryptsetupVersion.FindStringSubmatch(string(out))
+	if version == nil {
+		return nil, fmt.Errorf("Unexpected cryptsetup version: %s", out)
+	}
+	info.Version = version[0]
+	major, _ := strconv.Atoi(version[1])
+	minor, _ := strconv.Atoi(version[2])
+
+	// LUKS2 appeared in cryptsetup 2.0, online reencryption in 2.2
+	info.LUKS2 = major >= 2
+	help, _ := hostCommand(path, "--help").CombinedOutput()
+	info.Reencrypt = (major > 2 || (major == 2 && minor >= 2)) && strings.Contains(string(help), "reencrypt")
+	info.Integrity = info.LUKS2 && strings.Contains(string(help), "--integrity")
+
+	return info, nil
+}
+
+// Check cryptsetup supports what the config requires
+func (c *cryptsetupInfo) check(config *tConfig) error {
+	if config.LuksType == "luks2" && !c.LUKS2 {
+		return fmt.Errorf("luksType luks2 requires cryptsetup 2.0+, found %s", c.Version)
+	}
+	return nil
+}
+
+// Result of a LUKS volume check
+type luksCheck struct {
+	Version      string
+	UsedSlots    []string
+	UnlockedSlot string
+}
+
+var (
+	luksDumpVersion = regexp.MustCompile(`(?m)^Version:\s+(\d+)`)
+	// LUKS1: "Key Slot 0: ENABLED"
+	luks1Slot = regexp.MustCompile(`(?m)^Key Slot (\d+): ENABLED`)
+	// LUKS2: "  0: luks2" in the "Keyslots:" section
+	luks2Slot    = regexp.MustCompile(`(?m)^\s+(\d+): luks2`)
+	luksUnlocked = regexp.MustCompile(`Key slot (\d+) unlocked`)
+)
+
+// UUID of a LUKS header
+func luksUUID(dev string) (string, error) {
+	out, err := hostCommand("cryptsetup", "luksUUID", dev).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("luksUUID command failed - %s", out)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Check a LUKS device without opening it:
+// header is valid, key unlocks a keyslot, and which keyslots are used
+func checkLuks(dev string, keyfile string, header string) (*luksCheck, error) {
+	check := &luksCheck{}
+
+	out, err := hostCommand("cryptsetup", "luksDump", headerOrDevice(header, dev)).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid LUKS header - %s", out)
+	}
+	if version := luksDumpVersion.FindSubmatch(out); version != nil {
+		check.Version = string(version[1])
+	}
+
+	slotRegexp := luks1Slot
+	dump := string(out)
+	if check.Version == "2" {
+		slotRegexp = luks2Slot
+		// only look at the keyslots section
+		if i := strings.Index(dump, "Keyslots:"); i >= 0 {
+			dump = dump[i:]
+			if j := strings.Index(dump, "Tokens:"); j >= 0 {
+				dump = dump[:j]
+			}
+		}
+	}
+	for _, slot := range slotRegexp.FindAllStringSubmatch(dump, -1) {
+		check.UsedSlots = append(check.UsedSlots, slot[1])
+	}
+
+	keys := &keyFiles{}
+	defer keys.close()
+	key, err := keys.path(keyfile)
+	if err != nil {
+		return check, err
+	}
+	args := append([]string{"open", "--test-passphrase", "-v", "-d", key}, headerArgs(header)...)
+	out, err = keys.attach(hostCommand("cryptsetup", append(args, dev)...)).CombinedOutput()
+	if err != nil {
+		return check, fmt.Errorf("Key does not unlock any keyslot - %s", out)
+	}
+	if slot := luksUnlocked.FindSubmatch(out); slot != nil {
+		check.UnlockedSlot = string(slot[1])
+	}
+
+	return check, nil
+}
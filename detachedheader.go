@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/extensions/backups"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/pagination"
+	log "github.com/sirupsen/logrus"
+)
+
+// Detached LUKS headers are written there for cryptsetup, while formatting or opening a volume: a tmpfs
+const detachedHeadersDir = "/run/docker-plugin-cinder/headers"
+
+// Name of the detached LUKS header of a new volume in luksHeaderStore.
+// Volumes created from its snapshots share it (recorded in their metadata).
+func detachedHeaderName(vol *volumes.Volume) string {
+	return vol.ID + ".luks-detached-header"
+}
+
+func hasDetachedHeader(vol *volumes.Volume) bool {
+	_, ok := vol.Metadata[metaDetachedHeader]
+	return ok
+}
+
+// Path of a header file for cryptsetup, removed by the returned function
+func newHeaderFile(vol *volumes.Volume) (string, func(), error) {
+	if err := os.MkdirAll(detachedHeadersDir, 0700); err != nil {
+		return "", nil, err
+	}
+	path := filepath.Join(detachedHeadersDir, vol.ID)
+	// cryptsetup creates it when formatting
+	os.Remove(path)
+	return path, func() { os.Remove(path) }, nil
+}
+
+// Fetch the detached LUKS header of a volume to a file for cryptsetup.
+// Returns an empty path for volumes with their header on the device.
+func (d plugin) fetchDetachedHeader(ctx context.Context, vol *volumes.Volume) (string, func(), error) {
+	name, ok := vol.Metadata[metaDetachedHeader]
+	if !ok {
+		return "", func() {}, nil
+	}
+	if d.config.LuksHeaderStore == "" {
+		return "", nil, fmt.Errorf("Volume %s has a detached LUKS header, but no luksHeaderStore is configured", vol.Name)
+	}
+
+	header, err := d.readHeaderObject(ctx, d.config.LuksHeaderStore, name)
+	if err != nil {
+		return "", nil, fmt.Errorf("Error reading detached LUKS header %s: %w", name, err)
+	}
+	path, cleanup, err := newHeaderFile(vol)
+	if err != nil {
+		return "", nil, err
+	}
+	if err = os.WriteFile(path, header, 0600); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return path, cleanup, nil
+}
+
+// Store the header file a volume was formatted with, and return its name
+func (d plugin) storeDetachedHeader(ctx context.Context, path string, vol *volumes.Volume) (string, error) {
+	header, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	name := detachedHeaderName(vol)
+	if err = d.writeHeaderObject(ctx, d.config.LuksHeaderStore, name, header, vol); err != nil {
+		return "", fmt.Errorf("Error storing detached LUKS header %s: %w", name, err)
+	}
+	return name, nil
+}
+
+// Delete the detached LUKS header of a deleted volume, unless other volumes share it
+// (copies of its snapshots, or the volume it was copied from) or backups may need it:
+// backups of the volumes sharing it, and of deleted volumes, which may have shared it
+func (d plugin) releaseDetachedHeader(logger *log.Entry, vol *volumes.Volume) {
+	name, ok := vol.Metadata[metaDetachedHeader]
+	if !ok || d.config.LuksHeaderStore == "" {
+		return
+	}
+	logger = logger.WithField("header", name)
+
+	users := 0
+	sharing := map[string]bool{vol.ID: true}
+	pager := volumes.List(d.block(logger.Context), volumes.ListOpts{Metadata: map[string]string{metaDetachedHeader: name}})
+	err := pager.EachPage(func(page pagination.Page) (bool, error) {
+		vList, err := volumes.ExtractVolumes(page)
+		if err != nil {
+			return false, err
+		}
+		for _, v := range vList {
+			if v.ID != vol.ID && v.Metadata[metaDetachedHeader] == name {
+				sharing[v.ID] = true
+				users++
+			}
+		}
+		return true, nil
+	})
+	if err == nil {
+		// restored backups get the volume's metadata back, header included
+		deleted := make(map[string]bool)
+		err = backups.List(d.block(logger.Context), backups.ListOpts{}).EachPage(func(page pagination.Page) (bool, error) {
+			bList, err := backups.ExtractBackups(page)
+			if err != nil {
+				return false, err
+			}
+			for _, b := range bList {
+				if sharing[b.VolumeID] {
+					users++
+					continue
+				}
+				gone, checked := deleted[b.VolumeID]
+				if !checked {
+					_, err := volumes.Get(d.block(logger.Context), b.VolumeID).Extract()
+					if _, notFound := err.(gophercloud.ErrDefault404); notFound {
+						gone = true
+					} else if err != nil {
+						return false, err
+					}
+					deleted[b.VolumeID] = gone
+				}
+				if gone {
+					users++
+				}
+			}
+			return true, nil
+		})
+	}
+	if err != nil {
+		logger.WithError(err).Warn("Error looking up users of detached LUKS header, keeping it")
+		return
+	}
+	if users > 0 {
+		logger.Debugf("Detached LUKS header still used by %d volume(s) or backup(s), keeping it", users)
+		return
+	}
+
+	if err = d.deleteHeaderObject(logger.Context, d.config.LuksHeaderStore, name); err != nil {
+		logger.WithError(err).Error("Error deleting detached LUKS header")
+		return
+	}
+	logger.Info("Detached LUKS header deleted")
+}
+
+// Where cryptsetup reads the LUKS header of a device from
+func headerOrDevice(header string, dev string) string {
+	if header == "" {
+		return dev
+	}
+	return hostPath(header)
+}
+
+// cryptsetup arguments using a header file, if any
+func headerArgs(header string) []string {
+	if header == "" {
+		return nil
+	}
+	return []string{"--header", hostPath(header)}
+}
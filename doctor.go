@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+	log "github.com/sirupsen/logrus"
+)
+
+type doctorCheck struct {
+	name string
+	// "PASS", "WARN" or "FAIL"
+	result string
+	detail string
+}
+
+// Startup failures: fatal, except for the doctor command, which reports them with its own checks
+type startupFailures struct {
+	doctor bool
+	checks []doctorCheck
+}
+
+func (s *startupFailures) fail(logger *log.Entry, name string, format string, a ...interface{}) {
+	if !s.doctor {
+		if logger == nil {
+			logger = log.NewEntry(log.StandardLogger())
+		}
+		logger.Fatalf(format, a...)
+	}
+	s.checks = append(s.checks, doctorCheck{name, "FAIL", fmt.Sprintf(format, a...)})
+}
+
+// Report the failures and exit when startup can't go on to the doctor's own checks
+func (s *startupFailures) stop() {
+	if err := printChecks(s.checks); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
+
+// Check the host and the configuration, and print a report
+func cmdDoctor(ctx context.Context, d *plugin, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	checks := append([]doctorCheck{}, d.startupChecks...)
+	check := func(name string, result string, format string, a ...interface{}) {
+		checks = append(checks, doctorCheck{name, result, fmt.Sprintf(format, a...)})
+	}
+
+	// tools
+	for _, tool := range d.requiredTools() {
+		if path, err := lookPath(tool); err != nil {
+			check("tool "+tool, "FAIL", "not found in PATH")
+		} else {
+			check("tool "+tool, "PASS", "%s", path)
+		}
+	}
+	enabled := make(map[string]bool)
+	for _, name := range d.config.enabledFilesystems() {
+		enabled[name] = true
+	}
+	for name := range filesystems {
+		if enabled[name] {
+			continue
+		}
+		if err := checkFilesystemTools(name, d.config.AutoGrow); err != nil {
+			check("filesystem "+name, "WARN", "%s (only needed for volumes created with filesystem=%s)", err, name)
+		}
+	}
+	if d.cryptsetup == nil {
+		if len(d.config.EncryptionKey) > 0 || len(d.config.EncryptionKeys) > 0 || d.config.DefaultEncryption {
+			check("cryptsetup", "FAIL", "not usable, but encryption is configured")
+		} else {
+			check("cryptsetup", "WARN", "not usable, encrypted volumes won't work")
+		}
+	} else {
+		check("cryptsetup", "PASS", "%s, LUKS2: %t", d.cryptsetup.Version, d.cryptsetup.LUKS2)
+	}
+
+	// mount directories
+	for _, root := range d.config.mountRoots() {
+		if stat, err := os.Stat(root); err != nil {
+			check("mountDir", "FAIL", "%s", err)
+		} else if !stat.IsDir() {
+			check("mountDir", "FAIL", "%s is not a directory", root)
+		} else if propagation, mountPoint, err := mountPropagation(root); err != nil {
+			check("mountDir", "WARN", "%s exists, propagation unknown: %s", root, err)
+		} else if propagation != "private" {
+			check("mountDir", "WARN", "%s is in %s mount %s: volume mounts propagate to other mount namespaces, make it a private mount (mount --bind --make-private)", root, propagation, mountPoint)
+		} else {
+			check("mountDir", "PASS", "%s, private mount", root)
+		}
+	}
+
+	// OpenStack
+	if d.provider.Token() == "" {
+		check("credentials", "FAIL", "no token")
+	} else {
+		check("credentials", "PASS", "authenticated on %s", d.provider.IdentityEndpoint)
+	}
+	if d.local != nil {
+		check("machine ID", "PASS", "not needed with %s connector, attaching as host %s", d.config.Connector, d.hostname)
+	} else if server, err := servers.Get(d.compute(ctx), d.machineID()).Extract(); err != nil {
+		check("machine ID", "FAIL", "server %s: %s", d.machineID(), err)
+	} else {
+		check("machine ID", "PASS", "%s (%s, %s)", server.ID, server.Name, server.Status)
+	}
+	if resp, err := d.List(); err != nil {
+		check("volumes list", "FAIL", "%s", err)
+	} else {
+		check("volumes list", "PASS", "%d volume(s)", len(resp.Volumes))
+	}
+
+	return printChecks(checks)
+}
+
+func printChecks(checks []doctorCheck) error {
+	failed := 0
+	for _, c := range checks {
+		fmt.Printf("%s\t%s\t%s\n", c.result, c.name, c.detail)
+		if c.result == "FAIL" {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d check(s) failed", failed)
+	}
+	return nil
+}
+
+// Tools used whatever the volumes
+func (d plugin) requiredTools() []string {
+	tools := []string{"mount", "blkid", "blockdev", "fsfreeze"}
+	listed := make(map[string]bool)
+	for _, filesystem := range d.config.enabledFilesystems() {
+		fsTools := []string{"mkfs." + filesystem}
+		if spec, ok := filesystems[filesystem]; ok && d.config.AutoGrow {
+			fsTools = append(fsTools, spec.growTools...)
+		}
+		for _, tool := range fsTools {
+			if !listed[tool] {
+				listed[tool] = true
+				tools = append(tools, tool)
+			}
+		}
+	}
+	switch d.config.Connector {
+	case connectorISCSI:
+		tools = append(tools, "iscsiadm")
+	case connectorNVMeOF:
+		tools = append(tools, "nvme")
+	case connectorRBD:
+		tools = append(tools, "rbd")
+	}
+	return tools
+}
+
+// Propagation of the mount holding a path ("private", "shared", "slave"), and its mountpoint
+func mountPropagation(path string) (string, string, error) {
+	return mountPropagationIn(filepath.Join(procDir(), "mountinfo"), path)
+}
+
+// Same as mountPropagation, from a mountinfo file
+func mountPropagationIn(mountinfo string, path string) (string, string, error) {
+	path, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", "", err
+	}
+
+	f, err := os.Open(mountinfo)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	// format: [id] [parent] [major:minor] [root] [mountpoint] [options] [optional fields...] - ...
+	// the last mount on the longest mountpoint holding the path wins
+	mountPoint, propagation := "", ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 7 {
+			continue
+		}
+		mp := fields[4]
+		if mp != path && mp != "/" && !strings.HasPrefix(path, mp+"/") {
+			continue
+		}
+		if len(mp) < len(mountPoint) {
+			continue
+		}
+		mountPoint, propagation = mp, "private"
+		for _, field := range fields[6:] {
+			if field == "-" {
+				break
+			}
+			if strings.HasPrefix(field, "shared:") {
+				propagation = "shared"
+			} else if strings.HasPrefix(field, "master:") && propagation == "private" {
+				propagation = "slave"
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return "", "", err
+	}
+	if mountPoint == "" {
+		return "", "", errors.New("no mount found")
+	}
+	return propagation, mountPoint, nil
+}
@@ -0,0 +1,416 @@
+// Fake OpenStack cloud for end-to-end tests of the plugin without a cloud:
+// Keystone v3 password authentication, and the Cinder v3 calls the plugin makes in standalone mode.
+// Volumes are sparse files, exported through the attachments API as loop devices
+// ("local" connection info), so the plugin formats, encrypts and mounts real block devices.
+//
+// Run as root: go run ./e2e/fakecloud -listen 127.0.0.1:5000 -dir /tmp/fakecloud
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	projectID = "e2e0000000000000000000000000proj"
+	// gophercloud's JSONRFC3339MilliNoZ
+	timeFormat = "2006-01-02T15:04:05.000000"
+)
+
+type attachment struct {
+	ID             string                 `json:"id"`
+	VolumeID       string                 `json:"volume_id"`
+	Instance       string                 `json:"instance"`
+	Status         string                 `json:"status"`
+	AttachMode     string                 `json:"attach_mode"`
+	AttachedAt     string                 `json:"attached_at"`
+	ConnectionInfo map[string]interface{} `json:"connection_info"`
+	// not in the API
+	host   string
+	device string
+}
+
+type volume struct {
+	ID               string              `json:"id"`
+	Name             string              `json:"name"`
+	Description      string              `json:"description"`
+	Status           string              `json:"status"`
+	Size             int                 `json:"size"`
+	AvailabilityZone string              `json:"availability_zone"`
+	VolumeType       string              `json:"volume_type"`
+	Bootable         string              `json:"bootable"`
+	Metadata         map[string]string   `json:"metadata"`
+	CreatedAt        string              `json:"created_at"`
+	Attachments      []map[string]string `json:"attachments"`
+}
+
+type cloud struct {
+	mutex       sync.Mutex
+	dir         string
+	url         string
+	volumes     map[string]*volume
+	attachments map[string]*attachment
+}
+
+func main() {
+	listen := flag.String("listen", "127.0.0.1:5000", "Address to listen on")
+	dir := flag.String("dir", "/tmp/fakecloud", "Directory of the volume files")
+	flag.Parse()
+
+	if err := os.MkdirAll(*dir, 0700); err != nil {
+		log.Fatal(err)
+	}
+	c := &cloud{
+		dir:         *dir,
+		url:         "http://" + *listen,
+		volumes:     make(map[string]*volume),
+		attachments: make(map[string]*attachment),
+	}
+
+	http.HandleFunc("/v3/auth/tokens", c.authenticate)
+	http.HandleFunc("/volume/v3/"+projectID+"/", c.serveVolumes)
+	log.Printf("Fake cloud listening on %s, identity endpoint %s/v3/", *listen, c.url)
+	log.Fatal(http.ListenAndServe(*listen, nil))
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+func reply(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Openstack-Request-Id", "req-"+newID())
+	w.WriteHeader(code)
+	if body != nil {
+		json.NewEncoder(w).Encode(body)
+	}
+}
+
+func fail(w http.ResponseWriter, code int, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	log.Printf("%d %s", code, message)
+	reply(w, code, map[string]interface{}{"error": map[string]interface{}{"code": code, "message": message}})
+}
+
+// Any user and password get a token, with a catalog holding the fake Cinder endpoint
+func (c *cloud) authenticate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		fail(w, http.StatusMethodNotAllowed, "%s not allowed", r.Method)
+		return
+	}
+
+	w.Header().Set("X-Subject-Token", "e2e-token")
+	reply(w, http.StatusCreated, map[string]interface{}{
+		"token": map[string]interface{}{
+			"expires_at": time.Now().Add(24 * time.Hour).UTC().Format(time.RFC3339),
+			"project":    map[string]interface{}{"id": projectID, "name": "e2e", "domain": map[string]string{"id": "default", "name": "Default"}},
+			"user":       map[string]interface{}{"id": "e2e", "name": "e2e", "domain": map[string]string{"id": "default", "name": "Default"}},
+			"catalog": []interface{}{
+				map[string]interface{}{
+					"type": "volumev3",
+					"name": "cinderv3",
+					"id":   "cinderv3",
+					"endpoints": []interface{}{
+						map[string]interface{}{
+							"id":        "cinderv3-public",
+							"interface": "public",
+							"region":    "RegionOne",
+							"region_id": "RegionOne",
+							"url":       c.url + "/volume/v3/" + projectID,
+						},
+					},
+				},
+			},
+		},
+	})
+}
+
+func (c *cloud) serveVolumes(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/volume/v3/"+projectID), "/")
+	parts := strings.Split(path, "/")
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	switch {
+	case path == "volumes" && r.Method == http.MethodGet, path == "volumes/detail" && r.Method == http.MethodGet:
+		c.listVolumes(w, r)
+	case path == "volumes" && r.Method == http.MethodPost:
+		c.createVolume(w, r)
+	case len(parts) == 2 && parts[0] == "volumes":
+		c.volume(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "volumes" && parts[2] == "action":
+		c.volumeAction(w, r, parts[1])
+	case path == "attachments" && r.Method == http.MethodPost:
+		c.createAttachment(w, r)
+	case len(parts) == 2 && parts[0] == "attachments":
+		c.attachment(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "attachments" && parts[2] == "action":
+		c.completeAttachment(w, r, parts[1])
+	default:
+		fail(w, http.StatusNotFound, "%s %s not implemented", r.Method, r.URL.Path)
+	}
+}
+
+func (c *cloud) listVolumes(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	list := []*volume{}
+	for _, vol := range c.volumes {
+		if name == "" || vol.Name == name {
+			list = append(list, vol)
+		}
+	}
+	reply(w, http.StatusOK, map[string]interface{}{"volumes": list})
+}
+
+func (c *cloud) createVolume(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Volume struct {
+			Name       string            `json:"name"`
+			Size       int               `json:"size"`
+			VolumeType string            `json:"volume_type"`
+			Metadata   map[string]string `json:"metadata"`
+		} `json:"volume"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Volume.Size <= 0 {
+		fail(w, http.StatusBadRequest, "Invalid volume: %v", err)
+		return
+	}
+
+	vol := &volume{
+		ID:               newID(),
+		Name:             body.Volume.Name,
+		Status:           "available",
+		Size:             body.Volume.Size,
+		AvailabilityZone: "nova",
+		VolumeType:       body.Volume.VolumeType,
+		Bootable:         "false",
+		Metadata:         body.Volume.Metadata,
+		CreatedAt:        time.Now().UTC().Format(timeFormat),
+		Attachments:      []map[string]string{},
+	}
+	if vol.Metadata == nil {
+		vol.Metadata = make(map[string]string)
+	}
+	f, err := os.Create(c.file(vol.ID))
+	if err == nil {
+		err = f.Truncate(int64(vol.Size) << 30)
+		f.Close()
+	}
+	if err != nil {
+		fail(w, http.StatusInternalServerError, "Error creating volume file: %s", err)
+		return
+	}
+
+	c.volumes[vol.ID] = vol
+	log.Printf("Created volume %s (%s, %dGB)", vol.ID, vol.Name, vol.Size)
+	reply(w, http.StatusAccepted, map[string]interface{}{"volume": vol})
+}
+
+func (c *cloud) file(id string) string {
+	return filepath.Join(c.dir, id+".img")
+}
+
+func (c *cloud) volume(w http.ResponseWriter, r *http.Request, id string) {
+	vol, ok := c.volumes[id]
+	if !ok {
+		fail(w, http.StatusNotFound, "Volume %s could not be found.", id)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		reply(w, http.StatusOK, map[string]interface{}{"volume": vol})
+
+	case http.MethodPut:
+		var body struct {
+			Volume struct {
+				Name        *string           `json:"name"`
+				Description *string           `json:"description"`
+				Metadata    map[string]string `json:"metadata"`
+			} `json:"volume"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			fail(w, http.StatusBadRequest, "Invalid volume: %s", err)
+			return
+		}
+		if body.Volume.Name != nil {
+			vol.Name = *body.Volume.Name
+		}
+		if body.Volume.Description != nil {
+			vol.Description = *body.Volume.Description
+		}
+		if body.Volume.Metadata != nil {
+			vol.Metadata = body.Volume.Metadata
+		}
+		reply(w, http.StatusOK, map[string]interface{}{"volume": vol})
+
+	case http.MethodDelete:
+		if len(vol.Attachments) > 0 {
+			fail(w, http.StatusBadRequest, "Invalid volume: Volume %s is attached", id)
+			return
+		}
+		if err := os.Remove(c.file(id)); err != nil {
+			fail(w, http.StatusInternalServerError, "%s", err)
+			return
+		}
+		delete(c.volumes, id)
+		log.Printf("Deleted volume %s", id)
+		reply(w, http.StatusAccepted, nil)
+
+	default:
+		fail(w, http.StatusMethodNotAllowed, "%s not allowed", r.Method)
+	}
+}
+
+// Actions the plugin may call on volumes not in error: they only change metadata here
+func (c *cloud) volumeAction(w http.ResponseWriter, r *http.Request, id string) {
+	vol, ok := c.volumes[id]
+	if !ok {
+		fail(w, http.StatusNotFound, "Volume %s could not be found.", id)
+		return
+	}
+
+	var body map[string]map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		fail(w, http.StatusBadRequest, "Invalid action: %s", err)
+		return
+	}
+	for action, args := range body {
+		switch action {
+		case "os-update_readonly_flag":
+			vol.Metadata["readonly"] = fmt.Sprint(args["readonly"])
+		case "os-reset_status":
+			vol.Status = fmt.Sprint(args["status"])
+		default:
+			fail(w, http.StatusBadRequest, "Action %s not implemented", action)
+			return
+		}
+	}
+	reply(w, http.StatusAccepted, nil)
+}
+
+// Export a volume: set up a loop device for its file
+func (c *cloud) createAttachment(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Attachment struct {
+			VolumeID  string                 `json:"volume_uuid"`
+			Connector map[string]interface{} `json:"connector"`
+		} `json:"attachment"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		fail(w, http.StatusBadRequest, "Invalid attachment: %s", err)
+		return
+	}
+	vol, ok := c.volumes[body.Attachment.VolumeID]
+	if !ok {
+		fail(w, http.StatusNotFound, "Volume %s could not be found.", body.Attachment.VolumeID)
+		return
+	}
+	if vol.Status != "available" {
+		fail(w, http.StatusBadRequest, "Invalid volume: Volume %s status must be available, but current status is: %s", vol.ID, vol.Status)
+		return
+	}
+
+	out, err := exec.Command("losetup", "--find", "--show", c.file(vol.ID)).CombinedOutput()
+	if err != nil {
+		fail(w, http.StatusInternalServerError, "losetup failed: %s", out)
+		return
+	}
+	device := strings.TrimSpace(string(out))
+
+	att := &attachment{
+		ID:         newID(),
+		VolumeID:   vol.ID,
+		Status:     "reserved",
+		AttachMode: "rw",
+		AttachedAt: time.Now().UTC().Format(timeFormat),
+		ConnectionInfo: map[string]interface{}{
+			"driver_volume_type": "local",
+			"data":               map[string]interface{}{"device_path": device},
+		},
+		device: device,
+	}
+	att.host, _ = body.Attachment.Connector["host"].(string)
+	if vol.Metadata["readonly"] == "true" {
+		att.AttachMode = "ro"
+	}
+	c.attachments[att.ID] = att
+
+	vol.Status = "attaching"
+	vol.Attachments = append(vol.Attachments, map[string]string{
+		"id":            att.ID,
+		"attachment_id": att.ID,
+		"volume_id":     vol.ID,
+		"host_name":     att.host,
+		"server_id":     "",
+		"device":        device,
+		"attached_at":   att.AttachedAt,
+	})
+	log.Printf("Exported volume %s as %s to %s", vol.ID, device, att.host)
+	reply(w, http.StatusOK, map[string]interface{}{"attachment": att})
+}
+
+func (c *cloud) attachment(w http.ResponseWriter, r *http.Request, id string) {
+	att, ok := c.attachments[id]
+	if !ok {
+		fail(w, http.StatusNotFound, "Attachment %s could not be found.", id)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		reply(w, http.StatusOK, map[string]interface{}{"attachment": att})
+
+	case http.MethodDelete:
+		if out, err := exec.Command("losetup", "-d", att.device).CombinedOutput(); err != nil {
+			fail(w, http.StatusInternalServerError, "losetup -d failed: %s", out)
+			return
+		}
+		delete(c.attachments, id)
+		if vol, ok := c.volumes[att.VolumeID]; ok {
+			kept := []map[string]string{}
+			for _, a := range vol.Attachments {
+				if a["attachment_id"] != id {
+					kept = append(kept, a)
+				}
+			}
+			vol.Attachments = kept
+			if len(kept) == 0 {
+				vol.Status = "available"
+			}
+		}
+		log.Printf("Deleted attachment %s of volume %s", id, att.VolumeID)
+		reply(w, http.StatusOK, nil)
+
+	default:
+		fail(w, http.StatusMethodNotAllowed, "%s not allowed", r.Method)
+	}
+}
+
+func (c *cloud) completeAttachment(w http.ResponseWriter, r *http.Request, id string) {
+	att, ok := c.attachments[id]
+	if !ok {
+		fail(w, http.StatusNotFound, "Attachment %s could not be found.", id)
+		return
+	}
+	att.Status = "attached"
+	if vol, ok := c.volumes[att.VolumeID]; ok {
+		vol.Status = "in-use"
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
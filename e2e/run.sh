@@ -0,0 +1,203 @@
+#!/bin/sh
+# End-to-end test of the plugin without OpenStack: the plugin runs against a fake cloud
+# (e2e/fakecloud) exporting volumes as loop devices, and is driven through its socket
+# like Docker does. Formatting, LUKS, mounting and unmounting run for real.
+#
+# Requires root, Go, losetup, mkfs.ext4, tune2fs and curl; cryptsetup for the encrypted volume tests.
+# Usage: e2e/run.sh [-v] (from the repository root; -v shows the plugin log on success too)
+
+set -eu
+
+VERBOSE=0
+[ "${1:-}" = "-v" ] && VERBOSE=1
+
+PORT=${E2E_PORT:-5000}
+WORK=$(mktemp -d /tmp/docker-plugin-cinder-e2e.XXXXXX)
+SOCKET=$WORK/cinder.sock
+FAILED=0
+
+cleanup() {
+	set +e
+	[ -n "${PLUGIN_PID:-}" ] && kill "$PLUGIN_PID" 2>/dev/null && wait "$PLUGIN_PID" 2>/dev/null
+	[ -n "${CLOUD_PID:-}" ] && kill "$CLOUD_PID" 2>/dev/null && wait "$CLOUD_PID" 2>/dev/null
+	# leftovers of failed tests
+	grep " $WORK/" /proc/mounts | cut -d' ' -f2 | sort -r | xargs -r -n1 umount -l
+	for dev in $(losetup -j "$WORK/volumes" -O NAME -n 2>/dev/null; losetup -a | grep "$WORK/volumes" | cut -d: -f1); do
+		losetup -d "$dev" 2>/dev/null || true
+	done
+	if [ $FAILED -ne 0 ] || [ $VERBOSE -ne 0 ]; then
+		echo "--- plugin log"; cat "$WORK/plugin.log"
+		echo "--- fake cloud log"; cat "$WORK/cloud.log"
+	fi
+	rm -rf "$WORK"
+}
+trap cleanup EXIT
+
+fail() {
+	echo "FAIL: $*"
+	FAILED=1
+	exit 1
+}
+
+pass() {
+	echo "PASS: $*"
+}
+
+# Call the plugin API, print the response, fail on an "Err" in it unless expected ($3 = err)
+api() {
+	response=$(curl -s --unix-socket "$SOCKET" -X POST "http://plugin/VolumeDriver.$1" -d "$2") || fail "$1: plugin not responding"
+	err=$(printf '%s' "$response" | sed -n 's/.*"Err":"\([^"]*\)".*/\1/p')
+	if [ "${3:-}" = "err" ]; then
+		[ -n "$err" ] || fail "$1 $2 succeeded, expected an error"
+	elif [ -n "$err" ]; then
+		fail "$1 $2: $err"
+	fi
+	printf '%s' "$response"
+}
+
+mountpoint_of() {
+	printf '%s' "$1" | sed -n 's/.*"Mountpoint":"\([^"]*\)".*/\1/p'
+}
+
+go build -o "$WORK/docker-plugin-cinder" .
+go build -o "$WORK/fakecloud" ./e2e/fakecloud
+
+"$WORK/fakecloud" -listen "127.0.0.1:$PORT" -dir "$WORK/volumes" >"$WORK/cloud.log" 2>&1 &
+CLOUD_PID=$!
+
+# fscrypt volume key, as an orchestrator secret
+mkdir -m 0700 "$WORK/secrets"
+head -c 64 /dev/urandom >"$WORK/secrets/fscrypt"
+chmod 0400 "$WORK/secrets/fscrypt"
+
+# encryption is only configured when it can be tested
+ENCRYPTION=
+if command -v cryptsetup >/dev/null; then
+	head -c 64 /dev/urandom >"$WORK/luks.key"
+	chmod 0400 "$WORK/luks.key"
+	ENCRYPTION="\"encryptionKey\": \"$WORK/luks.key\","
+fi
+cat >"$WORK/cinder.json" <<EOF
+{
+    "endpoint": "http://127.0.0.1:$PORT/v3/",
+    "username": "e2e",
+    "password": "e2e",
+    "domainName": "Default",
+    "tenantName": "e2e",
+    "standalone": true,
+    "connector": "local",
+    "mountDir": "$WORK/mount",
+    "stateFile": "$WORK/state.db",
+    "socketName": "$SOCKET",
+    $ENCRYPTION
+    "secretsDir": "$WORK/secrets",
+    "timeoutVolumeState": 10,
+    "breakerThreshold": 0
+}
+EOF
+chmod 0600 "$WORK/cinder.json"
+
+for i in 1 2 3 4 5 6 7 8 9 10; do
+	curl -s "http://127.0.0.1:$PORT/v3/auth/tokens" >/dev/null && break
+	sleep 1
+done
+
+"$WORK/docker-plugin-cinder" -debug -config "$WORK/cinder.json" >"$WORK/plugin.log" 2>&1 &
+PLUGIN_PID=$!
+for i in 1 2 3 4 5 6 7 8 9 10; do
+	[ -S "$SOCKET" ] && break
+	sleep 1
+done
+[ -S "$SOCKET" ] || fail "plugin did not start"
+
+#
+# Plain volume: create, mount, write, unmount, mount again, read, remove
+
+api Create '{"Name":"e2e-plain","Opts":{"size":"1"}}' >/dev/null
+api Get '{"Name":"e2e-plain"}' | grep -q '"Name":"e2e-plain"' || fail "created volume not found"
+pass "create"
+
+mp=$(mountpoint_of "$(api Mount '{"Name":"e2e-plain","ID":"c1"}')")
+[ -d "$mp" ] || fail "mountpoint $mp missing"
+findmnt -n "$WORK/mount/e2e-plain" | grep -q ext4 || fail "volume not mounted as ext4"
+echo e2e >"$mp/file"
+pass "mount (formatted ext4)"
+
+mp2=$(mountpoint_of "$(api Mount '{"Name":"e2e-plain","ID":"c2"}')")
+[ "$mp2" = "$mp" ] || fail "second container got $mp2, not $mp"
+api Unmount '{"Name":"e2e-plain","ID":"c2"}' >/dev/null
+[ -f "$mp/file" ] || fail "volume unmounted while still used by a container"
+pass "shared mount"
+
+api Unmount '{"Name":"e2e-plain","ID":"c1"}' >/dev/null
+findmnt -n "$WORK/mount/e2e-plain" >/dev/null && fail "volume still mounted"
+losetup -a | grep -q "$WORK/volumes" && fail "volume still attached"
+pass "unmount and detach"
+
+mp=$(mountpoint_of "$(api Mount '{"Name":"e2e-plain","ID":"c3"}')")
+[ "$(cat "$mp/file")" = e2e ] || fail "data lost across mounts"
+api Unmount '{"Name":"e2e-plain","ID":"c3"}' >/dev/null
+pass "data kept across mounts"
+
+api Remove '{"Name":"e2e-plain"}' >/dev/null
+api Get '{"Name":"e2e-plain"}' err >/dev/null
+pass "remove"
+
+#
+# Failed mount: the volume is detached again, and the next attempt fails the same way
+
+api Create '{"Name":"e2e-noformat","Opts":{"size":"1","noAutoFormat":"true"}}' >/dev/null
+api Mount '{"Name":"e2e-noformat","ID":"c1"}' err | grep -q 'refusing to format' || fail "mount of an unformatted volume did not fail on formatting"
+losetup -a | grep -q "$WORK/volumes" && fail "volume still attached after a failed mount"
+api Mount '{"Name":"e2e-noformat","ID":"c2"}' err | grep -q 'refusing to format' || fail "retried mount did not fail the same way"
+api Remove '{"Name":"e2e-noformat"}' >/dev/null
+pass "failed mount cleaned up"
+
+#
+# Encrypted volume
+
+if [ -n "$ENCRYPTION" ]; then
+	api Create '{"Name":"e2e-luks","Opts":{"size":"1","encryption":"true"}}' >/dev/null
+	mp=$(mountpoint_of "$(api Mount '{"Name":"e2e-luks","ID":"c1"}')")
+	findmnt -n -o SOURCE "$WORK/mount/e2e-luks" | grep -q '^/dev/mapper/' || fail "encrypted volume not mounted through dm-crypt"
+	echo secret >"$mp/file"
+	api Unmount '{"Name":"e2e-luks","ID":"c1"}' >/dev/null
+	grep -q secret "$WORK"/volumes/*.img && fail "plaintext found on encrypted volume"
+	mp=$(mountpoint_of "$(api Mount '{"Name":"e2e-luks","ID":"c2"}')")
+	[ "$(cat "$mp/file")" = secret ] || fail "encrypted data lost across mounts"
+	api Unmount '{"Name":"e2e-luks","ID":"c2"}' >/dev/null
+	api Remove '{"Name":"e2e-luks"}' >/dev/null
+	pass "encrypted volume"
+
+	api Create '{"Name":"e2e-luks-noformat","Opts":{"size":"1","encryption":"true","noAutoFormat":"true"}}' >/dev/null
+	api Mount '{"Name":"e2e-luks-noformat","ID":"c1"}' err >/dev/null
+	[ -e /dev/mapper/e2e-luks-noformat_luks ] && fail "LUKS mapping left open after a failed mount"
+	losetup -a | grep -q "$WORK/volumes" && fail "encrypted volume still attached after a failed mount"
+	api Remove '{"Name":"e2e-luks-noformat"}' >/dev/null
+	pass "failed encrypted mount cleaned up"
+else
+	echo "SKIP: encrypted volume (no cryptsetup)"
+fi
+
+#
+# Subdirectory encrypted with fscrypt
+
+api Create '{"Name":"e2e-fscrypt","Opts":{"size":"1","filesystem":"ext4","encryption":"fscrypt","keySecret":"fscrypt"}}' >/dev/null
+mp=$(mountpoint_of "$(api Mount '{"Name":"e2e-fscrypt","ID":"c1"}')")
+[ -n "$mp" ] && [ -d "$mp" ] || fail "fscrypt volume not mounted"
+lsattr -d "$mp" | cut -d' ' -f1 | grep -q E || fail "subdirectory not encrypted"
+echo secret >"$mp/file"
+api Unmount '{"Name":"e2e-fscrypt","ID":"c1"}' >/dev/null
+dev=$(losetup --find --show "$WORK"/volumes/*.img)
+mkdir "$WORK/raw"
+mount -t ext4 -o ro "$dev" "$WORK/raw"
+ls "$WORK/raw/$(basename "$mp")" | grep -qx file && fail "fscrypt file name in clear on the volume"
+umount "$WORK/raw"
+losetup -d "$dev"
+mp=$(mountpoint_of "$(api Mount '{"Name":"e2e-fscrypt","ID":"c2"}')")
+[ "$(cat "$mp/file")" = secret ] || fail "fscrypt data lost across mounts"
+api Unmount '{"Name":"e2e-fscrypt","ID":"c2"}' >/dev/null
+api Remove '{"Name":"e2e-fscrypt"}' >/dev/null
+pass "fscrypt subdirectory"
+
+echo "All end-to-end tests passed"
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	log "github.com/sirupsen/logrus"
+)
+
+// Room taken from the end of the filesystem for the LUKS2 header,
+// while cryptsetup shifts the data
+const reencryptHeaderSize = 32 * 1024 * 1024
+
+// Encrypt a plaintext volume in place: shrink its filesystem to make room for
+// the LUKS2 header, then let cryptsetup encrypt the data behind it
+func cmdEncrypt(ctx context.Context, d *plugin, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	logger := log.WithContext(ctx).WithFields(log.Fields{"name": args[0], "action": "encrypt"})
+
+	if d.cryptsetup == nil || !d.cryptsetup.Reencrypt {
+		return errors.New("Encrypting existing volumes requires cryptsetup 2.2+ with reencrypt")
+	}
+
+	vol, err := d.getByName(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if len(vol.Attachments) > 0 {
+		return fmt.Errorf("Volume %s is attached to server %s, refusing to encrypt it", args[0], vol.Attachments[0].ServerID)
+	}
+	pending := metadataBool(vol, metaEncryptionPending, false)
+	if metadataBool(vol, metaEncryption, false) && !pending {
+		return fmt.Errorf("Volume %s is already encrypted", args[0])
+	}
+	if metadataBool(vol, metaRaw, false) {
+		return fmt.Errorf("Volume %s is a raw block device, its size can't be reduced for the LUKS header", args[0])
+	}
+
+	// Record the key before encrypting, so that the volume can always be opened (or its encryption resumed)
+	// from its metadata. An interrupted encryption keeps the key it was started with.
+	if !pending {
+		keyID, keyfile := d.currentKey()
+		if keyfile == "" {
+			return errors.New("No encryptionKey or encryptionKeyID in config")
+		}
+		metadata := map[string]string{metaEncryption: "true", metaEncryptionPending: "true"}
+		if fipsMode {
+			metadata[metaFIPS] = "true"
+		}
+		if keyID != "" {
+			metadata[metaKeyID] = keyID
+		}
+		if d.config.DeriveKeys {
+			metadata[metaKeyDerivation] = keyDerivationHKDF
+			metadata[metaKeyDerivationID] = vol.ID
+		}
+		updated, err := setVolumeMetadata(ctx, d, vol, metadata)
+		if err != nil {
+			return fmt.Errorf("Recording the encryption of volume %s in metadata failed: %w", args[0], err)
+		}
+		vol = updated
+	}
+	keyfile, err := d.keyFile(vol)
+	if err != nil {
+		return err
+	}
+
+	dev, vol, err := attachVolume(ctx, d, args[0])
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if _, err := d.detachVolume(logger.Context, vol); err != nil {
+			logger.WithError(err).Error("Error detaching volume")
+		}
+	}()
+
+	keys := &keyFiles{}
+	defer keys.close()
+	key, err := keys.path(keyfile)
+	if err != nil {
+		return err
+	}
+
+	luks, err := isLuks(dev)
+	if err != nil {
+		return err
+	}
+	var reencrypt []string
+	if luks {
+		if !pending {
+			return fmt.Errorf("Volume %s already has a LUKS header", args[0])
+		}
+		logger.Infof("Resuming encryption of device %s", dev)
+		reencrypt = []string{"reencrypt", "--resume-only", "-q", "--key-file", key}
+	} else {
+		fsType, err := getFilesystemType(dev)
+		if err != nil {
+			return err
+		}
+		if err = shrinkFilesystem(dev, fsType, reencryptHeaderSize); err != nil {
+			return err
+		}
+
+		logger.Infof("Encrypting device %s", dev)
+		reencrypt = []string{"reencrypt", "--encrypt", "-q", "--type", "luks2",
+			"--reduce-device-size", strconv.Itoa(reencryptHeaderSize/1024/1024) + "M", "--key-file", key}
+		if fipsMode {
+			reencrypt = append(reencrypt, fipsLuksArgs...)
+		}
+	}
+	out, err := keys.attach(hostCommand("cryptsetup", append(reencrypt, dev)...)).CombinedOutput()
+	if err != nil {
+		// the volume stays marked pending: running encrypt again resumes it
+		return fmt.Errorf("cryptsetup reencrypt failed - %s", out)
+	}
+
+	uuid, err := luksUUID(dev)
+	if err != nil {
+		return err
+	}
+	metadata := make(map[string]string)
+	for k, v := range vol.Metadata {
+		metadata[k] = v
+	}
+	delete(metadata, metaEncryptionPending)
+	metadata[metaLuksUUID] = uuid
+	updated, err := volumes.Update(d.block(ctx), vol.ID, volumes.UpdateOpts{Metadata: metadata}).Extract()
+	if err != nil {
+		return fmt.Errorf("Volume %s is encrypted, but recording it in metadata failed: %w", args[0], err)
+	}
+
+	if d.config.LuksHeaderBackup != "" {
+		if err = d.backupLuksHeader(ctx, dev, updated); err != nil {
+			logger.WithError(err).Error("Error backing up LUKS header")
+		}
+	}
+
+	fmt.Printf("%s\t%s\tencrypted\n", vol.ID, vol.Name)
+	return nil
+}
+
+// Shrink the filesystem of a device, unmounted, to leave size bytes free at its end
+func shrinkFilesystem(dev string, filesystem string, size int64) error {
+	switch filesystem {
+	case "ext2", "ext3", "ext4":
+	case "":
+		return fmt.Errorf("No filesystem on %s", dev)
+	default:
+		return fmt.Errorf("Filesystem %s of %s can't be shrunk, copy the data to a new encrypted volume instead", filesystem, dev)
+	}
+
+	devSize, err := getDeviceSize(dev)
+	if err != nil {
+		return err
+	}
+	fsSize, err := getFilesystemSize(dev, "", filesystem)
+	if err != nil {
+		return err
+	}
+	if fsSize <= devSize-size {
+		return nil
+	}
+
+	// resize2fs refuses to shrink a filesystem not checked first.
+	// e2fsck exits with 1 when it corrected errors: the filesystem is then clean.
+	if out, err := hostCommand("e2fsck", "-f", "-p", dev).CombinedOutput(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+			return fmt.Errorf("e2fsck %s failed - %s", dev, out)
+		}
+	}
+	target := strconv.FormatInt((devSize-size)/1024, 10) + "K"
+	if out, err := hostCommand("resize2fs", dev, target).CombinedOutput(); err != nil {
+		return fmt.Errorf("resize2fs %s %s failed - %s", dev, target, out)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gophercloud/gophercloud"
+)
+
+// Error of a volume operation returned to Docker, with what the cloud team needs to look into it,
+// appended so that messages keep their start (i.e. "Ghost volume"):
+// "<error> [mount of volume <name>, step <step>, volume ID <id>, HTTP <status>, request ID <id>]"
+type operationError struct {
+	action    string
+	name      string
+	step      string
+	volumeID  string
+	status    int
+	requestID string
+	err       error
+}
+
+func (e operationError) Error() string {
+	details := []string{fmt.Sprintf("%s of volume %s", e.action, e.name)}
+	if e.step != "" {
+		details = append(details, "step "+e.step)
+	}
+	if e.volumeID != "" {
+		details = append(details, "volume ID "+e.volumeID)
+	}
+	if e.status != 0 {
+		details = append(details, fmt.Sprintf("HTTP %d", e.status))
+	}
+	if e.requestID != "" {
+		details = append(details, "request ID "+e.requestID)
+	}
+	return fmt.Sprintf("%s [%s]", strings.TrimSpace(e.err.Error()), strings.Join(details, ", "))
+}
+
+func (e operationError) Unwrap() error {
+	return e.err
+}
+
+// Add the details of an operation to its error: its step, volume ID, and for OpenStack API errors,
+// the HTTP status and request ID
+func (d plugin) describeError(action string, name string, op *trackedOp, err error) error {
+	var described operationError
+	if err == nil || errors.As(err, &described) {
+		return err
+	}
+
+	described = operationError{action: action, name: name, err: err}
+	if op != nil {
+		described.step = d.watchdog.getStep(op)
+		described.volumeID = d.watchdog.getVolumeID(op)
+	}
+	if described.volumeID == "" {
+		if state, _ := d.state.get(name); state != nil {
+			described.volumeID = state.VolumeID
+		}
+	}
+	if response, ok := responseError(err); ok {
+		described.status = response.Actual
+		described.requestID = response.ResponseHeader.Get("X-Openstack-Request-Id")
+		if described.requestID == "" {
+			described.requestID = response.ResponseHeader.Get("X-Compute-Request-Id")
+		}
+	}
+	return described
+}
+
+// OpenStack API error response in an error chain
+func responseError(err error) (gophercloud.ErrUnexpectedResponseCode, bool) {
+	for ; err != nil; err = errors.Unwrap(err) {
+		switch e := err.(type) {
+		case gophercloud.ErrUnexpectedResponseCode:
+			return e, true
+		case gophercloud.ErrDefault400:
+			return e.ErrUnexpectedResponseCode, true
+		case gophercloud.ErrDefault401:
+			return e.ErrUnexpectedResponseCode, true
+		case gophercloud.ErrDefault403:
+			return e.ErrUnexpectedResponseCode, true
+		case gophercloud.ErrDefault404:
+			return e.ErrUnexpectedResponseCode, true
+		case gophercloud.ErrDefault405:
+			return e.ErrUnexpectedResponseCode, true
+		case gophercloud.ErrDefault408:
+			return e.ErrUnexpectedResponseCode, true
+		case gophercloud.ErrDefault409:
+			return e.ErrUnexpectedResponseCode, true
+		case gophercloud.ErrDefault429:
+			return e.ErrUnexpectedResponseCode, true
+		case gophercloud.ErrDefault500:
+			return e.ErrUnexpectedResponseCode, true
+		case gophercloud.ErrDefault503:
+			return e.ErrUnexpectedResponseCode, true
+		}
+	}
+	return gophercloud.ErrUnexpectedResponseCode{}, false
+}
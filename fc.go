@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Fibre Channel HBAs of this host
+const fcHostsDir = "/sys/class/fc_host"
+
+// Attach volumes exported over Fibre Channel: the storage zones and maps the LUN
+// to the HBAs of this host, which only have to scan for it
+type fcConnector struct{}
+
+// Fibre Channel LUN of a volume, from Cinder's connection data
+type fcTarget struct {
+	WWNs []string
+	LUN  int
+}
+
+func (fcConnector) volumeType() string {
+	return "fibre_channel"
+}
+
+func (fcConnector) properties(hostname string) (map[string]interface{}, error) {
+	wwpns, err := fcHostNames("port_name")
+	if err != nil {
+		return nil, err
+	}
+	wwnns, err := fcHostNames("node_name")
+	if err != nil {
+		return nil, err
+	}
+
+	properties := baseProperties(hostname)
+	properties["wwpns"] = wwpns
+	properties["wwnns"] = wwnns
+	return properties, nil
+}
+
+func (fcConnector) connect(ctx context.Context, data map[string]interface{}, timeout int) (string, error) {
+	target, err := newFcTarget(data)
+	if err != nil {
+		return "", err
+	}
+
+	logger := log.WithContext(ctx).WithFields(log.Fields{"action": "connect", "wwns": strings.Join(target.WWNs, ","), "lun": target.LUN})
+	dev, err := waitFor(ctx, []string{"/dev/disk/by-path"}, withSCSIRescan(logger, func() (string, error) {
+		return target.device(), nil
+	}), timeout)
+	if err == nil && dev == "" {
+		err = fmt.Errorf("Block device not found for LUN %d of %s", target.LUN, strings.Join(target.WWNs, ", "))
+	}
+	return dev, err
+}
+
+func (fcConnector) disconnect(data map[string]interface{}) error {
+	target, err := newFcTarget(data)
+	if err != nil {
+		return err
+	}
+	// one device per path to the LUN
+	for _, wwn := range target.WWNs {
+		paths, _ := filepath.Glob(fmt.Sprintf("/dev/disk/by-path/*-fc-0x%s-lun-%d", wwn, target.LUN))
+		for _, path := range paths {
+			if err = removeSCSIDevice(path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Port or node names of the HBAs of this host, without their 0x prefix
+func fcHostNames(attribute string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(fcHostsDir, "*", attribute))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, file := range files {
+		name, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, strings.TrimPrefix(strings.TrimSpace(string(name)), "0x"))
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("No Fibre Channel HBA found in %s", fcHostsDir)
+	}
+	return names, nil
+}
+
+// target_wwn is a list of target ports, or a single one
+func newFcTarget(data map[string]interface{}) (*fcTarget, error) {
+	target := &fcTarget{}
+	switch wwns := data["target_wwn"].(type) {
+	case string:
+		target.WWNs = []string{wwns}
+	case []interface{}:
+		for _, wwn := range wwns {
+			if s, ok := wwn.(string); ok {
+				target.WWNs = append(target.WWNs, s)
+			}
+		}
+	}
+	for i, wwn := range target.WWNs {
+		target.WWNs[i] = strings.ToLower(strings.TrimPrefix(wwn, "0x"))
+	}
+	lun, ok := data["target_lun"].(float64)
+	if !ok || len(target.WWNs) == 0 {
+		return nil, errors.New("Incomplete Fibre Channel connection data")
+	}
+	target.LUN = int(lun)
+	return target, nil
+}
+
+// udev link of the LUN through the first target port it shows up on
+func (t *fcTarget) device() string {
+	for _, wwn := range t.WWNs {
+		paths, _ := filepath.Glob(fmt.Sprintf("/dev/disk/by-path/*-fc-0x%s-lun-%d", wwn, t.LUN))
+		for _, path := range paths {
+			if isBlockDevice(path) {
+				return path
+			}
+		}
+	}
+	return ""
+}
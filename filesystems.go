@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// What the plugin needs to know about each supported filesystem
+type filesystemSpec struct {
+	// mkfs option setting the label, and maximum label length
+	labelOption string
+	labelLength int
+	// mkfs options for fast formatting
+	fastOptions []string
+	// can be grown while mounted, otherwise grown before mounting
+	growMounted bool
+	// tools to get the filesystem size and grow it
+	growTools []string
+	// mount options not to write to a read-only device (i.e. journal replay)
+	roOptions []string
+	// default mount options, before the volume's
+	mountOptions []string
+}
+
+var filesystems = map[string]filesystemSpec{
+	"ext2": {"-L", 16, []string{"-E", "lazy_itable_init=1,nodiscard"}, true, []string{"dumpe2fs", "resize2fs"}, nil, nil},
+	"ext3": {"-L", 16, []string{"-E", "lazy_itable_init=1,lazy_journal_init=1,nodiscard"}, true, []string{"dumpe2fs", "resize2fs"}, []string{"noload"}, nil},
+	"ext4": {"-L", 16, []string{"-E", "lazy_itable_init=1,lazy_journal_init=1,nodiscard"}, true, []string{"dumpe2fs", "resize2fs"}, []string{"noload"}, nil},
+	"xfs":  {"-L", 12, []string{"-K"}, true, []string{"xfs_info", "xfs_growfs"}, []string{"norecovery"}, nil},
+	// access times rewrite copy-on-write metadata on every read
+	"btrfs": {"-L", 255, []string{"--nodiscard"}, true, []string{"btrfs"}, []string{"nologreplay"}, []string{"noatime"}},
+	"f2fs":  {"-l", 255, []string{"-t", "0"}, false, []string{"dump.f2fs", "resize.f2fs"}, []string{"norecovery"}, []string{"noatime"}},
+}
+
+func supportedFilesystems() string {
+	names := make([]string, 0, len(filesystems))
+	for name := range filesystems {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// Check a filesystem is supported, and the tools to handle it are installed
+func checkFilesystemTools(filesystem string, grow bool) error {
+	spec, ok := filesystems[filesystem]
+	if !ok {
+		return fmt.Errorf("Unsupported filesystem %s, use one of: %s", filesystem, supportedFilesystems())
+	}
+
+	tools := []string{"blkid", "mkfs." + filesystem}
+	if grow {
+		tools = append(tools, spec.growTools...)
+	}
+
+	var missing []string
+	for _, tool := range tools {
+		if _, err := lookPath(tool); err != nil {
+			missing = append(missing, tool)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("Missing tools for %s filesystem: %s", filesystem, strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// Filesystems new volumes may get: the config's, and the ones of type profiles (of allowed types)
+func (c *tConfig) enabledFilesystems() []string {
+	enabled := map[string]bool{c.Filesystem: true}
+	for volumeType, profile := range c.TypeProfiles {
+		if fs, ok := profile["filesystem"]; ok && c.checkAllowedType(volumeType) == nil {
+			enabled[fs] = true
+		}
+	}
+	names := make([]string, 0, len(enabled))
+	for name := range enabled {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	log "github.com/sirupsen/logrus"
+)
+
+// encryption option of volumes encrypting their subdirectory with fscrypt, instead of the whole device with LUKS
+const encryptionFscrypt = "fscrypt"
+
+// Filesystems supporting fscrypt, and the mkfs options enabling it
+var fscryptFilesystems = map[string][]string{
+	"ext4": {"-O", "encrypt"},
+	"f2fs": {"-O", "encrypt"},
+}
+
+// fscrypt ioctls and structures (linux/fscrypt.h, policy v2, kernel 5.4+)
+const (
+	fsIocSetEncryptionPolicy   = 0x800c6613 // FS_IOC_SET_ENCRYPTION_POLICY
+	fsIocGetEncryptionPolicyEx = 0xc0096616 // FS_IOC_GET_ENCRYPTION_POLICY_EX
+	fsIocAddEncryptionKey      = 0xc0506617 // FS_IOC_ADD_ENCRYPTION_KEY
+
+	fscryptKeySpecTypeIdentifier = 2
+	fscryptPolicyV2              = 2
+	fscryptModeAES256XTS         = 1
+	fscryptModeAES256CTS         = 4
+	fscryptPolicyFlagsPad32      = 0x03
+
+	// struct fscrypt_add_key_arg, without the raw key following it
+	fscryptAddKeyArgSize = 80
+	fscryptKeySize       = 64
+	fscryptIdentifierLen = 16
+	// struct fscrypt_policy_v2
+	fscryptPolicySize = 24
+)
+
+// Set up fscrypt at volume creation: check the filesystem supports it, default the subdirectory
+// (the filesystem root can't be encrypted), and draw the salt deriving the volume's keys
+func (d plugin) storeFscryptOptions(metadata map[string]string) error {
+	filesystem := d.config.Filesystem
+	if fs, ok := metadata[metaFilesystem]; ok {
+		filesystem = fs
+	}
+	if _, ok := fscryptFilesystems[filesystem]; !ok {
+		return fmt.Errorf("encryption=fscrypt requires an ext4 or f2fs filesystem, not %s", filesystem)
+	}
+	if metadata[metaRaw] == "true" {
+		return errors.New("encryption=fscrypt requires a filesystem, raw volumes can't use it")
+	}
+	if _, ok := metadata[metaSubDir]; !ok && d.config.VolumeSubDir == "" {
+		metadata[metaSubDir] = "data"
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	metadata[metaFscrypt] = hex.EncodeToString(salt)
+	return nil
+}
+
+// Unlock the encrypted subdirectory of a mounted volume: add its key to the filesystem,
+// and encrypt the subdirectory with it if not yet (it must then be empty, and the mount read-write).
+// The filesystem forgets the key when unmounted.
+func (d plugin) unlockFscrypt(logger *log.Entry, vol *volumes.Volume, path string, subDir string, readOnly bool) error {
+	keyfile, err := d.keyFileFromMetadata(vol.Metadata)
+	if err != nil {
+		return err
+	}
+	if keyfile == "" {
+		return fmt.Errorf("Volume %s is encrypted with fscrypt, and no key is configured", vol.Name)
+	}
+
+	master, err := readKeyFile(keyfile)
+	if err != nil {
+		return err
+	}
+	defer master.destroy()
+
+	// the add key argument, followed by the raw key, all in locked memory
+	arg, err := newSecureBuffer(fscryptAddKeyArgSize + fscryptKeySize)
+	if err != nil {
+		return err
+	}
+	defer arg.destroy()
+	// each subdirectory gets its own key, from the salt shared with the volume's snapshots
+	info := fmt.Sprintf("docker-plugin-cinder fscrypt %s %s", vol.Metadata[metaFscrypt], subDir)
+	if err = hkdfSHA256(master.data, []byte(info), arg.data[fscryptAddKeyArgSize:]); err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(arg.data[0:], fscryptKeySpecTypeIdentifier)
+	binary.LittleEndian.PutUint32(arg.data[40:], fscryptKeySize)
+
+	root, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	if err = ioctl(root, fsIocAddEncryptionKey, unsafe.Pointer(&arg.data[0])); err != nil {
+		return fmt.Errorf("Adding fscrypt key to %s failed (kernel 5.4+ and filesystem encrypt feature required): %w", path, err)
+	}
+
+	// policy v2 identifies the key by the identifier the kernel computed
+	policy := make([]byte, fscryptPolicySize)
+	policy[0] = fscryptPolicyV2
+	policy[1] = fscryptModeAES256XTS
+	policy[2] = fscryptModeAES256CTS
+	policy[3] = fscryptPolicyFlagsPad32
+	copy(policy[8:], arg.data[8:8+fscryptIdentifierLen])
+
+	dir := filepath.Join(path, subDir)
+	if !readOnly {
+		if err = os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// already encrypted: the key added is enough, also on read-only mounts
+	current, err := getFscryptPolicy(f)
+	switch {
+	case err == nil:
+		if current[0] != fscryptPolicyV2 || string(current[8:]) != string(policy[8:]) {
+			return fmt.Errorf("Subdirectory %s is encrypted with another key", subDir)
+		}
+		logger.WithField("subdir", subDir).Debug("fscrypt subdirectory unlocked")
+		return nil
+	case err != syscall.ENODATA:
+		return fmt.Errorf("Reading encryption policy of subdirectory %s failed: %w", subDir, err)
+	case readOnly:
+		return fmt.Errorf("Subdirectory %s is not encrypted, and the volume is read-only", subDir)
+	}
+
+	switch err = ioctl(f, fsIocSetEncryptionPolicy, unsafe.Pointer(&policy[0])); err {
+	case nil:
+	case syscall.EEXIST:
+		return fmt.Errorf("Subdirectory %s is encrypted with another key", subDir)
+	case syscall.ENOTEMPTY:
+		return fmt.Errorf("Subdirectory %s is not empty, refusing to encrypt it", subDir)
+	default:
+		return fmt.Errorf("Encrypting subdirectory %s failed: %w", subDir, err)
+	}
+	logger.WithField("subdir", subDir).Debug("fscrypt subdirectory unlocked")
+	return nil
+}
+
+// Encryption policy of a directory, ENODATA when it has none
+func getFscryptPolicy(f *os.File) ([]byte, error) {
+	// struct fscrypt_get_policy_ex_arg: policy size, then the policy
+	arg := make([]byte, 8+fscryptPolicySize)
+	binary.LittleEndian.PutUint64(arg[0:], fscryptPolicySize)
+	if err := ioctl(f, fsIocGetEncryptionPolicyEx, unsafe.Pointer(&arg[0])); err != nil {
+		return nil, err
+	}
+	return arg[8:], nil
+}
+
+// Enable fscrypt on an existing ext4 filesystem, unmounted (no-op when enabled)
+func enableFscrypt(dev string, filesystem string) error {
+	if filesystem != "ext4" {
+		return nil
+	}
+	if out, err := hostCommand("tune2fs", "-O", "encrypt", dev).CombinedOutput(); err != nil {
+		return fmt.Errorf("tune2fs -O encrypt %s failed - %s", dev, out)
+	}
+	return nil
+}
+
+func ioctl(f *os.File, request uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), request, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
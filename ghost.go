@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Volume not found in Cinder
+var errNotFound = errors.New("Not Found")
+
+// Volume Docker knows about, deleted from Cinder out of band.
+// The message starts with "Ghost volume" for scripts to tell it apart from other errors.
+type ghostVolumeError struct {
+	name string
+}
+
+func (e ghostVolumeError) Error() string {
+	return fmt.Sprintf("Ghost volume: %s not found in Cinder (deleted out of band), remove it with docker volume rm", e.name)
+}
+
+// Reconciliation event, sent to ghostWebhook
+type ghostEvent struct {
+	Event  string    `json:"event"`
+	Volume string    `json:"volume"`
+	Action string    `json:"action"`
+	Host   string    `json:"host"`
+	Time   time.Time `json:"time"`
+}
+
+// Turn a volume not found into a ghost volume error when Docker must have it:
+// always for mount (Docker only mounts its volumes), and for other actions when the volume
+// is in use on this host. A reconciliation event is logged and sent.
+func (d plugin) checkGhost(logger *log.Entry, name string, action string, err error) error {
+	if !errors.Is(err, errNotFound) || !d.isGhost(name, action) {
+		return err
+	}
+
+	logger.WithField("event", "ghost-volume").Warn("Volume known to Docker is missing from Cinder, remove it with docker volume rm")
+	if d.config.GhostWebhook != "" {
+		event := ghostEvent{Event: "ghost-volume", Volume: name, Action: action, Host: d.hostname, Time: time.Now().UTC()}
+		go func() {
+			if err := postEvent(d.config.GhostWebhook, &event); err != nil {
+				logger.WithError(err).Error("Error sending ghost volume event")
+			}
+		}()
+	}
+	return ghostVolumeError{name: name}
+}
+
+func (d plugin) isGhost(name string, action string) bool {
+	if action == "mount" {
+		return true
+	}
+	if state, _ := d.state.get(name); state != nil {
+		return true
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return len(d.mounts[name]) > 0
+}
+
+// Forget what this host knows of a ghost volume, so Docker can remove it.
+// Caller must hold the volume's turn in the operation queue.
+func (d plugin) removeGhost(logger *log.Entry, name string) {
+	path := d.mountPath(name, nil)
+	if mounted, _ := isMounted(path); mounted {
+		if err := d.unmountVolume(logger, name); err != nil {
+			logger.WithError(err).Warn("Error cleaning up ghost volume mount")
+		}
+	}
+
+	d.mutex.Lock()
+	delete(d.mounts, name)
+	delete(d.mountpoints, name)
+	d.mutex.Unlock()
+
+	if err := d.state.delete(name); err != nil {
+		logger.WithError(err).Error("Error deleting volume state")
+	}
+	logger.Info("Ghost volume removed")
+}
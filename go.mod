@@ -7,6 +7,8 @@ require (
 	github.com/docker/go-plugins-helpers v0.0.0-20211224144127-6eecb7beb651
 	github.com/gophercloud/gophercloud v0.24.0
 	github.com/sirupsen/logrus v1.8.1
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/crypto v0.0.0-20220214200702-86341886e292
 )
 
 require (
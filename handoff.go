@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/coreos/go-systemd/activation"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// listening socket inherited from the previous binary
+	listenFDEnv = "DOCKER_PLUGIN_CINDER_LISTEN_FD"
+	// longest wait for running operations before handing the socket over, else the handoff is aborted
+	handoffTimeout = 5 * time.Minute
+)
+
+var errHandoff = errors.New("socket handed off")
+
+// Plugin API listener, that can stop accepting connections without closing its socket,
+// and knows whether requests are being served
+type handoffListener struct {
+	*net.UnixListener
+	mutex    sync.Mutex
+	stopping bool
+	conns    map[*handoffConn]bool
+	// serving again after a failed handoff
+	resumed chan struct{}
+}
+
+type handoffConn struct {
+	net.Conn
+	listener *handoffListener
+	// a request was read, its response not written yet
+	busy bool
+}
+
+// The inherited socket, the systemd one, or a new one
+func listen(config *tConfig) (*handoffListener, error) {
+	var l net.Listener
+
+	if fd := os.Getenv(listenFDEnv); fd != "" {
+		os.Unsetenv(listenFDEnv)
+		n, err := strconv.Atoi(fd)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s: %s", listenFDEnv, fd)
+		}
+		f := os.NewFile(uintptr(n), "listener")
+		l, err = net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		log.Debug("Started with socket from previous binary")
+	} else if listeners, err := activation.Listeners(); err != nil {
+		return nil, err
+	} else if len(listeners) > 0 {
+		l = listeners[0]
+		log.Debug("Started with socket activation")
+	} else if l, err = newUnixSocket(config); err != nil {
+		return nil, err
+	}
+
+	unixListener, ok := l.(*net.UnixListener)
+	if !ok {
+		return nil, fmt.Errorf("Not a Unix socket: %s", l.Addr())
+	}
+	return &handoffListener{
+		UnixListener: unixListener,
+		conns:        make(map[*handoffConn]bool),
+		resumed:      make(chan struct{}, 1),
+	}, nil
+}
+
+func (l *handoffListener) Accept() (net.Conn, error) {
+	conn, err := l.UnixListener.Accept()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.stopping {
+		if conn != nil {
+			// accepted just before stopping, served anyway
+			c := &handoffConn{Conn: conn, listener: l}
+			l.conns[c] = true
+			return c, nil
+		}
+		return nil, errHandoff
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &handoffConn{Conn: conn, listener: l}
+	l.conns[c] = true
+	return c, nil
+}
+
+// Stop accepting connections: they wait in the socket backlog
+func (l *handoffListener) stop() {
+	l.mutex.Lock()
+	l.stopping = true
+	l.mutex.Unlock()
+	l.SetDeadline(time.Now())
+}
+
+func (l *handoffListener) resume() {
+	l.mutex.Lock()
+	l.stopping = false
+	l.mutex.Unlock()
+	l.SetDeadline(time.Time{})
+	l.resumed <- struct{}{}
+}
+
+// Closed when the server stops, except when handing the socket over
+func (l *handoffListener) Close() error {
+	l.mutex.Lock()
+	stopping := l.stopping
+	l.mutex.Unlock()
+	if stopping {
+		return nil
+	}
+	return l.UnixListener.Close()
+}
+
+// Serve the plugin API until the listener is closed
+func (l *handoffListener) serve(serve func(net.Listener) error) error {
+	for {
+		err := serve(l)
+		if err != errHandoff {
+			return err
+		}
+		<-l.resumed
+	}
+}
+
+// Whether a request is being served
+func (l *handoffListener) busy() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for c := range l.conns {
+		if c.busy {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *handoffConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.listener.mutex.Lock()
+		c.busy = true
+		c.listener.mutex.Unlock()
+	}
+	return n, err
+}
+
+func (c *handoffConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.listener.mutex.Lock()
+	c.busy = false
+	c.listener.mutex.Unlock()
+	return n, err
+}
+
+func (c *handoffConn) Close() error {
+	c.listener.mutex.Lock()
+	delete(c.listener.conns, c)
+	c.listener.mutex.Unlock()
+	return c.Conn.Close()
+}
+
+// On SIGUSR2, replace the running binary with the one on disk (i.e. upgraded),
+// keeping the listening socket: Docker requests wait instead of failing.
+func (d *plugin) handoffOnSignal(l *handoffListener) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+
+	for range signals {
+		if err := d.handoff(l); err != nil {
+			log.WithError(err).Error("Error handing the socket over to the new binary")
+		}
+	}
+}
+
+func (d *plugin) handoff(l *handoffListener) error {
+	logger := log.WithFields(log.Fields{"action": "handoff"})
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(exe); err != nil {
+		return err
+	}
+
+	f, err := l.File()
+	if err != nil {
+		return err
+	}
+	// kept open across exec
+	if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_SETFD, 0); errno != 0 {
+		f.Close()
+		return errno
+	}
+
+	logger.Info("Stopping accepting requests, waiting for running operations")
+	l.stop()
+	// background work (i.e. asynchronous creates, autoExtend) included
+	d.ops.setClosed(true)
+	deadline := time.Now().Add(handoffTimeout)
+	for (d.ops.pending() > 0 || l.busy()) && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if pending := d.ops.pending(); pending > 0 || l.busy() {
+		f.Close()
+		d.ops.setClosed(false)
+		l.resume()
+		return fmt.Errorf("%d operation(s) still running after %s, handoff aborted", pending, handoffTimeout)
+	}
+
+	// the new binary opens it
+	if d.state != nil {
+		if err = d.state.db.Close(); err != nil {
+			logger.WithError(err).Error("Error closing state file")
+		}
+	}
+
+	logger.WithField("binary", exe).Info("Handing the socket over")
+	env := append(os.Environ(), fmt.Sprintf("%s=%d", listenFDEnv, f.Fd()))
+	err = syscall.Exec(exe, os.Args, env)
+
+	// still there: serve again
+	f.Close()
+	if d.state != nil {
+		state, stateErr := openStateStore(d.config.StateFile)
+		if stateErr != nil {
+			logger.WithError(stateErr).Fatal("Error reopening state file")
+		}
+		*d.state = *state
+	}
+	d.ops.setClosed(false)
+	l.resume()
+	return err
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/identity/v3/tokens"
+	log "github.com/sirupsen/logrus"
+)
+
+// Last probe result of an OpenStack endpoint
+type endpointHealth struct {
+	OK        bool          `json:"ok"`
+	Error     string        `json:"error,omitempty"`
+	Latency   time.Duration `json:"latency"`
+	CheckedAt time.Time     `json:"checkedAt"`
+}
+
+// Results of background endpoint probes, shared by all plugin copies
+type healthStatus struct {
+	mutex       sync.RWMutex
+	endpoints   map[string]endpointHealth
+	tokenExpiry time.Time
+}
+
+func newHealthStatus() *healthStatus {
+	return &healthStatus{endpoints: make(map[string]endpointHealth)}
+}
+
+func (h *healthStatus) set(name string, result endpointHealth) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.endpoints[name] = result
+}
+
+// Probe Keystone, Cinder and Nova every healthInterval seconds, and authenticate again
+// before the token expires, so the first Docker request after an outage doesn't discover it
+func (d plugin) probeEndpoints() {
+	if d.config.HealthInterval <= 0 {
+		return
+	}
+	interval := time.Duration(d.config.HealthInterval) * time.Second
+
+	for {
+		d.probeOnce(interval)
+		time.Sleep(interval)
+	}
+}
+
+func (d plugin) probeOnce(interval time.Duration) {
+	logger := log.WithFields(log.Fields{"action": "probeEndpoints"})
+
+	d.probe(logger, "keystone", func() error {
+		return d.refreshToken(logger, interval)
+	})
+
+	// a probe hanging past the next one reports nothing
+	ctx, cancel := context.WithTimeout(context.Background(), interval)
+	defer cancel()
+
+	d.probe(logger, "cinder", func() error {
+		client := d.block(ctx)
+		_, err := client.Get(client.ServiceURL("volumes")+"?limit=1", nil, nil)
+		return err
+	})
+
+	if d.computeClient != nil {
+		d.probe(logger, "nova", func() error {
+			client := d.compute(ctx)
+			url := client.ServiceURL("servers") + "?limit=1"
+			if d.local == nil {
+				url = client.ServiceURL("servers", d.machineID())
+			}
+			_, err := client.Get(url, nil, nil)
+			return err
+		})
+	}
+}
+
+func (d plugin) probe(logger *log.Entry, name string, check func() error) {
+	start := time.Now()
+	err := check()
+	result := endpointHealth{OK: err == nil, Latency: time.Since(start), CheckedAt: start}
+
+	if err != nil {
+		result.Error = err.Error()
+		logger.WithError(err).Warnf("%s endpoint probe failed", name)
+	}
+	d.health.set(name, result)
+}
+
+// Authenticate again when the token expires before the next probe
+func (d plugin) refreshToken(logger *log.Entry, interval time.Duration) error {
+	var expiresAt time.Time
+	if result, ok := d.provider.GetAuthResult().(tokens.CreateResult); ok {
+		if token, err := result.ExtractToken(); err == nil {
+			expiresAt = token.ExpiresAt
+		}
+	}
+
+	if expiresAt.IsZero() || time.Until(expiresAt) < 2*interval {
+		logger.Debug("Token expires soon, authenticating again")
+		if err := d.provider.Reauthenticate(d.provider.Token()); err != nil {
+			return err
+		}
+		if result, ok := d.provider.GetAuthResult().(tokens.CreateResult); ok {
+			if token, err := result.ExtractToken(); err == nil {
+				expiresAt = token.ExpiresAt
+			}
+		}
+	} else {
+		// the token is valid: check keystone is reachable
+		resp, err := d.provider.HTTPClient.Get(d.provider.IdentityBase)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return gophercloud.ErrUnexpectedResponseCode{URL: d.provider.IdentityBase, Method: "GET", Actual: resp.StatusCode}
+		}
+	}
+
+	d.health.mutex.Lock()
+	d.health.tokenExpiry = expiresAt
+	d.health.mutex.Unlock()
+	return nil
+}
+
+// GET /health on the plugin socket: probe results, 503 when an endpoint is down
+func (d plugin) serveHealth(w http.ResponseWriter, r *http.Request) {
+	d.health.mutex.RLock()
+	defer d.health.mutex.RUnlock()
+
+	healthy := true
+	for _, result := range d.health.endpoints {
+		healthy = healthy && result.OK
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"healthy":     healthy,
+		"endpoints":   d.health.endpoints,
+		"tokenExpiry": d.health.tokenExpiry,
+	})
+}
+
+// GET /metrics on the plugin socket: probe results in Prometheus text format
+func (d plugin) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	d.health.mutex.RLock()
+	defer d.health.mutex.RUnlock()
+
+	names := make([]string, 0, len(d.health.endpoints))
+	for name := range d.health.endpoints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# TYPE cinder_plugin_endpoint_up gauge")
+	for _, name := range names {
+		up := 0
+		if d.health.endpoints[name].OK {
+			up = 1
+		}
+		fmt.Fprintf(w, "cinder_plugin_endpoint_up{endpoint=%q} %d\n", name, up)
+	}
+	fmt.Fprintln(w, "# TYPE cinder_plugin_endpoint_latency_seconds gauge")
+	for _, name := range names {
+		fmt.Fprintf(w, "cinder_plugin_endpoint_latency_seconds{endpoint=%q} %f\n", name, d.health.endpoints[name].Latency.Seconds())
+	}
+	if !d.health.tokenExpiry.IsZero() {
+		fmt.Fprintln(w, "# TYPE cinder_plugin_token_expiry_seconds gauge")
+		fmt.Fprintf(w, "cinder_plugin_token_expiry_seconds %f\n", time.Until(d.health.tokenExpiry).Seconds())
+	}
+}
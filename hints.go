@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/extensions/schedulerhints"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/pagination"
+)
+
+// Volume options setting Cinder scheduler hints, i.e. -o hint:same_host=<volume>
+const hintOptionPrefix = "hint:"
+
+var uuidRegex = regexp.MustCompile("^[a-z0-9]{8}-[a-z0-9]{4}-[1-5][a-z0-9]{3}-[a-z0-9]{4}-[a-z0-9]{12}$")
+
+// Build Cinder scheduler hints from "hint:<name>" volume options.
+// same_host and different_host take comma-separated volume IDs or names,
+// other hints are passed as-is.
+// Returns nil when there is no hint.
+func (d plugin) schedulerHints(ctx context.Context, options map[string]string) (*schedulerhints.SchedulerHints, error) {
+	var hints *schedulerhints.SchedulerHints
+
+	for option, value := range options {
+		if !strings.HasPrefix(option, hintOptionPrefix) {
+			continue
+		}
+		if hints == nil {
+			hints = &schedulerhints.SchedulerHints{}
+		}
+
+		name := strings.TrimPrefix(option, hintOptionPrefix)
+		switch name {
+		case "same_host", "different_host":
+			ids, err := d.volumeIDs(ctx, strings.Split(value, ","))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s hint: %w", name, err)
+			}
+			if name == "same_host" {
+				hints.SameHost = append(hints.SameHost, ids...)
+			} else {
+				hints.DifferentHost = append(hints.DifferentHost, ids...)
+			}
+		case "local_to_instance":
+			hints.LocalToInstance = value
+		case "query":
+			hints.Query = value
+		default:
+			if hints.AdditionalProperties == nil {
+				hints.AdditionalProperties = make(map[string]interface{})
+			}
+			hints.AdditionalProperties[name] = value
+		}
+	}
+
+	return hints, nil
+}
+
+// Resolve volume names to IDs, IDs are kept as-is
+func (d plugin) volumeIDs(ctx context.Context, refs []string) ([]string, error) {
+	var ids []string
+
+	for _, ref := range refs {
+		ref = strings.TrimSpace(ref)
+		if ref == "" {
+			continue
+		}
+		if uuidRegex.MatchString(ref) {
+			ids = append(ids, ref)
+			continue
+		}
+		vol, err := d.getByName(ctx, ref)
+		if err != nil {
+			return nil, fmt.Errorf("volume %s: %w", ref, err)
+		}
+		ids = append(ids, vol.ID)
+	}
+
+	return ids, nil
+}
+
+// Place a new volume with the existing volumes of its affinity group:
+// same availability zone, and same_host hint on all of them.
+// The group is recorded in volume metadata.
+func (d plugin) affinityGroupHints(logger *log.Entry, group string, opts *volumes.CreateOpts, hints *schedulerhints.SchedulerHints) (*schedulerhints.SchedulerHints, error) {
+	var members []volumes.Volume
+
+	pager := volumes.List(d.block(logger.Context), volumes.ListOpts{Metadata: map[string]string{metaAffinityGroup: group}})
+	err := pager.EachPage(func(page pagination.Page) (bool, error) {
+		vList, err := volumes.ExtractVolumes(page)
+		if err != nil {
+			return false, err
+		}
+		members = append(members, vList...)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(members) == 0 {
+		logger.Debugf("First volume of affinity group %s", group)
+		return hints, nil
+	}
+
+	if hints == nil {
+		hints = &schedulerhints.SchedulerHints{}
+	}
+	for _, m := range members {
+		hints.SameHost = append(hints.SameHost, m.ID)
+	}
+	opts.AvailabilityZone = members[0].AvailabilityZone
+
+	logger.Debugf("Affinity group %s: %d volume(s) in zone %s", group, len(members), opts.AvailabilityZone)
+
+	return hints, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Mount namespace volumes are mounted in, when the plugin runs in a container
+// (i.e. /proc/1/ns/mnt, with the host PID namespace). Empty: the plugin's own.
+// Commands run there through nsenter, so mounts and device-mapper devices are the host's.
+var hostNamespace string
+
+var procNamespace = regexp.MustCompile(`^/proc/\d+/ns/mnt$`)
+
+// Check a hostNamespace config value, and use it
+func setHostNamespace(ns string) error {
+	if ns == "" {
+		return nil
+	}
+	if !procNamespace.MatchString(ns) {
+		return fmt.Errorf("Invalid hostNamespace %s, use /proc/<pid>/ns/mnt", ns)
+	}
+	if _, err := exec.LookPath("nsenter"); err != nil {
+		return fmt.Errorf("hostNamespace requires nsenter: %w", err)
+	}
+	if out, err := exec.Command("nsenter", "--mount="+ns, "--", "true").CombinedOutput(); err != nil {
+		return fmt.Errorf("Can't enter mount namespace %s (host PID namespace and CAP_SYS_ADMIN required) - %s", ns, out)
+	}
+	hostNamespace = ns
+	return nil
+}
+
+// Command run in the mount namespace of volumes
+func hostCommand(name string, args ...string) *exec.Cmd {
+	if hostNamespace == "" {
+		return exec.Command(name, args...)
+	}
+	return exec.Command("nsenter", append([]string{"--mount=" + hostNamespace, "--", name}, args...)...)
+}
+
+func hostCommandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	if hostNamespace == "" {
+		return exec.CommandContext(ctx, name, args...)
+	}
+	return exec.CommandContext(ctx, "nsenter", append([]string{"--mount=" + hostNamespace, "--", name}, args...)...)
+}
+
+// Path of a command in the mount namespace of volumes
+func lookPath(name string) (string, error) {
+	if hostNamespace == "" {
+		return exec.LookPath(name)
+	}
+	out, err := hostCommand("sh", "-c", "command -v "+name).Output()
+	path := strings.TrimSpace(string(out))
+	if err != nil || path == "" {
+		return "", fmt.Errorf("%s: executable file not found in host PATH", name)
+	}
+	return path, nil
+}
+
+// Path of a plugin file (i.e. a key file) for commands run in the mount namespace of volumes:
+// through the plugin's root, seen from the host PID namespace
+func hostPath(path string) string {
+	if hostNamespace == "" {
+		return path
+	}
+	return filepath.Join("/proc", strconv.Itoa(os.Getpid()), "root", path)
+}
+
+// Check mount directories are shared with the mount namespace of volumes: the plugin creates and inspects
+// them in its own namespace, while mount runs in the other one. They must be the same directories
+// (bind-mounted at the same path), receiving the mounts made there (shared or slave propagation).
+func checkHostMountDirs(roots []string) error {
+	if hostNamespace == "" {
+		return nil
+	}
+	for _, root := range roots {
+		if out, err := hostCommand("mkdir", "-p", root).CombinedOutput(); err != nil {
+			return fmt.Errorf("Error creating %s in mount namespace %s - %s", root, hostNamespace, out)
+		}
+		var stat syscall.Stat_t
+		if err := syscall.Stat(root, &stat); err != nil {
+			return fmt.Errorf("mountDir %s is not bind-mounted from mount namespace %s (i.e. -v %s:%s:rshared): %w", root, hostNamespace, root, root, err)
+		}
+		out, err := hostCommand("stat", "-c", "%d:%i", root).Output()
+		if err != nil {
+			return fmt.Errorf("Error checking %s in mount namespace %s: %w", root, hostNamespace, err)
+		}
+		if strings.TrimSpace(string(out)) != fmt.Sprintf("%d:%d", stat.Dev, stat.Ino) {
+			return fmt.Errorf("mountDir %s is not the same directory as in mount namespace %s, bind-mount it at the same path (i.e. -v %s:%s:rshared)", root, hostNamespace, root, root)
+		}
+		propagation, mountPoint, err := mountPropagationIn("/proc/self/mountinfo", root)
+		if err != nil {
+			return fmt.Errorf("Error checking propagation of %s: %w", root, err)
+		}
+		if propagation == "private" {
+			return fmt.Errorf("mountDir %s is in private mount %s: volumes mounted in %s wouldn't show in the plugin, bind-mount it with rshared propagation", root, mountPoint, hostNamespace)
+		}
+	}
+	return nil
+}
+
+// Path of a file of the mount namespace of volumes (i.e. a device node), seen from the plugin:
+// through the root of a process there
+func hostFile(path string) string {
+	if hostNamespace == "" {
+		return path
+	}
+	return filepath.Join(procDir(), "root", path)
+}
+
+// /proc directory of a process in the mount namespace of volumes, for its mount table
+func procDir() string {
+	if hostNamespace == "" {
+		return "/proc/self"
+	}
+	return filepath.Dir(filepath.Dir(hostNamespace))
+}
+
+// Detach a mount from the mount namespace of volumes, even when busy:
+// it is cleaned up once no longer used
+func lazyUnmount(path string) error {
+	if hostNamespace == "" {
+		return syscall.Unmount(path, syscall.MNT_DETACH)
+	}
+	if out, err := hostCommand("umount", "-l", path).CombinedOutput(); err != nil {
+		return fmt.Errorf("umount -l %s failed - %s", path, out)
+	}
+	return nil
+}
+
+// Unmount a filesystem in the mount namespace of volumes
+// (an unmount in the plugin's own namespace doesn't propagate to the host)
+func unmount(path string) error {
+	if hostNamespace == "" {
+		return syscall.Unmount(path, 0)
+	}
+	out, err := hostCommand("umount", path).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	switch {
+	case strings.Contains(string(out), "busy"):
+		return syscall.EBUSY
+	case strings.Contains(string(out), "not mounted"):
+		return syscall.EINVAL
+	}
+	return fmt.Errorf("umount %s failed - %s", path, out)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	iscsiInitiatorFile = "/etc/iscsi/initiatorname.iscsi"
+	// iscsiadm exit code when the session already exists
+	iscsiErrSessionExists = 15
+)
+
+// Attach volumes exported over iSCSI, with open-iscsi
+type iscsiConnector struct{}
+
+// iSCSI target of a volume, from Cinder's connection data
+type iscsiTarget struct {
+	Portal       string
+	IQN          string
+	LUN          int
+	AuthMethod   string
+	AuthUsername string
+	AuthPassword string
+}
+
+func (iscsiConnector) volumeType() string {
+	return "iscsi"
+}
+
+func (iscsiConnector) properties(hostname string) (map[string]interface{}, error) {
+	initiator, err := iscsiInitiator()
+	if err != nil {
+		return nil, err
+	}
+
+	properties := baseProperties(hostname)
+	properties["initiator"] = initiator
+	return properties, nil
+}
+
+func (iscsiConnector) connect(ctx context.Context, data map[string]interface{}, timeout int) (string, error) {
+	target, err := newIscsiTarget(data)
+	if err != nil {
+		return "", err
+	}
+
+	if err = target.login(); err != nil {
+		return "", err
+	}
+
+	devpath := target.devicePath()
+	logger := log.WithContext(ctx).WithFields(log.Fields{"action": "connect", "dev": devpath})
+	dev, err := waitFor(ctx, []string{filepath.Dir(devpath)}, withSCSIRescan(logger, func() (string, error) {
+		if isBlockDevice(devpath) {
+			return devpath, nil
+		}
+		return "", nil
+	}), timeout)
+	if err == nil && dev == "" {
+		err = fmt.Errorf("Block device not found: %s", devpath)
+	}
+	return dev, err
+}
+
+func (iscsiConnector) disconnect(data map[string]interface{}) error {
+	target, err := newIscsiTarget(data)
+	if err != nil {
+		return err
+	}
+	return target.logout()
+}
+
+// Initiator name of this host, as configured for open-iscsi
+func iscsiInitiator() (string, error) {
+	file, err := os.Open(iscsiInitiatorFile)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "InitiatorName=") {
+			return strings.TrimPrefix(line, "InitiatorName="), nil
+		}
+	}
+
+	return "", fmt.Errorf("No InitiatorName in %s", iscsiInitiatorFile)
+}
+
+func newIscsiTarget(data map[string]interface{}) (*iscsiTarget, error) {
+	target := &iscsiTarget{}
+	target.Portal, _ = data["target_portal"].(string)
+	target.IQN, _ = data["target_iqn"].(string)
+	if lun, ok := data["target_lun"].(float64); ok {
+		target.LUN = int(lun)
+	}
+	target.AuthMethod, _ = data["auth_method"].(string)
+	target.AuthUsername, _ = data["auth_username"].(string)
+	target.AuthPassword, _ = data["auth_password"].(string)
+
+	if target.Portal == "" || target.IQN == "" {
+		return nil, errors.New("Incomplete iSCSI connection data")
+	}
+	return target, nil
+}
+
+// udev link of the target LUN
+func (t *iscsiTarget) devicePath() string {
+	return fmt.Sprintf("/dev/disk/by-path/ip-%s-iscsi-%s-lun-%d", t.Portal, t.IQN, t.LUN)
+}
+
+func (t *iscsiTarget) iscsiadm(args ...string) error {
+	args = append([]string{"-m", "node", "-T", t.IQN, "-p", t.Portal}, args...)
+	out, err := hostCommand("iscsiadm", args...).CombinedOutput()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == iscsiErrSessionExists {
+			return nil
+		}
+		return fmt.Errorf("iscsiadm %s failed - %s", strings.Join(args[6:], " "), out)
+	}
+	return nil
+}
+
+// Log in to the target, if not already
+func (t *iscsiTarget) login() error {
+	// fails when the node record already exists
+	t.iscsiadm("-o", "new")
+
+	if t.AuthMethod != "" {
+		settings := [][]string{
+			{"node.session.auth.authmethod", t.AuthMethod},
+			{"node.session.auth.username", t.AuthUsername},
+			{"node.session.auth.password", t.AuthPassword},
+		}
+		for _, setting := range settings {
+			if err := t.iscsiadm("-o", "update", "-n", setting[0], "-v", setting[1]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return t.iscsiadm("--login")
+}
+
+// Remove the LUN device, and log out of the target if no other LUN of it is in use
+func (t *iscsiTarget) logout() error {
+	if err := removeSCSIDevice(t.devicePath()); err != nil {
+		return err
+	}
+
+	prefix := fmt.Sprintf("ip-%s-iscsi-%s-lun-", t.Portal, t.IQN)
+	if files, err := os.ReadDir("/dev/disk/by-path"); err == nil {
+		for _, file := range files {
+			if strings.HasPrefix(file.Name(), prefix) && file.Name() != filepath.Base(t.devicePath()) {
+				// target shared with another volume
+				return nil
+			}
+		}
+	}
+
+	if err := t.iscsiadm("--logout"); err != nil {
+		return err
+	}
+	return t.iscsiadm("-o", "delete")
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Largest key file cryptsetup reads
+const maxKeySize = 8 * 1024 * 1024
+
+// Key material in memory: in its own pages, locked in RAM (never swapped out) and not inherited
+// by child processes, wiped when destroyed
+type secureBuffer struct {
+	data   []byte
+	mapped []byte
+}
+
+var mlockWarning sync.Once
+
+func newSecureBuffer(size int) (*secureBuffer, error) {
+	if size <= 0 || size > maxKeySize {
+		return nil, fmt.Errorf("Invalid key size %d", size)
+	}
+	mapped, err := syscall.Mmap(-1, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANON)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Mlock(mapped); err != nil {
+		// i.e. RLIMIT_MEMLOCK without CAP_IPC_LOCK
+		mlockWarning.Do(func() {
+			log.WithError(err).Warn("Can't lock key material in memory, it may be swapped out")
+		})
+	}
+	syscall.Madvise(mapped, syscall.MADV_DONTFORK)
+	return &secureBuffer{data: mapped[:size], mapped: mapped}, nil
+}
+
+// Wipe and free the buffer
+func (b *secureBuffer) destroy() {
+	zeroize(b.mapped)
+	syscall.Munlock(b.mapped)
+	syscall.Munmap(b.mapped)
+	b.data, b.mapped = nil, nil
+}
+
+func zeroize(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// Read a key file into a secure buffer
+func readKeyFile(path string) (*secureBuffer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	buf, err := newSecureBuffer(int(stat.Size()))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if _, err = io.ReadFull(f, buf.data); err != nil {
+		buf.destroy()
+		return nil, err
+	}
+	return buf, nil
+}
+
+// Keys given to a command: key files by path, keys held in memory (derived keys)
+// through pipes, never on its command line nor on disk
+type keyFiles struct {
+	pipes []*os.File
+}
+
+// Path the command reads a key from
+func (k *keyFiles) path(key string) (string, error) {
+	if !isDerivedKey(key) {
+		return hostPath(key), nil
+	}
+
+	buf, err := deriveKey(key)
+	if err != nil {
+		return "", err
+	}
+	defer buf.destroy()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return "", err
+	}
+	// keys fit in the pipe buffer: written before the command starts
+	_, err = w.Write(buf.data)
+	w.Close()
+	if err != nil {
+		r.Close()
+		return "", err
+	}
+	k.pipes = append(k.pipes, r)
+	// ExtraFiles are the command's file descriptors from 3 on
+	return fmt.Sprintf("/dev/fd/%d", 2+len(k.pipes)), nil
+}
+
+// Give the command the keys it reads through pipes
+func (k *keyFiles) attach(cmd *exec.Cmd) *exec.Cmd {
+	cmd.ExtraFiles = k.pipes
+	return cmd
+}
+
+// Close the pipes unread keys are left in
+func (k *keyFiles) close() {
+	for _, pipe := range k.pipes {
+		pipe.Close()
+	}
+	k.pipes = nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Path of a secret delivered by the orchestrator, i.e. /run/secrets/<name>
+func (d plugin) secretPath(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, "/\\") || name == "." || name == ".." {
+		return "", fmt.Errorf("Invalid secret name: %s", name)
+	}
+	return filepath.Join(d.config.SecretsDir, name), nil
+}
+
+// Key encrypting new volumes: its ID in the encryptionKeys keyring and its file,
+// or config's encryptionKey without ID
+func (d plugin) currentKey() (string, string) {
+	if d.config.EncryptionKeyID != "" {
+		return d.config.EncryptionKeyID, d.config.EncryptionKeys[d.config.EncryptionKeyID]
+	}
+	return "", d.config.EncryptionKey
+}
+
+// LUKS key file of a volume: its secret if it has one, the keyring key
+// recorded at creation, or config's encryptionKey.
+// With key derivation, the volume's own key derived from it.
+// The file is read again by cryptsetup every time, so rotated secrets apply at next mount.
+func (d plugin) keyFile(vol *volumes.Volume) (string, error) {
+	keyfile, err := d.keyFileFromMetadata(vol.Metadata)
+	if err != nil || keyfile == "" {
+		return keyfile, err
+	}
+	if vol.Metadata[metaKeyDerivation] == keyDerivationHKDF {
+		return derivedKeyFile(keyfile, keyDerivationID(vol))
+	}
+	return keyfile, nil
+}
+
+// ID a volume's key is derived from: recorded in its metadata, inherited by
+// the copies of its snapshots, or its own ID for volumes that didn't record it
+func keyDerivationID(vol *volumes.Volume) string {
+	if id := vol.Metadata[metaKeyDerivationID]; id != "" {
+		return id
+	}
+	return vol.ID
+}
+
+func (d plugin) keyFileFromMetadata(metadata map[string]string) (string, error) {
+	if name, ok := metadata[metaKeySecret]; ok {
+		path, err := d.secretPath(name)
+		if err != nil {
+			return "", err
+		}
+		if _, err := os.Stat(path); err != nil {
+			return "", fmt.Errorf("Key secret %s not available: %w", name, err)
+		}
+		return path, nil
+	}
+
+	if id, ok := metadata[metaKeyID]; ok {
+		path, ok := d.config.EncryptionKeys[id]
+		if !ok {
+			return "", fmt.Errorf("Volume key %s not in encryptionKeys", id)
+		}
+		return path, nil
+	}
+
+	return d.config.EncryptionKey, nil
+}
+
+// How volume keys are derived from master keys (keyDerivation metadata)
+const keyDerivationHKDF = "hkdf-sha256"
+
+// Derived keys are only held in memory: key files stand for them as derived:<volume ID>:<master key file>
+const derivedKeyPrefix = "derived:"
+
+// Derived keys used to be written there by older versions
+const derivedKeysDir = "/run/docker-plugin-cinder/keys"
+
+// Key file of a volume's key, derived from a master key file
+func derivedKeyFile(masterKeyFile string, volumeID string) (string, error) {
+	if _, err := os.Stat(masterKeyFile); err != nil {
+		return "", err
+	}
+	return derivedKeyPrefix + volumeID + ":" + masterKeyFile, nil
+}
+
+func isDerivedKey(keyfile string) bool {
+	return strings.HasPrefix(keyfile, derivedKeyPrefix)
+}
+
+// Derive the key a derived key file stands for
+func deriveKey(keyfile string) (*secureBuffer, error) {
+	ref := strings.SplitN(strings.TrimPrefix(keyfile, derivedKeyPrefix), ":", 2)
+	if len(ref) != 2 {
+		return nil, fmt.Errorf("Invalid derived key %s", keyfile)
+	}
+	master, err := readKeyFile(ref[1])
+	if err != nil {
+		return nil, err
+	}
+	defer master.destroy()
+
+	key, err := newSecureBuffer(64)
+	if err != nil {
+		return nil, err
+	}
+	if err = hkdfSHA256(master.data, []byte("docker-plugin-cinder luks "+ref[0]), key.data); err != nil {
+		key.destroy()
+		return nil, err
+	}
+	return key, nil
+}
+
+// Remove the derived key files older versions left
+func removeDerivedKeyFiles() error {
+	return os.RemoveAll(derivedKeysDir)
+}
+
+// HKDF (RFC 5869) with SHA-256 and no salt, filling out
+func hkdfSHA256(secret []byte, info []byte, out []byte) error {
+	_, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, info), out)
+	return err
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+// Use volumes exported as a block device of this host (os-brick's "local" protocol),
+// i.e. by a Cinder backend running on the host itself, or the e2e test cloud's loop devices
+type localDeviceConnector struct{}
+
+func (localDeviceConnector) volumeType() string {
+	return "local"
+}
+
+func (localDeviceConnector) properties(hostname string) (map[string]interface{}, error) {
+	return baseProperties(hostname), nil
+}
+
+func (localDeviceConnector) connect(ctx context.Context, data map[string]interface{}, timeout int) (string, error) {
+	devpath, _ := data["device_path"].(string)
+	if devpath == "" {
+		return "", errors.New("Incomplete local connection data")
+	}
+
+	dev, err := waitFor(ctx, []string{filepath.Dir(devpath)}, func() (string, error) {
+		if isBlockDevice(devpath) {
+			return devpath, nil
+		}
+		return "", nil
+	}, timeout)
+	if err == nil && dev == "" {
+		err = fmt.Errorf("Device %s not found", devpath)
+	}
+	return dev, err
+}
+
+// The device belongs to the backend exporting it: nothing to disconnect
+func (localDeviceConnector) disconnect(data map[string]interface{}) error {
+	return nil
+}
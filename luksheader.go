@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/openstack/objectstorage/v1/objects"
+)
+
+// LUKS headers are backed up to luksHeaderBackup, and detached headers stored in luksHeaderStore:
+// a local directory, or a Swift container as "swift://<container>"
+const swiftScheme = "swift://"
+
+func luksHeaderBackupName(vol *volumes.Volume) string {
+	return vol.ID + ".luks-header"
+}
+
+// Back up the LUKS header of a volume's device
+func (d plugin) backupLuksHeader(ctx context.Context, dev string, vol *volumes.Volume) error {
+	logger := log.WithFields(log.Fields{"dev": dev, "id": vol.ID, "action": "backupLuksHeader"})
+
+	// stored off the volume already
+	if hasDetachedHeader(vol) {
+		logger.Debug("Detached LUKS header, not backed up")
+		return nil
+	}
+
+	// cryptsetup refuses to overwrite an existing file
+	tmpDir, err := os.MkdirTemp("", "luks-header")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	tmpFile := filepath.Join(tmpDir, "header")
+
+	out, err := hostCommand("cryptsetup", "luksHeaderBackup", dev, "--header-backup-file", hostPath(tmpFile)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("luksHeaderBackup command failed - %s", out)
+	}
+
+	header, err := os.ReadFile(tmpFile)
+	if err != nil {
+		return err
+	}
+
+	logger.Debugf("Saving LUKS header to %s", d.config.LuksHeaderBackup)
+	return d.writeHeaderObject(ctx, d.config.LuksHeaderBackup, luksHeaderBackupName(vol), header, vol)
+}
+
+// Restore the LUKS header of a volume's device from its backup
+func (d plugin) restoreLuksHeader(ctx context.Context, dev string, vol *volumes.Volume) error {
+	if hasDetachedHeader(vol) {
+		return fmt.Errorf("Volume %s has a detached LUKS header, not stored on its device", vol.Name)
+	}
+
+	name := luksHeaderBackupName(vol)
+	header, err := d.readHeaderObject(ctx, d.config.LuksHeaderBackup, name)
+	if err != nil {
+		return fmt.Errorf("Error reading LUKS header backup %s: %w", name, err)
+	}
+
+	tmpFile, err := os.CreateTemp("", "luks-header")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err = tmpFile.Write(header); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	tmpFile.Close()
+
+	out, err := hostCommand("cryptsetup", "luksHeaderRestore", "-q", dev, "--header-backup-file", hostPath(tmpFile.Name())).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("luksHeaderRestore command failed - %s", out)
+	}
+
+	return nil
+}
+
+// Write a LUKS header to a local directory or a Swift container (swift://<container>)
+func (d plugin) writeHeaderObject(ctx context.Context, location string, name string, header []byte, vol *volumes.Volume) error {
+	if strings.HasPrefix(location, swiftScheme) {
+		container := strings.TrimPrefix(location, swiftScheme)
+		res := objects.Create(d.object(ctx), container, name, objects.CreateOpts{
+			Content:     bytes.NewReader(header),
+			ContentType: "application/octet-stream",
+			Metadata:    map[string]string{"volume-name": vol.Name},
+		})
+		return res.Err
+	}
+	return os.WriteFile(filepath.Join(location, name), header, 0600)
+}
+
+func (d plugin) deleteHeaderObject(ctx context.Context, location string, name string) error {
+	if strings.HasPrefix(location, swiftScheme) {
+		container := strings.TrimPrefix(location, swiftScheme)
+		return objects.Delete(d.object(ctx), container, name, nil).Err
+	}
+	if err := os.Remove(filepath.Join(location, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (d plugin) readHeaderObject(ctx context.Context, location string, name string) ([]byte, error) {
+	if strings.HasPrefix(location, swiftScheme) {
+		container := strings.TrimPrefix(location, swiftScheme)
+		res := objects.Download(d.object(ctx), container, name, nil)
+		return res.ExtractContent()
+	}
+	return os.ReadFile(filepath.Join(location, name))
+}
+
+// Check the LUKS header of a volume's device is the one it was formatted with,
+// detecting swapped volumes or replaced headers before opening it.
+// Volumes formatted before UUIDs were recorded get theirs recorded now.
+func (d plugin) verifyLuksUUID(logger *log.Entry, dev string, vol *volumes.Volume) error {
+	uuid, err := luksUUID(dev)
+	if err != nil {
+		return err
+	}
+
+	recorded, ok := vol.Metadata[metaLuksUUID]
+	if !ok {
+		logger.WithField("uuid", uuid).Info("Recording LUKS UUID")
+		if _, err = setVolumeMetadata(logger.Context, &d, vol, map[string]string{metaLuksUUID: uuid}); err != nil {
+			logger.WithError(err).Warn("Error recording LUKS UUID")
+		}
+		return nil
+	}
+
+	if uuid != recorded {
+		return fmt.Errorf("LUKS header of device %s has UUID %s, volume %s was formatted with %s: refusing to open it (volume swapped or header replaced?)",
+			dev, uuid, vol.Name, recorded)
+	}
+	return nil
+}
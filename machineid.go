@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+	log "github.com/sirupsen/logrus"
+)
+
+const metadataURL = "http://169.254.169.254/openstack/latest/meta_data.json"
+
+// Sources of the machine ID, tried in machineIDSources order
+const (
+	machineIDMetadata    = "metadata"
+	machineIDConfigDrive = "configDrive"
+	machineIDMapping     = "mapping"
+	machineIDServers     = "servers"
+)
+
+var defaultMachineIDSources = []string{machineIDMetadata, machineIDConfigDrive, machineIDMapping, machineIDServers}
+
+// Host names matched against server names, for machineIDHostname
+const (
+	hostnameOS    = "hostname"
+	hostnameShort = "short"
+	hostnameFQDN  = "fqdn"
+	hostnameEnv   = "env:"
+)
+
+// Check the machineIDSources and machineIDHostname config values
+func (c *tConfig) checkMachineIDSources() error {
+	for _, source := range c.MachineIDSources {
+		switch source {
+		case machineIDMetadata, machineIDConfigDrive, machineIDServers:
+		case machineIDMapping:
+			if c.MachineIDMap == "" {
+				return fmt.Errorf("machineIDSources entry %s requires machineIDMap", source)
+			}
+		default:
+			return fmt.Errorf("Invalid machineIDSources entry %s, use %s, %s, %s or %s", source, machineIDMetadata, machineIDConfigDrive, machineIDMapping, machineIDServers)
+		}
+	}
+
+	switch {
+	case c.MachineIDHostname == hostnameOS, c.MachineIDHostname == hostnameShort, c.MachineIDHostname == hostnameFQDN:
+	case strings.HasPrefix(c.MachineIDHostname, hostnameEnv) && len(c.MachineIDHostname) > len(hostnameEnv):
+	default:
+		return fmt.Errorf("Invalid machineIDHostname %s, use %s, %s, %s or %s<variable>", c.MachineIDHostname, hostnameOS, hostnameShort, hostnameFQDN, hostnameEnv)
+	}
+	return nil
+}
+
+// ID of the server running the plugin, from the first of machineIDSources giving it:
+// metadata service, config drive, machineIDMap file, or Openstack servers list based on the machine's hostname
+func resolveMachineID(computeClient *gophercloud.ServiceClient, config *tConfig) (string, error) {
+	sources := config.MachineIDSources
+	if len(sources) == 0 {
+		sources = defaultMachineIDSources
+	}
+
+	var errs []string
+	for _, source := range sources {
+		var id string
+		var err error
+		switch source {
+		case machineIDMetadata:
+			id, err = metadataMachineID()
+		case machineIDConfigDrive:
+			id, err = configDriveMachineID()
+		case machineIDMapping:
+			if config.MachineIDMap == "" {
+				continue
+			}
+			id, err = mappingMachineID(config)
+		case machineIDServers:
+			id, err = serversMachineID(computeClient, config)
+		}
+		if err == nil {
+			log.WithField("source", source).Debug("Found machine ID")
+			return id, nil
+		}
+		log.WithError(err).WithField("source", source).Debug("Machine ID not found")
+		errs = append(errs, fmt.Sprintf("%s: %s", source, err.Error()))
+	}
+
+	return "", fmt.Errorf("Machine ID not found (%s), set machineID in config", strings.Join(errs, "; "))
+}
+
+// Host name matching the server name, according to machineIDHostname
+func machineHostname(source string) (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case source == hostnameShort:
+		return strings.SplitN(hostname, ".", 2)[0], nil
+	case source == hostnameFQDN:
+		fqdn, err := net.LookupCNAME(hostname)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSuffix(fqdn, "."), nil
+	case strings.HasPrefix(source, hostnameEnv):
+		name := strings.TrimPrefix(source, hostnameEnv)
+		if hostname = os.Getenv(name); hostname == "" {
+			return "", fmt.Errorf("Environment variable %s not set", name)
+		}
+	}
+	return hostname, nil
+}
+
+// ID of the only server named after this machine
+func serversMachineID(computeClient *gophercloud.ServiceClient, config *tConfig) (string, error) {
+	if computeClient == nil {
+		return "", fmt.Errorf("Nova is not used in standalone mode")
+	}
+
+	hostname, err := machineHostname(config.MachineIDHostname)
+	if err != nil {
+		return "", err
+	}
+
+	listOpts := servers.ListOpts{
+		TenantID: config.TenantID,
+		Name:     hostname,
+	}
+
+	allPages, err := servers.List(computeClient, listOpts).AllPages()
+	if err != nil {
+		return "", err
+	}
+
+	allServers, err := servers.ExtractServers(allPages)
+	if err != nil {
+		return "", err
+	}
+
+	// Name is a regexp: keep exact matches only
+	var matching []servers.Server
+	for _, server := range allServers {
+		log.WithField("id", server.ID).Info("servers list")
+		if server.Name == hostname {
+			matching = append(matching, server)
+		}
+	}
+
+	if len(matching) != 1 {
+		return "", fmt.Errorf("Openstack servers list returned %d servers for name %s", len(matching), hostname)
+	}
+
+	return matching[0].ID, nil
+}
+
+// ID of this machine in the machineIDMap file, a JSON object of host names to server IDs,
+// for servers deliberately named differently from their hosts.
+// Read at each lookup, so it can be updated without restarting the plugin.
+func mappingMachineID(config *tConfig) (string, error) {
+	hostname, err := machineHostname(config.MachineIDHostname)
+	if err != nil {
+		return "", err
+	}
+
+	content, err := ioutil.ReadFile(config.MachineIDMap)
+	if err != nil {
+		return "", err
+	}
+	var mapping map[string]string
+	if err = json.Unmarshal(content, &mapping); err != nil {
+		return "", fmt.Errorf("Invalid machineIDMap %s: %w", config.MachineIDMap, err)
+	}
+
+	id, ok := mapping[hostname]
+	if !ok {
+		return "", fmt.Errorf("No entry for %s in %s", hostname, config.MachineIDMap)
+	}
+	if !uuidRegex.MatchString(id) {
+		return "", fmt.Errorf("Invalid server ID %s for %s in %s", id, hostname, config.MachineIDMap)
+	}
+	return id, nil
+}
+
+// Config drive block device, mounted read-only for a moment to read its metadata
+func configDriveMachineID() (string, error) {
+	var dev string
+	for _, label := range []string{"config-2", "CONFIG-2"} {
+		path := filepath.Join("/dev/disk/by-label", label)
+		if _, err := os.Stat(path); err == nil {
+			dev = path
+			break
+		}
+	}
+	if dev == "" {
+		return "", fmt.Errorf("No config drive (config-2 labelled device)")
+	}
+
+	dir, err := ioutil.TempDir("", "config-drive")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(dir)
+
+	err = syscall.Mount(dev, dir, "iso9660", syscall.MS_RDONLY, "")
+	if err != nil {
+		err = syscall.Mount(dev, dir, "vfat", syscall.MS_RDONLY, "")
+	}
+	if err != nil {
+		return "", fmt.Errorf("Can't mount config drive %s: %w", dev, err)
+	}
+	defer syscall.Unmount(dir, 0)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "openstack", "latest", "meta_data.json"))
+	if err != nil {
+		return "", err
+	}
+	var metadata instanceMetadata
+	if err = json.Unmarshal(data, &metadata); err != nil {
+		return "", err
+	}
+	if metadata.UUID == "" {
+		return "", fmt.Errorf("No uuid in config drive metadata")
+	}
+	return metadata.UUID, nil
+}
+
+// What the plugin reads from the metadata service
+type instanceMetadata struct {
+	UUID             string `json:"uuid"`
+	AvailabilityZone string `json:"availability_zone"`
+}
+
+func getInstanceMetadata() (*instanceMetadata, error) {
+	client := http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get(metadataURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Metadata service returned %s", resp.Status)
+	}
+
+	var metadata instanceMetadata
+	if err = json.NewDecoder(resp.Body).Decode(&metadata); err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+func metadataMachineID() (string, error) {
+	metadata, err := getInstanceMetadata()
+	if err != nil {
+		return "", err
+	}
+	if metadata.UUID == "" {
+		return "", fmt.Errorf("No uuid in metadata")
+	}
+
+	return metadata.UUID, nil
+}
+
+// ID of this machine, read by concurrent operations while one of them may look it up again
+type machineIDHolder struct {
+	mutex sync.RWMutex
+	id    string
+}
+
+func (m *machineIDHolder) get() string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.id
+}
+
+// Replace the ID, unless another operation already changed it
+func (m *machineIDHolder) swap(old string, id string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.id != old {
+		return false
+	}
+	m.id = id
+	return true
+}
+
+// ID of the server running the plugin
+func (d plugin) machineID() string {
+	return d.machine.get()
+}
+
+// Look up the ID of this machine again, as it changes when the instance is
+// rebuilt or moved. Returns whether it changed.
+func (d plugin) refreshMachineID(logger *log.Entry) bool {
+	if d.machineIDForced {
+		return false
+	}
+
+	old := d.machineID()
+	id, err := resolveMachineID(d.compute(logger.Context), d.config)
+	if err != nil {
+		logger.WithError(err).Warn("Error looking up machine ID")
+		return false
+	}
+	if id == old {
+		return false
+	}
+	if !d.machine.swap(old, id) {
+		// changed by another operation meanwhile
+		return true
+	}
+
+	logger.Warnf("Machine ID changed from %s to %s", old, id)
+	return true
+}
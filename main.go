@@ -1,13 +1,14 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	_log "log"
 	"os"
+	"path/filepath"
+	"time"
 
-	"github.com/coreos/go-systemd/activation"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/docker/go-plugins-helpers/volume"
@@ -16,6 +17,7 @@ import (
 )
 
 type tConfig struct {
+	ConfigVersion               int `json:"configVersion,omitempty"`
 	Debug                       bool
 	Quiet                       bool
 	IdentityEndpoint            string `json:"endpoint,omitempty"`
@@ -30,7 +32,15 @@ type tConfig struct {
 	ApplicationCredentialSecret string `json:"applicationCredentialSecret,omitempty"`
 	Region                      string `json:"region,omitempty"`
 	MachineID                   string `json:"machineID,omitempty"`
+	// where the machine ID is looked up, in order: metadata, configDrive, mapping, servers
+	MachineIDSources            []string `json:"machineIDSources,omitempty"`
+	MachineIDHostname           string `json:"machineIDHostname,omitempty"`
+	MachineIDMap                string `json:"machineIDMap,omitempty"`
 	MountDir                    string `json:"mountDir,omitempty"`
+	// volume type -> directory its volumes are mounted in, instead of mountDir
+	MountDirs                   map[string]string `json:"mountDirs,omitempty"`
+	// directories mountpoint options must be in
+	MountpointRoots             []string `json:"mountpointRoots,omitempty"`
 	Filesystem                  string `json:"filesystem,omitempty"`
 	DefaultSize                 string `json:"defaultSize,omitempty"`
 	DefaultType                 string `json:"defaultType,omitempty"`
@@ -40,6 +50,143 @@ type tConfig struct {
 	TimeoutDeviceWait           int `json:"timeoutDeviceWait,omitempty"`
 	DelayVolumeState            int `json:"delayVolumeState,omitempty"`
 	DelayDeviceWait             int `json:"delayDeviceWait,omitempty"`
+	DeviceIDLength              int `json:"deviceIDLength,omitempty"`
+	TimeoutOpenFiles            int `json:"timeoutOpenFiles,omitempty"`
+	TimeoutDetaching            int `json:"timeoutDetaching,omitempty"`
+	TimeoutAttaching            int `json:"timeoutAttaching,omitempty"`
+	MountDirRetries             int `json:"mountDirRetries,omitempty"`
+	MountDirRetryDelay          int `json:"mountDirRetryDelay,omitempty"`
+	SnapshotBeforeDelete        bool `json:"snapshotBeforeDelete,omitempty"`
+	SnapshotTTL                 int `json:"snapshotTTL,omitempty"`
+	TrashPurgeInterval          int `json:"trashPurgeInterval,omitempty"`
+	ForceRemove                 bool `json:"forceRemove,omitempty"`
+	TimeoutFreeze               int `json:"timeoutFreeze,omitempty"`
+	AutoGrow                    bool `json:"autoGrow,omitempty"`
+	NoAutoFormat                bool `json:"noAutoFormat,omitempty"`
+	SecureMount                 bool `json:"secureMount,omitempty"`
+	NoExec                      bool `json:"noExec,omitempty"`
+	ReservedBlocksPercent       int `json:"reservedBlocksPercent,omitempty"`
+	FastFormat                  bool `json:"fastFormat,omitempty"`
+	ManagedOnly                 bool `json:"managedOnly,omitempty"`
+	PruneProtection             bool `json:"pruneProtection,omitempty"`
+	EngineID                    string `json:"engineID,omitempty"`
+	ListFilterPrefix            string `json:"listFilterPrefix,omitempty"`
+	DefaultEncryption           bool `json:"defaultEncryption,omitempty"`
+	SecretsDir                  string `json:"secretsDir,omitempty"`
+	InsecureFiles               string `json:"insecureFiles,omitempty"`
+	FIPS                        bool `json:"fips,omitempty"`
+	LuksHeaderBackup            string `json:"luksHeaderBackup,omitempty"`
+	LuksHeaderStore             string `json:"luksHeaderStore,omitempty"`
+	LuksType                    string `json:"luksType,omitempty"`
+	DeriveKeys                  bool `json:"deriveKeys,omitempty"`
+	Discard                     bool `json:"discard,omitempty"`
+	// key ID -> key file
+	EncryptionKeys              map[string]string `json:"encryptionKeys,omitempty"`
+	EncryptionKeyID             string `json:"encryptionKeyID,omitempty"`
+	ResetErrorState             bool `json:"resetErrorState,omitempty"`
+	PollVolumeState             int `json:"pollVolumeState,omitempty"`
+	MaxPollVolumeState          int `json:"maxPollVolumeState,omitempty"`
+	RetriesVolumeState          int `json:"retriesVolumeState,omitempty"`
+	TimeoutAttach               int `json:"timeoutAttach,omitempty"`
+	TimeoutDetach               int `json:"timeoutDetach,omitempty"`
+	PollDeviceWait              int `json:"pollDeviceWait,omitempty"`
+	ScsiRescanDelay             int `json:"scsiRescanDelay,omitempty"`
+	AttachRetries               int `json:"attachRetries,omitempty"`
+	Connector                   string `json:"connector,omitempty"`
+	Standalone                  bool `json:"standalone,omitempty"`
+	HostNamespace               string `json:"hostNamespace,omitempty"`
+	HealthInterval              int `json:"healthInterval,omitempty"`
+	BreakerThreshold            int `json:"breakerThreshold,omitempty"`
+	BreakerCooldown             int `json:"breakerCooldown,omitempty"`
+	MaxRunningOps               int `json:"maxRunningOps,omitempty"`
+	MaxQueuedOps                int `json:"maxQueuedOps,omitempty"`
+	TimeoutOperation            int `json:"timeoutOperation,omitempty"`
+	TimeoutAPI                  int `json:"timeoutAPI,omitempty"`
+	StateFile                   string `json:"stateFile,omitempty"`
+	SocketName                  string `json:"socketName,omitempty"`
+	SocketDir                   string `json:"socketDir,omitempty"`
+	SocketGroup                 string `json:"socketGroup,omitempty"`
+	SocketMode                  string `json:"socketMode,omitempty"`
+	CacheNotFound               int `json:"cacheNotFound,omitempty"`
+	AsyncCreate                 bool `json:"asyncCreate,omitempty"`
+	LogProgress                 int `json:"logProgress,omitempty"`
+	CrossAZ                     string `json:"crossAZ,omitempty"`
+	TimeoutMigration            int `json:"timeoutMigration,omitempty"`
+	// filesystem usage percentages
+	CapacityAlerts              []int `json:"capacityAlerts,omitempty"`
+	CapacityWebhook             string `json:"capacityWebhook,omitempty"`
+	GhostWebhook                string `json:"ghostWebhook,omitempty"`
+	CapacityInterval            int `json:"capacityInterval,omitempty"`
+	AutoExtendThreshold         int `json:"autoExtendThreshold,omitempty"`
+	AutoExtendStep              int `json:"autoExtendStep,omitempty"`
+	AutoExtendMaxSize           int `json:"autoExtendMaxSize,omitempty"`
+	AutoExtendInterval          int `json:"autoExtendInterval,omitempty"`
+	MapperCleanupInterval       int `json:"mapperCleanupInterval,omitempty"`
+	// availability zone -> host@backend#pool where volumes are migrated
+	AZMigrationHosts            map[string]string `json:"azMigrationHosts,omitempty"`
+	NameTemplate                string `json:"nameTemplate,omitempty"`
+	NameVars                    map[string]string `json:"nameVars,omitempty"`
+	PolicyHook                  string `json:"policyHook,omitempty"`
+	PolicyTimeout               int `json:"policyTimeout,omitempty"`
+	// create options users may not set, i.e. size, type, encryption
+	LockedOptions               []string `json:"lockedOptions,omitempty"`
+	// volume types users may request with -o type=, all when empty
+	AllowedTypes                []string `json:"allowedTypes,omitempty"`
+	// volume type -> create option -> default value
+	TypeProfiles                map[string]map[string]string `json:"typeProfiles,omitempty"`
+	// volume type (or "*" for all) -> /sys/block/<dev>/queue/ setting -> value
+	DeviceTuning                map[string]map[string]string `json:"deviceTuning,omitempty"`
+}
+
+// Timeout waiting for an attaching volume to become in-use
+func (c *tConfig) attachTimeout() int {
+	if c.TimeoutAttach > 0 {
+		return c.TimeoutAttach
+	}
+	return c.TimeoutVolumeState
+}
+
+// Timeout waiting for a detached volume to become available
+func (c *tConfig) detachTimeout() int {
+	if c.TimeoutDetach > 0 {
+		return c.TimeoutDetach
+	}
+	return c.TimeoutVolumeState
+}
+
+// Directory volumes of a type are mounted in
+func (c *tConfig) mountRoot(volumeType string) string {
+	if dir, ok := c.MountDirs[volumeType]; ok {
+		return dir
+	}
+	return c.MountDir
+}
+
+// All directories volumes are mounted in, mountDir first
+func (c *tConfig) mountRoots() []string {
+	roots := []string{c.MountDir}
+	for _, dir := range c.MountDirs {
+		known := false
+		for _, root := range roots {
+			known = known || root == dir
+		}
+		if !known {
+			roots = append(roots, dir)
+		}
+	}
+	return roots
+}
+
+// Block device settings for a volume type: "*" settings, overridden by the type's own
+func (c *tConfig) deviceTuning(volumeType string) map[string]string {
+	settings := make(map[string]string)
+	for name, value := range c.DeviceTuning["*"] {
+		settings[name] = value
+	}
+	for name, value := range c.DeviceTuning[volumeType] {
+		settings[name] = value
+	}
+	return settings
 }
 
 func init() {
@@ -56,9 +203,33 @@ func main() {
 	flag.BoolVar(&config.Debug, "debug", false, "Enable debug logging")
 	flag.BoolVar(&config.Quiet, "quiet", false, "Only report errors")
 	flag.StringVar(&configFile, "config", "cinder.json", "Config file")
+	flag.StringVar(&config.IdentityEndpoint, "endpoint", "", "Keystone endpoint")
+	flag.StringVar(&config.Username, "username", "", "OpenStack user name")
+	flag.StringVar(&config.Password, "password", "", "OpenStack password (visible in the process list, prefer the config file or OS_PASSWORD)")
+	flag.StringVar(&config.DomainID, "domainID", "", "OpenStack domain ID")
+	flag.StringVar(&config.DomainName, "domainName", "", "OpenStack domain name")
+	flag.StringVar(&config.TenantID, "tenantId", "", "OpenStack project ID")
+	flag.StringVar(&config.TenantName, "tenantName", "", "OpenStack project name")
+	flag.StringVar(&config.ApplicationCredentialID, "applicationCredentialId", "", "OpenStack application credential ID")
+	flag.StringVar(&config.ApplicationCredentialName, "applicationCredentialName", "", "OpenStack application credential name")
+	flag.StringVar(&config.ApplicationCredentialSecret, "applicationCredentialSecret", "", "OpenStack application credential secret (visible in the process list, prefer the config file or OS_APPLICATION_CREDENTIAL_SECRET)")
+	flag.StringVar(&config.Region, "region", "", "OpenStack region")
+	flag.Var(jsonFlag{&config.MachineIDSources}, "machineIDSources", "Where the machine ID is looked up, in order (JSON list of metadata, configDrive, mapping, servers)")
+	flag.Var(jsonFlag{&config.MountDirs}, "mountDirs", "Directory volumes are mounted in, per volume type (JSON object)")
+	flag.Var(jsonFlag{&config.MountpointRoots}, "mountpointRoots", "Directories mountpoint options must be in (JSON list)")
+	flag.Var(jsonFlag{&config.EncryptionKeys}, "encryptionKeys", "Key files by key ID (JSON object)")
+	flag.Var(jsonFlag{&config.CapacityAlerts}, "capacityAlerts", "Filesystem usage percentages alerted on (JSON list)")
+	flag.Var(jsonFlag{&config.AZMigrationHosts}, "azMigrationHosts", "Cinder backend (host@backend#pool) volumes are migrated to, per availability zone (JSON object)")
+	flag.Var(jsonFlag{&config.NameVars}, "nameVars", "Variables of nameTemplate (JSON object)")
+	flag.Var(jsonFlag{&config.LockedOptions}, "lockedOptions", "Create options users may not set (JSON list)")
+	flag.Var(jsonFlag{&config.AllowedTypes}, "allowedTypes", "Volume types users may request, all when empty (JSON list)")
+	flag.Var(jsonFlag{&config.TypeProfiles}, "typeProfiles", "Default create options per volume type (JSON object)")
+	flag.Var(jsonFlag{&config.DeviceTuning}, "deviceTuning", "/sys/block/<dev>/queue/ settings per volume type, * for all (JSON object)")
 	flag.StringVar(&config.MountDir, "mountDir", "/var/lib/cinder/mount", "Cinder mount directory")
 	flag.StringVar(&config.MachineID, "machineID", "", "force machine ID")
-	flag.StringVar(&config.Filesystem, "filesystem", "ext4", "New volumes filesystem (ext4)")
+	flag.StringVar(&config.MachineIDMap, "machineIDMap", "", "JSON file mapping host names to server IDs")
+	flag.StringVar(&config.MachineIDHostname, "machineIDHostname", "hostname", "Name of this machine's server, to find its ID in the servers list: hostname, short, fqdn or env:<variable>")
+	flag.StringVar(&config.Filesystem, "filesystem", "ext4", "New volumes filesystem: "+supportedFilesystems()+" (ext4)")
 	flag.StringVar(&config.DefaultSize, "defaultSize", "10", "New volumes default size (10)")
 	flag.StringVar(&config.DefaultType, "defaultType", "classic", "New volumes default type (classic)")
 	flag.StringVar(&config.VolumeSubDir, "volumeSubDir", "data", "Volumes subdirectory (data)")
@@ -66,24 +237,218 @@ func main() {
 	flag.IntVar(&config.TimeoutVolumeState, "timeoutVolumeState", 5, "Timeout for waitOnVolumeState (s)")
 	flag.IntVar(&config.TimeoutDeviceWait, "timeoutDeviceWait", 5, "Timeout when waiting for device attachment (s)")
 	flag.IntVar(&config.DelayVolumeState, "delayVolumeState", 1, "Delay after waitOnVolumeState (s)")
+	flag.StringVar(&config.HostNamespace, "hostNamespace", "", "Mount namespace to mount volumes in when running in a container, i.e. /proc/1/ns/mnt (host PID namespace)")
+	flag.StringVar(&config.Connector, "connector", connectorNova, "How volumes are attached: nova, or iscsi, fc, nvmeof, rbd, local for hosts not managed by Nova (i.e. Ironic bare-metal nodes)")
+	flag.BoolVar(&config.Standalone, "standalone", false, "Attach volumes with the Cinder attachments API, for clouds without Nova (requires a connector other than nova)")
+	flag.IntVar(&config.HealthInterval, "healthInterval", 60, "Interval between OpenStack endpoints probes, 0 to disable (s)")
+	flag.IntVar(&config.BreakerThreshold, "breakerThreshold", 5, "Consecutive OpenStack API failures before failing fast, 0 to disable")
+	flag.IntVar(&config.BreakerCooldown, "breakerCooldown", 30, "How long OpenStack API calls fail fast after breakerThreshold failures (s)")
+	flag.IntVar(&config.MaxRunningOps, "maxRunningOps", 4, "Volume operations (create, mount, unmount, remove) running at once")
+	flag.IntVar(&config.MaxQueuedOps, "maxQueuedOps", 64, "Volume operations waiting or running, beyond which they are rejected (0: unlimited)")
+	flag.IntVar(&config.TimeoutOperation, "timeoutOperation", 0, "Give up on create and mount operations after this time, logging a diagnostic, 0 to disable (s)")
+	flag.IntVar(&config.TimeoutAPI, "timeoutAPI", 60, "Timeout of each OpenStack API call, 0 to disable (s)")
+	flag.StringVar(&config.StateFile, "stateFile", "/var/lib/cinder/state.db", "Local database of the volumes in use on this host, empty to disable")
+	flag.StringVar(&config.SocketName, "socketName", "cinder", "Plugin name, naming its socket (<name>.sock), or socket full path")
+	flag.StringVar(&config.SocketDir, "socketDir", "/run/docker/plugins", "Directory of the plugin socket, where Docker looks for plugins")
+	flag.StringVar(&config.SocketGroup, "socketGroup", "", "Group (name or ID) owning the plugin socket, default: the plugin's")
+	flag.StringVar(&config.SocketMode, "socketMode", "0660", "Permissions of the plugin socket (octal)")
+	flag.StringVar(&config.CapacityWebhook, "capacityWebhook", "", "URL receiving a JSON POST when a mounted volume crosses a capacityAlerts threshold")
+	flag.StringVar(&config.GhostWebhook, "ghostWebhook", "", "URL receiving a JSON POST when a volume known to Docker is missing from Cinder")
+	flag.IntVar(&config.CapacityInterval, "capacityInterval", 60, "Interval between filesystem usage checks of capacityAlerts (s)")
+	flag.IntVar(&config.AutoExtendThreshold, "autoExtendThreshold", 0, "Extend mounted volumes when their filesystem usage reaches this percentage, 0 to disable")
+	flag.IntVar(&config.AutoExtendStep, "autoExtendStep", 10, "Size added to volumes extended automatically (GB)")
+	flag.IntVar(&config.AutoExtendMaxSize, "autoExtendMaxSize", 0, "Size volumes are not extended automatically beyond, 0 for no limit (GB)")
+	flag.IntVar(&config.AutoExtendInterval, "autoExtendInterval", 60, "Interval between filesystem usage checks of autoExtendThreshold (s)")
+	flag.IntVar(&config.MapperCleanupInterval, "mapperCleanupInterval", 300, "Interval between closings of dangling LUKS mappings, 0 for startup only (s)")
+	flag.StringVar(&config.CrossAZ, "crossAZ", crossAZAllow, "Volumes in another availability zone: allow attaching them, fail with a clear error, or migrate them to azMigrationHosts (admin rights)")
+	flag.IntVar(&config.TimeoutMigration, "timeoutMigration", 3600, "Give up waiting for a volume migration after this time, 0 to disable (s)")
+	flag.IntVar(&config.LogProgress, "logProgress", 10, "Interval between progress logs of running volume operations, 0 to disable (s)")
+	flag.BoolVar(&config.AsyncCreate, "asyncCreate", false, "Return from create once Cinder accepted it, restoring backups and encrypting in the background (mount waits for it)")
+	flag.IntVar(&config.CacheNotFound, "cacheNotFound", 5, "How long volumes not found are remembered as missing, 0 to disable (s)")
+	flag.StringVar(&config.NameTemplate, "nameTemplate", "", "Go template of Cinder volume names, with {{.DockerName}} and nameVars, i.e. {{.Cluster}}-{{.DockerName}}")
+	flag.IntVar(&config.PollVolumeState, "pollVolumeState", 500, "First interval of waitOnVolumeState polling, doubled up to maxPollVolumeState (ms)")
+	flag.IntVar(&config.MaxPollVolumeState, "maxPollVolumeState", 5000, "Longest interval of waitOnVolumeState polling (ms)")
+	flag.IntVar(&config.RetriesVolumeState, "retriesVolumeState", 0, "API errors tolerated while polling a volume state")
+	flag.IntVar(&config.TimeoutAttach, "timeoutAttach", 0, "Timeout waiting for an attaching volume to become in-use, 0 for timeoutVolumeState (s)")
+	flag.IntVar(&config.TimeoutDetach, "timeoutDetach", 0, "Timeout waiting for a detached volume to become available, 0 for timeoutVolumeState (s)")
+	flag.IntVar(&config.PollDeviceWait, "pollDeviceWait", 1000, "Interval of device checks when waiting for device attachment (ms)")
+	flag.IntVar(&config.ScsiRescanDelay, "scsiRescanDelay", 2, "Wait for a device before rescanning SCSI hosts, then between rescans, 0 to disable (s)")
+	flag.IntVar(&config.AttachRetries, "attachRetries", 1, "Attach again volumes which attach never completes, this many times")
 	flag.IntVar(&config.DelayDeviceWait, "delayDeviceWait", 1, "Delay after device attachment (s)")
+	flag.IntVar(&config.DeviceIDLength, "deviceIDLength", 20, "Characters of the volume ID looked for in /dev/disk/by-id names")
+	flag.IntVar(&config.TimeoutOpenFiles, "timeoutOpenFiles", 5, "Timeout waiting for open files to be closed before unmount (s)")
+	flag.IntVar(&config.MountDirRetries, "mountDirRetries", 3, "Retries creating a mount directory, unmounting what is left there")
+	flag.IntVar(&config.MountDirRetryDelay, "mountDirRetryDelay", 1000, "First delay before unmounting what is left in a mount directory, doubled at each retry (ms)")
+	flag.IntVar(&config.TimeoutDetaching, "timeoutDetaching", 120, "Force-detach volumes stuck in 'detaching' after this time, 0 to disable (s)")
+	flag.IntVar(&config.TimeoutAttaching, "timeoutAttaching", 900, "With resetErrorState, reset volumes 'attaching' since this long (s)")
+	flag.BoolVar(&config.SnapshotBeforeDelete, "snapshotBeforeDelete", false, "Snapshot volumes before removing them")
+	flag.IntVar(&config.SnapshotTTL, "snapshotTTL", 72, "How long removed volumes and their snapshot are kept (h)")
+	flag.IntVar(&config.TrashPurgeInterval, "trashPurgeInterval", 3600, "Interval between purges of removed volumes whose snapshotTTL expired, 0 for startup and removals only (s)")
+	flag.BoolVar(&config.ForceRemove, "forceRemove", false, "Force-detach and force-delete volumes that can't be removed normally")
+	flag.IntVar(&config.TimeoutFreeze, "timeoutFreeze", 30, "Maximum time a filesystem stays frozen for a snapshot (s)")
+	flag.BoolVar(&config.AutoGrow, "autoGrow", true, "Grow filesystems at mount when their volume was extended")
+	flag.BoolVar(&config.NoAutoFormat, "noAutoFormat", false, "Fail mounting volumes without filesystem instead of formatting them")
+	flag.BoolVar(&config.SecureMount, "secureMount", false, "Always mount volumes with nosuid,nodev")
+	flag.BoolVar(&config.NoExec, "noExec", false, "Always mount volumes with noexec")
+	flag.IntVar(&config.ReservedBlocksPercent, "reservedBlocksPercent", -1, "ext2/3/4 reserved blocks percentage for new volumes (-1: mkfs default)")
+	flag.BoolVar(&config.FastFormat, "fastFormat", false, "Format new volumes with lazy initialization and no discard")
+	flag.BoolVar(&config.ManagedOnly, "managedOnly", false, "Only handle volumes created by the plugin")
+	flag.BoolVar(&config.PruneProtection, "pruneProtection", false, "Refuse to remove volumes created by another Docker engine")
+	flag.StringVar(&config.EngineID, "engineID", "", "ID marking the volumes this Docker engine creates (default: Docker's engine ID, or the host name)")
+	flag.StringVar(&config.ListFilterPrefix, "listFilterPrefix", "", "Only handle volumes which name starts with this prefix")
+	flag.BoolVar(&config.DefaultEncryption, "defaultEncryption", false, "Encrypt new volumes unless created with encryption=false")
+	flag.BoolVar(&config.FIPS, "fips", false, "Only use FIPS-approved LUKS algorithms, and refuse to start unless the host is in FIPS mode")
+	flag.StringVar(&config.InsecureFiles, "insecureFiles", insecureFilesFail, "Config and key files other users can access: fail to start, or warn")
+	flag.StringVar(&config.SecretsDir, "secretsDir", "/run/secrets", "Directory of secrets holding volume keys (keySecret volume option)")
+	flag.StringVar(&config.LuksHeaderBackup, "luksHeaderBackup", "", "LUKS headers backup directory, or swift://<container>")
+	flag.StringVar(&config.LuksHeaderStore, "luksHeaderStore", "", "Format new encrypted volumes with a detached LUKS header, stored in this directory or swift://<container>")
+	flag.StringVar(&config.LuksType, "luksType", "", "LUKS format of new encrypted volumes: luks1 or luks2 (cryptsetup default)")
+	flag.StringVar(&config.PolicyHook, "policyHook", "", "Command or http(s) URL authorizing create, mount and remove requests (JSON)")
+	flag.IntVar(&config.PolicyTimeout, "policyTimeout", 10, "Timeout of policyHook calls (s)")
+	flag.BoolVar(&config.Discard, "discard", false, "Pass TRIM through to Cinder: open LUKS devices with --allow-discards and mount with discard")
+	flag.BoolVar(&config.DeriveKeys, "deriveKeys", false, "Encrypt new volumes with keys derived from the encryption key and their ID (HKDF-SHA256)")
+	flag.StringVar(&config.EncryptionKeyID, "encryptionKeyID", "", "ID of the encryptionKeys key encrypting new volumes")
+	flag.BoolVar(&config.ResetErrorState, "resetErrorState", false, "Reset volumes in error states to retry mounting or removing them (admin rights)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] [command]\n\nOptions:\n", os.Args[0])
+		flag.PrintDefaults()
+		printCommands()
+	}
 	flag.Parse()
 
 	log.SetFormatter(&log.TextFormatter{DisableTimestamp: true})
 	log.SetOutput(os.Stdout)
 
-	content, err := ioutil.ReadFile(configFile)
-	if err != nil {
-		log.Fatal(err.Error())
-	}
+	// doctor reports what prevents starting rather than exiting on the first one
+	startup := &startupFailures{doctor: flag.NArg() > 0 && flag.Arg(0) == "doctor"}
+
+	// flags given on the command line win over config files and variables
+	explicit := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
 
-	err = json.Unmarshal(content, &config)
+	defaults := config
+	configFiles, fileErr := loadConfigFiles(configFile, &config)
+	// managed plugins may be configured with variables only (docker plugin set)
+	fromEnv, err := loadConfigEnv(&config, &defaults)
 	if err != nil {
-		log.Fatal(err.Error())
+		startup.fail(nil, "config", "%s", err)
+	}
+	if fileErr != nil && !(fromEnv && os.IsNotExist(fileErr)) {
+		startup.fail(nil, "config", "%s", fileErr)
+	}
+	for name, value := range explicit {
+		if err = flag.Set(name, value); err != nil {
+			startup.fail(nil, "config", "%s", err)
+		}
 	}
 
 	if len(config.MountDir) == 0 {
-		log.Fatal("No mountDir configured. Abort.")
+		startup.fail(nil, "config", "No mountDir configured. Abort.")
+	}
+	for volumeType, dir := range config.MountDirs {
+		if !filepath.IsAbs(dir) {
+			startup.fail(nil, "config", "mountDirs entry of volume type %s must be an absolute path", volumeType)
+		}
+	}
+	for _, root := range config.MountpointRoots {
+		if !filepath.IsAbs(root) || filepath.Clean(root) == "/" {
+			startup.fail(nil, "config", "mountpointRoots entry %s must be an absolute path, other than /", root)
+		}
+	}
+	if len(config.MountpointRoots) > 0 && config.StateFile == "" {
+		startup.fail(nil, "config", "mountpointRoots requires a stateFile, to find custom mountpoints again")
+	}
+
+	if len(config.EncryptionKeyID) > 0 {
+		if _, ok := config.EncryptionKeys[config.EncryptionKeyID]; !ok {
+			startup.fail(nil, "config", "encryptionKeyID %s not in encryptionKeys", config.EncryptionKeyID)
+		}
+	}
+
+	if config.DefaultEncryption && len(config.EncryptionKey) == 0 && len(config.EncryptionKeyID) == 0 {
+		startup.fail(nil, "config", "defaultEncryption requires an encryptionKey or encryptionKeyID")
+	}
+
+	if config.InsecureFiles != insecureFilesFail && config.InsecureFiles != insecureFilesWarn {
+		startup.fail(nil, "config", "Invalid insecureFiles %s, use %s or %s", config.InsecureFiles, insecureFilesFail, insecureFilesWarn)
+	}
+	if err = config.checkSecretFiles(configFiles); err != nil {
+		startup.fail(nil, "config", "%s", err)
+	}
+
+	// tools are looked up where they run
+	if err = setHostNamespace(config.HostNamespace); err != nil {
+		startup.fail(nil, "config", "%s", err)
+	} else if err = checkHostMountDirs(config.mountRoots()); err != nil {
+		startup.fail(nil, "config", "%s", err)
+	}
+
+	// doctor reports missing tools with the other checks
+	if flag.Arg(0) != "doctor" {
+		for _, filesystem := range config.enabledFilesystems() {
+			if err = checkFilesystemTools(filesystem, config.AutoGrow); err != nil {
+				startup.fail(nil, "config", "%s", err)
+			}
+		}
+	}
+
+	if _, err = newLocalConnector(config.Connector); err != nil {
+		startup.fail(nil, "config", "%s", err)
+	}
+
+	if config.AutoExtendThreshold > 0 && (config.AutoExtendThreshold > 100 || config.AutoExtendInterval <= 0 || config.AutoExtendStep <= 0) {
+		startup.fail(nil, "config", "autoExtendThreshold must be a percentage, with positive autoExtendInterval and autoExtendStep")
+	}
+
+	for _, threshold := range config.CapacityAlerts {
+		if threshold <= 0 || threshold > 100 || config.CapacityInterval <= 0 {
+			startup.fail(nil, "config", "capacityAlerts must be percentages, with a positive capacityInterval")
+		}
+	}
+
+	if config.CrossAZ != crossAZAllow && config.CrossAZ != crossAZFail && config.CrossAZ != crossAZMigrate {
+		startup.fail(nil, "config", "Invalid crossAZ %s, use %s, %s or %s", config.CrossAZ, crossAZAllow, crossAZFail, crossAZMigrate)
+	}
+	if config.TimeoutMigration < 0 {
+		startup.fail(nil, "config", "timeoutMigration can't be negative")
+	}
+
+	if config.Standalone && config.Connector == connectorNova {
+		startup.fail(nil, "config", "standalone mode requires a connector other than nova")
+	}
+
+	if config.LuksType != "" && config.LuksType != "luks1" && config.LuksType != "luks2" {
+		startup.fail(nil, "config", "Invalid luksType %s, use luks1 or luks2", config.LuksType)
+	}
+
+	if config.PollVolumeState <= 0 || config.PollDeviceWait <= 0 {
+		startup.fail(nil, "config", "pollVolumeState and pollDeviceWait must be positive")
+	}
+	if config.MaxPollVolumeState < config.PollVolumeState {
+		log.Warnf("maxPollVolumeState %dms is below pollVolumeState, using %dms", config.MaxPollVolumeState, config.PollVolumeState)
+		config.MaxPollVolumeState = config.PollVolumeState
+	}
+	if config.RetriesVolumeState < 0 || config.AttachRetries < 0 || config.TimeoutAttach < 0 || config.TimeoutDetach < 0 || config.TimeoutAttaching < 0 || config.MountDirRetries < 0 || config.MountDirRetryDelay < 0 {
+		startup.fail(nil, "config", "retriesVolumeState, attachRetries, timeoutAttach, timeoutDetach, timeoutAttaching, mountDirRetries and mountDirRetryDelay can't be negative")
+	}
+	if config.DeviceIDLength < 8 || config.DeviceIDLength > 36 {
+		startup.fail(nil, "config", "deviceIDLength must be between 8 and 36")
+	}
+	devicePollInterval = time.Duration(config.PollDeviceWait) * time.Millisecond
+	scsiRescanDelay = time.Duration(config.ScsiRescanDelay) * time.Second
+
+	if err = config.checkMachineIDSources(); err != nil {
+		startup.fail(nil, "config", "%s", err)
+	}
+
+	if config.PolicyHook != "" && config.PolicyTimeout <= 0 {
+		startup.fail(nil, "config", "policyHook requires a positive policyTimeout")
+	}
+
+	if err = config.checkTypeProfiles(); err != nil {
+		startup.fail(nil, "config", "%s", err)
 	}
 
 	if config.Quiet {
@@ -97,7 +462,8 @@ func main() {
 	log.Debug("Debug logging enabled")
 
 	if len(config.IdentityEndpoint) == 0 {
-		log.Fatal("Identity endpoint missing")
+		startup.fail(nil, "credentials", "Identity endpoint missing")
+		startup.stop()
 	}
 
 	opts := gophercloud.AuthOptions{
@@ -117,9 +483,24 @@ func main() {
 	logger := log.WithField("endpoint", opts.IdentityEndpoint)
 	logger.Info("Connecting...")
 
-	provider, err := openstack.AuthenticatedClient(opts)
+	provider, err := openstack.NewClient(opts.IdentityEndpoint)
 	if err != nil {
-		logger.WithError(err).Fatal(err.Error())
+		startup.fail(logger.WithError(err), "credentials", "%s", err)
+		startup.stop()
+	}
+
+	// a hung endpoint fails the call instead of blocking the volume forever
+	if config.TimeoutAPI > 0 {
+		provider.HTTPClient.Timeout = time.Duration(config.TimeoutAPI) * time.Second
+	}
+
+	if config.BreakerThreshold > 0 {
+		provider.HTTPClient.Transport = newCircuitBreaker(provider.HTTPClient.Transport, config.BreakerThreshold, time.Duration(config.BreakerCooldown)*time.Second)
+	}
+
+	if err = openstack.Authenticate(provider, opts); err != nil {
+		startup.fail(logger.WithError(err), "credentials", "%s", err)
+		startup.stop()
 	}
 
 	endpointOpts := gophercloud.EndpointOpts{
@@ -129,25 +510,85 @@ func main() {
 	plugin, err := newPlugin(provider, endpointOpts, &config)
 
 	if err != nil {
-		logger.WithError(err).Fatal(err.Error())
+		// i.e. machine ID not found
+		startup.fail(logger.WithError(err), "plugin", "%s", err)
+		startup.stop()
+	}
+
+	if err = removeDerivedKeyFiles(); err != nil {
+		logger.WithError(err).Warn("Error removing derived key files")
 	}
 
+	plugin.cryptsetup, err = detectCryptsetup()
+	if err != nil {
+		// doctor reports it with its cryptsetup check
+		if (len(config.EncryptionKey) > 0 || len(config.EncryptionKeys) > 0 || config.DefaultEncryption) && !startup.doctor {
+			logger.WithError(err).Fatal("Encryption is configured, but cryptsetup is not usable")
+		}
+		logger.WithError(err).Warn("cryptsetup is not usable, encrypted volumes won't work")
+	} else {
+		logger.WithFields(log.Fields{
+			"path":      plugin.cryptsetup.Path,
+			"luks2":     plugin.cryptsetup.LUKS2,
+			"integrity": plugin.cryptsetup.Integrity,
+			"reencrypt": plugin.cryptsetup.Reencrypt,
+		}).Infof("Found cryptsetup %s", plugin.cryptsetup.Version)
+		if err = plugin.cryptsetup.check(&config); err != nil {
+			startup.fail(logger.WithError(err), "cryptsetup", "%s", err)
+		}
+	}
+
+	if config.FIPS {
+		if err = checkFIPS(plugin.cryptsetup); err != nil {
+			startup.fail(logger.WithError(err), "fips", "%s", err)
+		}
+		fipsMode = true
+		logger.Info("FIPS mode")
+	}
+
+	if flag.NArg() > 0 {
+		plugin.startupChecks = startup.checks
+		if err = runCommand(plugin, flag.Args()); err != nil {
+			log.Fatal(err.Error())
+		}
+		return
+	}
+
+	if config.StateFile != "" {
+		if plugin.state, err = openStateStore(config.StateFile); err != nil {
+			logger.WithError(err).Fatalf("Error opening state file %s", config.StateFile)
+		}
+		if err = plugin.loadState(); err != nil {
+			logger.WithError(err).Fatalf("Error loading state file %s", config.StateFile)
+		}
+	}
+	if err = plugin.creating.load(plugin.state); err != nil {
+		logger.WithError(err).Fatalf("Error loading state file %s", config.StateFile)
+	}
+
+	if err = plugin.adoptMounts(); err != nil {
+		logger.WithError(err).Error("Error checking volumes mounted before startup")
+	}
+	// background work: started once the local state is loaded, not for commands
+	go plugin.purgeTrash()
+	go plugin.autoExtendVolumes()
+	go plugin.watchCapacity()
+	go plugin.collectMappings()
+
 	handler := volume.NewHandler(plugin)
+	handler.HandleFunc("/health", plugin.serveHealth)
+	handler.HandleFunc("/metrics", plugin.serveMetrics)
+	go plugin.probeEndpoints()
 
 	logger.Info("Connected.")
 
-	listeners, err := activation.Listeners()
-
+	listener, err := listen(&config)
 	if err != nil {
-		logger.WithError(err).Error(err.Error())
+		logger.WithError(err).Fatal(err.Error())
 	}
+	go plugin.handoffOnSignal(listener)
 
-	if len(listeners) > 0 {
-		logger.Debugf("Started with socket activation")
-		err = handler.Serve(listeners[0])
-	} else {
-		err = handler.ServeUnix("cinder", 0)
-	}
+	err = listener.serve(handler.Serve)
 
 	if err != nil {
 		logger.WithError(err).Fatal(err.Error())
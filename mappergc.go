@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/pagination"
+	log "github.com/sirupsen/logrus"
+)
+
+// Close the LUKS mappings of the plugin (/dev/mapper/*_luks) no volume accounts for, at startup and then every
+// mapperCleanupInterval seconds: left by a crash, a failed unmount, or a device that disappeared under them,
+// they would make the next luksOpen of the volume fail on the name already taken.
+func (d plugin) collectMappings() {
+	d.closeDanglingMappings()
+	if d.config.MapperCleanupInterval <= 0 {
+		return
+	}
+	for {
+		time.Sleep(time.Duration(d.config.MapperCleanupInterval) * time.Second)
+		d.closeDanglingMappings()
+	}
+}
+
+// Close the dangling mappings that no volume in use on this host, nor any operation in progress, accounts for.
+// Mappings held open (i.e. mounted outside the plugin) are left alone: cryptsetup refuses to close them.
+func (d plugin) closeDanglingMappings() {
+	logger := log.WithFields(log.Fields{"action": "closeDanglingMappings"})
+
+	// listed first: a mapping opened since by an operation isn't considered
+	names, err := filepath.Glob(hostFile("/dev/mapper/*_luks"))
+	if err != nil || len(names) == 0 {
+		return
+	}
+
+	// operations record their volume before releasing it
+	used := make(map[string]bool)
+	for _, name := range d.ops.busy() {
+		used[luksMapperName(name)] = true
+	}
+	d.mutex.Lock()
+	for name := range d.mounts {
+		used[luksMapperName(name)] = true
+	}
+	d.mutex.Unlock()
+	states, err := d.state.all()
+	if err != nil {
+		logger.WithError(err).Error("Error reading volume states")
+		return
+	}
+	for name, state := range states {
+		used[luksMapperName(name)] = true
+		if state.LuksName != "" {
+			used[state.LuksName] = true
+		}
+	}
+
+	for _, name := range names {
+		luksName := filepath.Base(name)
+		if used[luksName] {
+			continue
+		}
+		d.closeDanglingMapping(logger.WithField("luksName", luksName), luksName)
+	}
+}
+
+// Close a mapping no volume in use accounts for, when it is certainly dangling: its backing device is gone,
+// or its volume is not attached to this host anymore. Anything else (i.e. another plugin instance, an admin
+// command, or an attach in progress) may still need it.
+func (d plugin) closeDanglingMapping(logger *log.Entry, luksName string) {
+	// unknown for a shortened name of a deleted volume: then only a gone device tells
+	name := d.mappingVolume(luksName)
+	if name != "" {
+		release, err := d.ops.acquire(name)
+		if err != nil {
+			return
+		}
+		defer release()
+
+		// mounted while waiting for the volume's turn
+		d.mutex.Lock()
+		mounted := len(d.mounts[name]) > 0
+		d.mutex.Unlock()
+		if state, _ := d.state.get(name); mounted || state != nil {
+			return
+		}
+	}
+
+	reason := ""
+	if baseDevice, err := getLuksBaseDevice(luksName); err != nil {
+		logger.WithError(err).Debug("Error reading mapping status")
+		return
+	} else if baseDevice == "" {
+		reason = "backing device gone"
+	} else if _, err := os.Stat(hostFile(baseDevice)); err != nil {
+		reason = "backing device gone"
+	} else if name == "" {
+		logger.Debug("Volume of mapping unknown, left open")
+		return
+	} else if vol, err := d.getByName(context.Background(), name); err != nil {
+		logger.WithError(err).Debug("Volume of mapping not found, left open")
+		return
+	} else if vol.Status != "available" && vol.Status != "in-use" {
+		// attach or detach in progress
+		return
+	} else {
+		for _, att := range vol.Attachments {
+			if d.isAttachedHere(att) {
+				return
+			}
+		}
+		reason = "volume not attached to this host"
+	}
+
+	out, err := hostCommand("cryptsetup", "close", luksName).CombinedOutput()
+	if err != nil {
+		if strings.Contains(string(out), "in use") {
+			logger.Debug("Dangling mapping still in use, left open")
+			return
+		}
+		logger.WithError(err).Errorf("Error closing dangling mapping - %s", out)
+		return
+	}
+	logger.WithField("reason", reason).Warn("Closed dangling LUKS mapping")
+}
+
+// Name of the volume a LUKS mapping was opened for: the one whose state records it, or whose mapping name
+// it is. Shortened names don't tell, and take a lookup of the plugin's volumes. Empty when none matches.
+func (d plugin) mappingVolume(luksName string) string {
+	if states, err := d.state.all(); err == nil {
+		for name, state := range states {
+			if state.LuksName == luksName {
+				return name
+			}
+		}
+	}
+	if name := strings.TrimSuffix(luksName, "_luks"); len(name) < maxMapperNameLength-len("_luks") {
+		return name
+	}
+
+	found := ""
+	pager := volumes.List(d.block(context.Background()), volumes.ListOpts{})
+	err := pager.EachPage(func(page pagination.Page) (bool, error) {
+		vList, err := volumes.ExtractVolumes(page)
+		if err != nil {
+			return false, err
+		}
+		for i := range vList {
+			if !d.isPluginVolume(&vList[i]) {
+				continue
+			}
+			if name, _ := d.dockerName(&vList[i]); luksMapperName(name) == luksName {
+				found = name
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		log.WithError(err).WithField("luksName", luksName).Debug("Error listing volumes")
+	}
+	return found
+}
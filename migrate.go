@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	log "github.com/sirupsen/logrus"
+)
+
+// Interval between two migration progress checks
+const migrationPollInterval = 5 * time.Second
+
+// Admin-only volume attributes describing a migration
+type migrationState struct {
+	Status          string `json:"status"`
+	MigrationStatus string `json:"migration_status"`
+	Host            string `json:"os-vol-host-attr:host"`
+}
+
+func (d plugin) getMigrationState(ctx context.Context, id string) (*migrationState, error) {
+	var result struct {
+		Volume migrationState `json:"volume"`
+	}
+	if err := volumes.Get(d.block(ctx), id).ExtractInto(&result); err != nil {
+		return nil, err
+	}
+	return &result.Volume, nil
+}
+
+// Move a volume to another Cinder backend (host@backend#pool), and report progress until it ends,
+// ctx is done, or timeoutMigration. The volume is locked by Cinder during the migration.
+func (d plugin) migrateVolume(ctx context.Context, logger *log.Entry, vol *volumes.Volume, host string, forceHostCopy bool) error {
+	err := volumeAction(d.block(ctx), vol.ID, map[string]interface{}{
+		"os-migrate_volume": map[string]interface{}{
+			"host":            host,
+			"force_host_copy": forceHostCopy,
+			"lock_volume":     true,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx = nonNilContext(ctx)
+	if d.config.TimeoutMigration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(d.config.TimeoutMigration)*time.Second)
+		defer cancel()
+	}
+
+	start := time.Now()
+	last := ""
+	for {
+		select {
+		case <-ctx.Done():
+			// Cinder goes on with it
+			return fmt.Errorf("Gave up waiting for the migration of volume %s to %s after %s (%s), check 'openstack volume show %s'",
+				vol.ID, host, time.Since(start).Round(time.Second), ctx.Err(), vol.ID)
+		case <-time.After(migrationPollInterval):
+		}
+
+		state, err := d.getMigrationState(ctx, vol.ID)
+		if err != nil {
+			return err
+		}
+
+		progress := fmt.Sprintf("%s (volume %s, on %s)", state.MigrationStatus, state.Status, state.Host)
+		if progress != last {
+			logger.Infof("Migration %s after %s", progress, time.Since(start).Round(time.Second))
+			last = progress
+		}
+
+		switch state.MigrationStatus {
+		case "success":
+			return nil
+		case "error":
+			return fmt.Errorf("Migration of volume %s to %s failed, it stays on %s", vol.ID, host, state.Host)
+		case "", "none":
+			// some drivers clear the status when done
+			if state.Status == "available" && state.Host == host {
+				return nil
+			}
+		}
+	}
+}
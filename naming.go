@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+)
+
+// Stands for the Docker name when rendering the template to find how to reverse it
+const dockerNameMarker = "\x00"
+
+// Maps Docker volume names to Cinder names with nameTemplate, i.e. {{.Cluster}}-{{.DockerName}},
+// rendered with nameVars and DockerName, and back
+type volumeNamer struct {
+	tmpl *template.Template
+	vars map[string]string
+	// rendered template around the Docker name
+	prefix string
+	suffix string
+}
+
+// nil without template: Cinder names are Docker names
+func newVolumeNamer(text string, vars map[string]string) (*volumeNamer, error) {
+	if text == "" {
+		return nil, nil
+	}
+
+	tmpl, err := template.New("nameTemplate").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid nameTemplate: %w", err)
+	}
+	n := &volumeNamer{tmpl: tmpl, vars: vars}
+
+	rendered, err := n.render(dockerNameMarker)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid nameTemplate: %w", err)
+	}
+	parts := strings.Split(rendered, dockerNameMarker)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("nameTemplate must use {{.DockerName}} once")
+	}
+	n.prefix, n.suffix = parts[0], parts[1]
+
+	return n, nil
+}
+
+func (n *volumeNamer) render(dockerName string) (string, error) {
+	data := map[string]string{"DockerName": dockerName}
+	for k, v := range n.vars {
+		data[k] = v
+	}
+
+	var out bytes.Buffer
+	if err := n.tmpl.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// Cinder name of a Docker volume
+func (d plugin) cinderName(name string) string {
+	if d.namer != nil {
+		// template checked at startup
+		name, _ = d.namer.render(name)
+	}
+	return shortenName(name, maxCinderNameLength)
+}
+
+// Docker name of a Cinder volume: recorded at creation (unless renamed since), or reversed from its Cinder name.
+// Without nameTemplate, volumes not created by the plugin are named after their Cinder name;
+// with it, they must match it.
+func (d plugin) dockerName(vol *volumes.Volume) (string, bool) {
+	if name, ok := vol.Metadata[metaName]; ok && d.cinderName(name) == vol.Name {
+		return name, true
+	}
+	if d.namer == nil {
+		return vol.Name, true
+	}
+	if len(vol.Name) > len(d.namer.prefix)+len(d.namer.suffix) &&
+		strings.HasPrefix(vol.Name, d.namer.prefix) && strings.HasSuffix(vol.Name, d.namer.suffix) {
+		return vol.Name[len(d.namer.prefix) : len(vol.Name)-len(d.namer.suffix)], true
+	}
+	return "", false
+}
+
+// Docker name of a volume if known, its Cinder name otherwise
+func (d plugin) volumeName(vol *volumes.Volume) string {
+	if name, ok := d.dockerName(vol); ok {
+		return name
+	}
+	return vol.Name
+}
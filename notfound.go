@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Volumes recently looked up and not found, so that Docker probing missing volumes
+// (i.e. Get before Create, for each container referencing them) doesn't hit Cinder each time
+type notFoundCache struct {
+	ttl   time.Duration
+	mutex sync.Mutex
+	// Cinder name -> expiry
+	names map[string]time.Time
+}
+
+// nil when ttl is 0: nothing cached
+func newNotFoundCache(ttl time.Duration) *notFoundCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &notFoundCache{ttl: ttl, names: make(map[string]time.Time)}
+}
+
+func (c *notFoundCache) has(name string) bool {
+	if c == nil {
+		return false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	expiry, ok := c.names[name]
+	if ok && time.Now().After(expiry) {
+		delete(c.names, name)
+		return false
+	}
+	return ok
+}
+
+func (c *notFoundCache) add(name string) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	// forget expired names now and then
+	if len(c.names) > 1000 {
+		for n, expiry := range c.names {
+			if now.After(expiry) {
+				delete(c.names, n)
+			}
+		}
+	}
+	c.names[name] = now.Add(c.ttl)
+}
+
+func (c *notFoundCache) forget(name string) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.names, name)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	nvmeHostNQNFile  = "/etc/nvme/hostnqn"
+	nvmeSubsystemDir = "/sys/class/nvme-subsystem"
+)
+
+// Attach volumes exported over NVMe-oF, with nvme-cli
+type nvmeofConnector struct{}
+
+// NVMe-oF subsystem of a volume, from Cinder's connection data
+type nvmeofTarget struct {
+	NQN string
+	// address, port, transport
+	Portals [][3]string
+	// namespace of the volume in the subsystem, when given
+	NGUID string
+	UUID  string
+}
+
+func (nvmeofConnector) volumeType() string {
+	return "nvmeof"
+}
+
+func (nvmeofConnector) properties(hostname string) (map[string]interface{}, error) {
+	out, err := os.ReadFile(nvmeHostNQNFile)
+	if err != nil {
+		return nil, err
+	}
+
+	properties := baseProperties(hostname)
+	properties["nqn"] = strings.TrimSpace(string(out))
+	return properties, nil
+}
+
+func (nvmeofConnector) connect(ctx context.Context, data map[string]interface{}, timeout int) (string, error) {
+	target, err := newNvmeofTarget(data)
+	if err != nil {
+		return "", err
+	}
+
+	for _, portal := range target.Portals {
+		out, err := hostCommand("nvme", "connect", "-t", portal[2], "-a", portal[0], "-s", portal[1], "-n", target.NQN).CombinedOutput()
+		if err != nil && !strings.Contains(string(out), "already connected") {
+			return "", fmt.Errorf("nvme connect to %s failed - %s", portal[0], out)
+		}
+	}
+
+	dev, err := waitFor(ctx, []string{"/dev"}, target.findNamespace, timeout)
+	if err == nil && dev == "" {
+		err = fmt.Errorf("No namespace found for %s", target.NQN)
+	}
+	return dev, err
+}
+
+func (nvmeofConnector) disconnect(data map[string]interface{}) error {
+	target, err := newNvmeofTarget(data)
+	if err != nil {
+		return err
+	}
+
+	// subsystem shared with other volumes
+	if subsys := target.subsystem(); subsys != "" && len(namespaces(subsys)) > 1 {
+		return nil
+	}
+
+	out, err := hostCommand("nvme", "disconnect", "-n", target.NQN).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("nvme disconnect failed - %s", out)
+	}
+	return nil
+}
+
+// Connection data has portals since Cinder Wallaby, a single target_portal before
+func newNvmeofTarget(data map[string]interface{}) (*nvmeofTarget, error) {
+	target := &nvmeofTarget{}
+	target.NQN, _ = data["target_nqn"].(string)
+	target.NGUID, _ = data["volume_nguid"].(string)
+	target.UUID, _ = data["vol_uuid"].(string)
+
+	if portals, ok := data["portals"].([]interface{}); ok {
+		for _, p := range portals {
+			if fields, ok := p.([]interface{}); ok && len(fields) == 3 {
+				target.Portals = append(target.Portals, [3]string{
+					fmt.Sprint(fields[0]), fmt.Sprint(fields[1]), nvmeTransport(fmt.Sprint(fields[2])),
+				})
+			}
+		}
+	} else if portal, ok := data["target_portal"].(string); ok {
+		transport, _ := data["transport_type"].(string)
+		target.Portals = append(target.Portals, [3]string{portal, fmt.Sprint(data["target_port"]), nvmeTransport(transport)})
+	}
+
+	if target.NQN == "" || len(target.Portals) == 0 {
+		return nil, errors.New("Incomplete NVMe-oF connection data")
+	}
+	return target, nil
+}
+
+// nvme-cli transport name for Cinder's
+func nvmeTransport(transport string) string {
+	switch strings.ToLower(transport) {
+	case "rdma", "roce", "rocev2":
+		return "rdma"
+	}
+	return "tcp"
+}
+
+// sysfs directory of the connected subsystem, "" when not connected
+func (t *nvmeofTarget) subsystem() string {
+	dirs, _ := filepath.Glob(filepath.Join(nvmeSubsystemDir, "*"))
+	for _, dir := range dirs {
+		nqn, err := os.ReadFile(filepath.Join(dir, "subsysnqn"))
+		if err == nil && strings.TrimSpace(string(nqn)) == t.NQN {
+			return dir
+		}
+	}
+	return ""
+}
+
+// Namespace devices of a subsystem, i.e. nvme1n1
+func namespaces(subsys string) []string {
+	paths, _ := filepath.Glob(filepath.Join(subsys, "nvme*n*"))
+	var names []string
+	for _, path := range paths {
+		names = append(names, filepath.Base(path))
+	}
+	return names
+}
+
+// Device of the volume namespace: the one with its NGUID or UUID,
+// or the only one of the subsystem
+func (t *nvmeofTarget) findNamespace() (string, error) {
+	subsys := t.subsystem()
+	if subsys == "" {
+		return "", nil
+	}
+
+	names := namespaces(subsys)
+	for _, name := range names {
+		for attr, want := range map[string]string{"nguid": t.NGUID, "uuid": t.UUID} {
+			if want == "" {
+				continue
+			}
+			got, err := os.ReadFile(filepath.Join("/sys/block", name, attr))
+			if err == nil && normalizeID(string(got)) == normalizeID(want) {
+				return filepath.Join("/dev", name), nil
+			}
+		}
+	}
+
+	if t.NGUID == "" && t.UUID == "" && len(names) == 1 {
+		return filepath.Join("/dev", names[0]), nil
+	}
+	return "", nil
+}
+
+func normalizeID(id string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(id), "-", ""))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Queue of volume operations: one at a time per volume, at most maxRunning at once,
+// and at most maxQueued waiting or running, beyond which new work is rejected
+// (i.e. all containers starting at host boot). Cleanups (unmount, remove) are never
+// rejected for load: Docker doesn't retry them, and what they release would leak.
+type opQueue struct {
+	running   chan struct{}
+	maxQueued int
+
+	mutex   sync.Mutex
+	queued  int
+	volumes map[string]*volumeLock
+	// new operations rejected, i.e. while handing over to a new binary
+	closed bool
+}
+
+// Lock of a volume, deleted once no operation uses it
+type volumeLock struct {
+	lock  chan struct{}
+	users int
+}
+
+func newOpQueue(maxRunning int, maxQueued int) *opQueue {
+	if maxRunning <= 0 {
+		maxRunning = 1
+	}
+	return &opQueue{
+		running:   make(chan struct{}, maxRunning),
+		maxQueued: maxQueued,
+		volumes:   make(map[string]*volumeLock),
+	}
+}
+
+// Wait for the turn of an operation on a volume, and return the function ending it
+func (q *opQueue) acquire(name string) (func(), error) {
+	return q.enter(name, true)
+}
+
+// Same as acquire, for operations releasing a volume: not rejected when too many are queued
+func (q *opQueue) acquireCleanup(name string) (func(), error) {
+	return q.enter(name, false)
+}
+
+func (q *opQueue) enter(name string, shed bool) (func(), error) {
+	q.mutex.Lock()
+	if q.closed {
+		q.mutex.Unlock()
+		return nil, fmt.Errorf("Plugin restarting, retry later")
+	}
+	if shed && q.maxQueued > 0 && q.queued >= q.maxQueued {
+		q.mutex.Unlock()
+		return nil, fmt.Errorf("Too many volume operations in progress (%d), retry later", q.queued)
+	}
+	q.queued++
+	vl, ok := q.volumes[name]
+	if !ok {
+		vl = &volumeLock{lock: make(chan struct{}, 1)}
+		q.volumes[name] = vl
+	}
+	vl.users++
+	q.mutex.Unlock()
+
+	// volume first: operations waiting for a busy volume don't hold a running slot
+	vl.lock <- struct{}{}
+	q.running <- struct{}{}
+
+	return func() {
+		<-q.running
+		<-vl.lock
+
+		q.mutex.Lock()
+		q.queued--
+		if vl.users--; vl.users == 0 {
+			delete(q.volumes, name)
+		}
+		q.mutex.Unlock()
+	}, nil
+}
+
+// Volumes with operations waiting or running
+func (q *opQueue) busy() []string {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	names := make([]string, 0, len(q.volumes))
+	for name := range q.volumes {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Reject new operations, or accept them again
+func (q *opQueue) setClosed(closed bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.closed = closed
+}
+
+// Operations waiting or running
+func (q *opQueue) pending() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.queued
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+)
+
+// Per-volume options given at creation, stored in Cinder metadata,
+// so they apply wherever and whenever the volume is mounted.
+// Unset options default to config.
+type volumeOptions struct {
+	Filesystem   string
+	MountOptions []string
+	SubDir       string
+	UID          int
+	GID          int
+	Encrypted    bool
+}
+
+// Validate filesystem, mountopts, subdir, mountpoint, uid and gid create options,
+// and store them in metadata
+func (d plugin) storeVolumeOptions(options map[string]string, metadata map[string]string) error {
+	if fs, ok := options["filesystem"]; ok {
+		if err := checkFilesystemTools(fs, d.config.AutoGrow); err != nil {
+			return err
+		}
+		metadata[metaFilesystem] = fs
+	}
+
+	if mo, ok := options["mountopts"]; ok {
+		metadata[metaMountOptions] = mo
+	}
+
+	if sub, ok := options["subdir"]; ok {
+		if filepath.IsAbs(sub) || strings.HasPrefix(filepath.Clean(sub), "..") {
+			return fmt.Errorf("Invalid subdir option %s: must be relative, inside the volume", sub)
+		}
+		metadata[metaSubDir] = filepath.Clean(sub)
+	}
+
+	if mountpoint, ok := options["mountpoint"]; ok {
+		if err := d.config.checkMountpoint(mountpoint); err != nil {
+			return err
+		}
+		metadata[metaMountpoint] = filepath.Clean(mountpoint)
+	}
+
+	for option, key := range map[string]string{"uid": metaUID, "gid": metaGID} {
+		if id, ok := options[option]; ok {
+			if _, err := strconv.Atoi(id); err != nil {
+				return fmt.Errorf("Invalid %s option: %w", option, err)
+			}
+			metadata[key] = id
+		}
+	}
+
+	return nil
+}
+
+// A mountpoint option must be inside one of mountpointRoots
+func (c *tConfig) checkMountpoint(mountpoint string) error {
+	if len(c.MountpointRoots) == 0 {
+		return fmt.Errorf("mountpoint option not allowed, mountpointRoots is not set in config")
+	}
+	if !filepath.IsAbs(mountpoint) {
+		return fmt.Errorf("Invalid mountpoint option %s: must be an absolute path", mountpoint)
+	}
+
+	mountpoint = filepath.Clean(mountpoint)
+	for _, root := range c.MountpointRoots {
+		if strings.HasPrefix(mountpoint, filepath.Clean(root)+string(filepath.Separator)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Invalid mountpoint option %s: must be inside %s", mountpoint, strings.Join(c.MountpointRoots, ", "))
+}
+
+// Options of a volume, from its metadata or config
+func (d plugin) volumeOptions(vol *volumes.Volume) volumeOptions {
+	opts := volumeOptions{
+		Filesystem: d.config.Filesystem,
+		SubDir:     d.config.VolumeSubDir,
+		Encrypted:  metadataBool(vol, metaEncryption, false),
+	}
+
+	if fs, ok := vol.Metadata[metaFilesystem]; ok {
+		opts.Filesystem = fs
+	}
+	if mo := vol.Metadata[metaMountOptions]; mo != "" {
+		opts.MountOptions = strings.Split(mo, ",")
+	}
+	if sub, ok := vol.Metadata[metaSubDir]; ok {
+		opts.SubDir = sub
+	}
+	opts.UID, _ = strconv.Atoi(vol.Metadata[metaUID])
+	opts.GID, _ = strconv.Atoi(vol.Metadata[metaGID])
+
+	return opts
+}
+
+// Create options a volume type profile may set
+var profileOptions = map[string]bool{
+	"size":                 true,
+	"filesystem":           true,
+	"mountopts":            true,
+	"subdir":               true,
+	"uid":                  true,
+	"gid":                  true,
+	"encryption":           true,
+	"luksType":             true,
+	"fastFormat":           true,
+	"noAutoFormat":         true,
+	"snapshotBeforeDelete": true,
+	"raw":                  true,
+	"protected":            true,
+	"discard":              true,
+	"ephemeralKey":         true,
+	"autoExtend":           true,
+	"autoExtendMaxSize":    true,
+}
+
+// Check typeProfiles only set options they may
+func (c *tConfig) checkTypeProfiles() error {
+	for volumeType, profile := range c.TypeProfiles {
+		for option := range profile {
+			if !profileOptions[option] {
+				return fmt.Errorf("Invalid option %s in %s type profile", option, volumeType)
+			}
+		}
+	}
+	return nil
+}
+
+// Create options with the defaults of the volume type (typeProfiles), overridden by the given ones
+// Volumes from a snapshot or backup keep their source's settings.
+func (c *tConfig) withTypeProfile(options map[string]string) map[string]string {
+	_, fromSnapshot := options["from-snapshot-ro"]
+	_, fromBackup := options["backupRestore"]
+	if fromSnapshot || fromBackup {
+		return options
+	}
+
+	volumeType := c.DefaultType
+	if t, ok := options["type"]; ok {
+		volumeType = t
+	}
+
+	merged := make(map[string]string)
+	for option, value := range c.TypeProfiles[volumeType] {
+		merged[option] = value
+	}
+	for option, value := range options {
+		merged[option] = value
+	}
+	return merged
+}
+
+// Check a volume type requested by a user is in allowedTypes
+func (c *tConfig) checkAllowedType(volumeType string) error {
+	if len(c.AllowedTypes) == 0 {
+		return nil
+	}
+	for _, allowed := range c.AllowedTypes {
+		if volumeType == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("Volume type %s is not allowed, use one of: %s", volumeType, strings.Join(c.AllowedTypes, ", "))
+}
+
+// Check a user did not set create options locked by lockedOptions
+// (type profiles still may)
+func (c *tConfig) checkLockedOptions(options map[string]string) error {
+	for _, locked := range c.LockedOptions {
+		if _, ok := options[locked]; ok {
+			return fmt.Errorf("Option %s is locked by the plugin configuration", locked)
+		}
+	}
+	return nil
+}
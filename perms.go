@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// What to do about secret files other users can read (insecureFiles config)
+const (
+	insecureFilesFail = "fail"
+	insecureFilesWarn = "warn"
+)
+
+// Check a file holding secrets can only be read by its owner, root or the plugin's user
+func checkSecretFile(path string) error {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if mode := stat.Mode().Perm(); mode&0077 != 0 {
+		return fmt.Errorf("%s is accessible to other users (mode %04o), chmod 600 it", path, mode)
+	}
+	if sys, ok := stat.Sys().(*syscall.Stat_t); ok && sys.Uid != 0 && int(sys.Uid) != os.Geteuid() {
+		return fmt.Errorf("%s is owned by user %d, not root or the plugin's user", path, sys.Uid)
+	}
+	return nil
+}
+
+// Check the permissions of the config files (credentials) and key files (LUKS keys).
+// Key secrets (secretsDir) belong to the orchestrator delivering them, and are not checked.
+func (c *tConfig) checkSecretFiles(configFiles []string) error {
+	files := append([]string{}, configFiles...)
+	if c.EncryptionKey != "" {
+		files = append(files, c.EncryptionKey)
+	}
+	keyIDs := make([]string, 0, len(c.EncryptionKeys))
+	for id := range c.EncryptionKeys {
+		keyIDs = append(keyIDs, id)
+	}
+	sort.Strings(keyIDs)
+	for _, id := range keyIDs {
+		files = append(files, c.EncryptionKeys[id])
+	}
+
+	for _, file := range files {
+		err := checkSecretFile(file)
+		if err == nil || os.IsNotExist(err) {
+			continue
+		}
+		if c.InsecureFiles != insecureFilesWarn {
+			return fmt.Errorf("Insecure secret file: %w (insecureFiles: warn to start anyway)", err)
+		}
+		log.WithError(err).Warn("INSECURE SECRET FILE: credentials or keys may be read by other users")
+	}
+	return nil
+}
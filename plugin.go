@@ -5,7 +5,6 @@ import (
 	"errors"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"strconv"
@@ -18,17 +17,92 @@ import (
 	"github.com/docker/go-plugins-helpers/volume"
 	"github.com/gophercloud/gophercloud"
 	"github.com/gophercloud/gophercloud/openstack"
-	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/snapshots"
 	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/extensions/backups"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/extensions/schedulerhints"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/extensions/volumeactions"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/volumeattach"
 	"github.com/gophercloud/gophercloud/pagination"
 )
 
+// Cinder metadata keys set by the plugin
+const (
+	metaSnapshotBeforeDelete = "docker-plugin-cinder.snapshotBeforeDelete"
+	metaExpiresAt            = "docker-plugin-cinder.expiresAt"
+	metaDeletedName          = "docker-plugin-cinder.deletedName"
+	metaNoAutoFormat         = "docker-plugin-cinder.noAutoFormat"
+	metaRaw                  = "docker-plugin-cinder.raw"
+	metaFastFormat           = "docker-plugin-cinder.fastFormat"
+	metaAffinityGroup        = "docker-plugin-cinder.affinityGroup"
+	metaManaged              = "docker-plugin-cinder.managed"
+	metaFilesystem           = "docker-plugin-cinder.filesystem"
+	metaMountOptions         = "docker-plugin-cinder.mountopts"
+	metaSubDir               = "docker-plugin-cinder.subdir"
+	metaMountpoint           = "docker-plugin-cinder.mountpoint"
+	metaUID                  = "docker-plugin-cinder.uid"
+	metaGID                  = "docker-plugin-cinder.gid"
+	metaEncryption           = "docker-plugin-cinder.encryption"
+	metaEncryptionPending    = "docker-plugin-cinder.encryptionPending"
+	metaKeySecret            = "docker-plugin-cinder.keySecret"
+	metaKeyID                = "docker-plugin-cinder.keyID"
+	metaReadOnly             = "docker-plugin-cinder.readOnly"
+	metaName                 = "docker-plugin-cinder.name"
+	metaProtected            = "docker-plugin-cinder.protected"
+	metaAutoExtend           = "docker-plugin-cinder.autoExtend"
+	metaAutoExtendMaxSize    = "docker-plugin-cinder.autoExtendMaxSize"
+	metaLuksUUID             = "docker-plugin-cinder.luksUUID"
+	metaKeyDerivation        = "docker-plugin-cinder.keyDerivation"
+	metaKeyDerivationID      = "docker-plugin-cinder.keyDerivationID"
+	metaDiscard              = "docker-plugin-cinder.discard"
+	metaEphemeralKey         = "docker-plugin-cinder.ephemeralKey"
+	metaEngineID             = "docker-plugin-cinder.engineID"
+	metaFIPS                 = "docker-plugin-cinder.fips"
+	metaDetachedHeader       = "docker-plugin-cinder.detachedHeader"
+	metaFscrypt              = "docker-plugin-cinder.fscrypt"
+)
+
 type plugin struct {
 	blockClient   *gophercloud.ServiceClient
 	computeClient *gophercloud.ServiceClient
+	// only set when LUKS headers are backed up to Swift
+	objectClient  *gophercloud.ServiceClient
 	config        *tConfig
+	// guards mounts and mountpoints
 	mutex         *sync.Mutex
+	// serializes operations per volume
+	ops           *opQueue
+	// in-flight create and mount operations
+	watchdog      *watchdog
+	// mount IDs (one per container) currently using each volume on this host
+	mounts        map[string]map[string]bool
+	// mountpoints of the volumes in use
+	mountpoints   map[string]string
+	// nil when cryptsetup is not available
+	cryptsetup    *cryptsetupInfo
+	// machineID set in config: never looked up again
+	machineIDForced bool
+	// this machine's server ID, updated when the instance is rebuilt or moved
+	machine       *machineIDHolder
+	// host name for attachments made without Nova
+	hostname      string
+	// Docker engine marking the volumes it creates
+	engineID      string
+	// nil when attaching through Nova
+	local         localConnector
+	provider      *gophercloud.ProviderClient
+	health        *healthStatus
+	// nil when not persisted
+	state         *stateStore
+	// nil without nameTemplate
+	namer         *volumeNamer
+	// nil when not caching
+	notFound      *notFoundCache
+	// volumes created in the background
+	creating      *createTracker
+	serverNames   *serverNameCache
+	// startup failures the doctor command reports
+	startupChecks []doctorCheck
 }
 
 func newPlugin(provider *gophercloud.ProviderClient, endpointOpts gophercloud.EndpointOpts, config *tConfig) (*plugin, error) {
@@ -41,54 +115,85 @@ func newPlugin(provider *gophercloud.ProviderClient, endpointOpts gophercloud.En
 		return nil, err
 	}
 
-	computeClient, err := openstack.NewComputeV2(provider, endpointOpts)
-
+	local, err := newLocalConnector(config.Connector)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(config.MachineID) == 0 {
-		// Find machine ID from Openstack servers
-
-		hostname, err := os.Hostname()
+	var computeClient *gophercloud.ServiceClient
+	if config.Standalone {
+		// attachments API, without Nova
+		blockClient.Microversion = attachmentsMicroversion
+	} else {
+		computeClient, err = openstack.NewComputeV2(provider, endpointOpts)
 		if err != nil {
-			panic(err)
-		}
-
-		listOpts := servers.ListOpts{
-			 TenantID: config.TenantID,
-			 Name: hostname,
+			return nil, err
 		}
+	}
 
-		allPages, err := servers.List(computeClient, listOpts).AllPages()
-		if err != nil {
-			panic(err)
+	var objectClient *gophercloud.ServiceClient
+	for _, location := range []string{config.LuksHeaderBackup, config.LuksHeaderStore} {
+		if strings.HasPrefix(location, swiftScheme) {
+			if objectClient == nil {
+				objectClient, err = openstack.NewObjectStorageV1(provider, endpointOpts)
+				if err != nil {
+					return nil, err
+				}
+			}
+		} else if location != "" {
+			if err = os.MkdirAll(location, 0700); err != nil {
+				return nil, err
+			}
 		}
+	}
 
-		allServers, err := servers.ExtractServers(allPages)
-		if err != nil {
-			panic(err)
-		}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
 
-		if len(allServers) != 1 {
-			panic(fmt.Sprintf("Openstack servers list returned more than one server for name %s", hostname))
-		}
+	namer, err := newVolumeNamer(config.NameTemplate, config.NameVars)
+	if err != nil {
+		return nil, err
+	}
 
-		for _, server := range allServers {
-			log.WithField("id", server.ID).Info("servers list")
+	machineIDForced := len(config.MachineID) > 0
+	if local != nil {
+		// not attaching through Nova: no machine ID needed
+		log.WithField("host", hostname).Debugf("Attaching volumes with %s connector", config.Connector)
+	} else if !machineIDForced {
+		if config.MachineID, err = resolveMachineID(computeClient, config); err != nil {
+			return nil, err
 		}
-
-		config.MachineID = allServers[0].ID
+		log.WithField("id", config.MachineID).Info("Found machine ID")
 	} else {
 		log.WithField("id", config.MachineID).Debug("Using configured machine ID")
 	}
 
-	return &plugin{
+	d := &plugin{
 		blockClient:   blockClient,
 		computeClient: computeClient,
+		objectClient:  objectClient,
 		config:        config,
 		mutex:         &sync.Mutex{},
-	}, nil
+		ops:           newOpQueue(config.MaxRunningOps, config.MaxQueuedOps),
+		watchdog:      newWatchdog(),
+		mounts:        make(map[string]map[string]bool),
+		mountpoints:   make(map[string]string),
+		machineIDForced: machineIDForced,
+		machine:       &machineIDHolder{id: config.MachineID},
+		hostname:      hostname,
+		engineID:      resolveEngineID(config, hostname),
+		local:         local,
+		provider:      provider,
+		health:        newHealthStatus(),
+		namer:         namer,
+		notFound:      newNotFoundCache(time.Duration(config.CacheNotFound) * time.Second),
+		creating:      newCreateTracker(),
+		serverNames:   newServerNameCache(),
+	}
+
+	return d, nil
 }
 
 func (d plugin) Capabilities() *volume.CapabilitiesResponse {
@@ -101,21 +206,91 @@ func (d plugin) Capabilities() *volume.CapabilitiesResponse {
 }
 
 func (d plugin) Create(r *volume.CreateRequest) error {
-	logger := log.WithFields(log.Fields{"name": r.Name, "action": "create"})
+	return d.watch("create", r.Name, func(ctx context.Context) error {
+		return d.create(ctx, r)
+	})
+}
+
+func (d plugin) create(ctx context.Context, r *volume.CreateRequest) error {
+	logger := log.WithContext(ctx).WithFields(log.Fields{"name": r.Name, "action": "create"})
 	logger.Infof("Creating volume '%s' ...", r.Name)
 	logger.Debugf("Create: %+v", r)
 
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
+	release, err := d.ops.acquire(r.Name)
+	if err != nil {
+		logger.WithError(err).Error("Volume operation rejected")
+		return err
+	}
+	// released by the background completion instead, when asynchronous
+	background := false
+	defer func() {
+		if !background {
+			release()
+		}
+	}()
+	d.watchdog.step(r.Name, "started")
+
+	if !strings.HasPrefix(r.Name, d.config.ListFilterPrefix) {
+		logger.Errorf("Volume name does not start with '%s'", d.config.ListFilterPrefix)
+		return fmt.Errorf("Volume name must start with '%s'", d.config.ListFilterPrefix)
+	}
+
+	if err = d.config.checkLockedOptions(r.Options); err != nil {
+		logger.WithError(err).Error("Volume options rejected")
+		return err
+	}
+
+	if r.Options, err = d.authorize(logger, "create", r.Name, r.Options, ""); err != nil {
+		return err
+	}
+
+	// options implied by the volume type
+	r.Options = d.config.withTypeProfile(r.Options)
 
 	// DEFAULT SIZE IN GB
 	var size = d.config.DefaultSize
 	// Default volume type
 	var volumeType = d.config.DefaultType
-	// No encryption by default
-	var encryption = false
-	var err error
-	keyfile := d.config.EncryptionKey
+	// No encryption by default, unless defaultEncryption is set
+	var encryption = d.config.DefaultEncryption
+	keyID, keyfile := d.currentKey()
+	metadata := map[string]string{metaManaged: "true", metaName: r.Name, metaEngineID: d.engineID}
+
+	// read-only copy of a snapshot
+	var snapshot *snapshots.Snapshot
+	if ref, ok := r.Options["from-snapshot-ro"]; ok {
+		if snapshot, err = d.getSnapshot(ctx, ref); err != nil {
+			logger.WithError(err).Error("Error looking up snapshot")
+			return err
+		}
+		source, err := volumes.Get(d.block(ctx), snapshot.VolumeID).Extract()
+		if err != nil {
+			logger.WithError(err).Error("Error looking up snapshot volume")
+			return err
+		}
+		for key, value := range inheritedMetadata(source) {
+			metadata[key] = value
+		}
+		metadata[metaReadOnly] = "true"
+		size = strconv.Itoa(snapshot.Size)
+		volumeType = source.VolumeType
+	}
+
+	// backup to restore into the new volume
+	var backup *backups.Backup
+	if ref, ok := r.Options["backupRestore"]; ok {
+		if snapshot != nil {
+			return errors.New("from-snapshot-ro and backupRestore options are exclusive")
+		}
+		if backup, err = d.getBackup(ctx, ref); err != nil {
+			logger.WithError(err).Error("Error looking up backup")
+			return err
+		}
+		if backup.Status != "available" {
+			return fmt.Errorf("Backup %s is %s, not available", ref, backup.Status)
+		}
+		size = strconv.Itoa(backup.Size)
+	}
 
 	if s, ok := r.Options["size"]; ok {
 		size = s
@@ -124,37 +299,250 @@ func (d plugin) Create(r *volume.CreateRequest) error {
 	sizeInt, err := strconv.Atoi(size)
 	if err != nil {
 		logger.WithError(err).Error("Error parsing size option")
-		return fmt.Errorf("Invalid size option: %s", err.Error())
+		return fmt.Errorf("Invalid size option: %w", err)
 	}
 
 	if t, ok := r.Options["type"]; ok {
+		if err = d.config.checkAllowedType(t); err != nil {
+			logger.WithError(err).Error("Volume type rejected")
+			return err
+		}
 		volumeType = t
 	}
 
 	// if "encryption" option is anything else than "false", it means we want the volume encrypted
+	// (with LUKS, unless "fscrypt")
+	fscrypt := false
 	if e, ok := r.Options["encryption"]; ok {
-		if strings.ToLower(e) != "false" {
-			logger.Debug("Encryption set to true")
-			if keyfile == "" {
-				logger.Info("Can't encrypt volume, no encryptionKey in config")
-			} else {
-				encryption = true
+		fscrypt = strings.ToLower(e) == encryptionFscrypt
+		encryption = strings.ToLower(e) != "false"
+	}
+
+	luksType := d.config.LuksType
+	if t, ok := r.Options["luksType"]; ok {
+		if t != "luks1" && t != "luks2" {
+			return fmt.Errorf("Invalid luksType option %s, use luks1 or luks2", t)
+		}
+		if t == "luks2" && d.cryptsetup != nil && !d.cryptsetup.LUKS2 {
+			return errors.New("luksType luks2 is not supported by this cryptsetup")
+		}
+		luksType = t
+	}
+
+	// key delivered as a secret, i.e. /run/secrets/<keySecret>
+	if secret, ok := r.Options["keySecret"]; ok {
+		metadata[metaKeySecret] = secret
+		if keyfile, err = d.keyFileFromMetadata(metadata); err != nil {
+			logger.WithError(err).Error("Invalid keySecret option")
+			return err
+		}
+		encryption = true
+	}
+
+	if snapshot != nil || backup != nil {
+		// already encrypted, or not, like the snapshot or backup
+		encryption = false
+	}
+
+	// scratch volume, encrypted with a new key at each mount instead
+	if e, ok := r.Options["ephemeralKey"]; ok && strings.ToLower(e) == "true" {
+		if snapshot != nil || backup != nil {
+			return errors.New("ephemeralKey volumes can't be created from a snapshot or backup: their data is lost at unmount")
+		}
+		metadata[metaEphemeralKey] = "true"
+		encryption = false
+	}
+
+	// subdirectory encrypted at mount: nothing to format now
+	if fscrypt && encryption {
+		if keyfile == "" {
+			return errors.New("encryption=fscrypt requires an encryptionKey, encryptionKeyID or keySecret")
+		}
+		encryption = false
+	} else {
+		fscrypt = false
+	}
+
+	if encryption {
+		logger.Debug("Encryption set to true")
+		if keyfile == "" {
+			logger.Info("Can't encrypt volume, no encryptionKey in config")
+			encryption = false
+		}
+	}
+
+	if s, ok := r.Options["snapshotBeforeDelete"]; ok {
+		metadata[metaSnapshotBeforeDelete] = strings.ToLower(s)
+	}
+
+	if n, ok := r.Options["noAutoFormat"]; ok {
+		metadata[metaNoAutoFormat] = strings.ToLower(n)
+	}
+
+	if raw, ok := r.Options["raw"]; ok {
+		metadata[metaRaw] = strings.ToLower(raw)
+	}
+
+	if f, ok := r.Options["fastFormat"]; ok {
+		metadata[metaFastFormat] = strings.ToLower(f)
+	}
+
+	if t, ok := r.Options["discard"]; ok {
+		metadata[metaDiscard] = strings.ToLower(t)
+	}
+
+	if p, ok := r.Options["protected"]; ok {
+		metadata[metaProtected] = strings.ToLower(p)
+	}
+
+	if a, ok := r.Options["autoExtend"]; ok {
+		metadata[metaAutoExtend] = strings.ToLower(a)
+	}
+
+	if m, ok := r.Options["autoExtendMaxSize"]; ok {
+		if _, err := strconv.Atoi(m); err != nil {
+			return fmt.Errorf("Invalid autoExtendMaxSize option: %w", err)
+		}
+		metadata[metaAutoExtendMaxSize] = m
+	}
+
+	if err = d.storeVolumeOptions(r.Options, metadata); err != nil {
+		logger.WithError(err).Error("Invalid volume options")
+		return err
+	}
+
+	if fscrypt {
+		if err = d.storeFscryptOptions(metadata); err != nil {
+			logger.WithError(err).Error("Invalid volume options")
+			return err
+		}
+		if _, secret := metadata[metaKeySecret]; !secret && keyID != "" {
+			metadata[metaKeyID] = keyID
+		}
+	}
+
+	if encryption {
+		metadata[metaEncryption] = "true"
+		if _, secret := metadata[metaKeySecret]; !secret {
+			if keyID != "" {
+				metadata[metaKeyID] = keyID
+			}
+			if d.config.DeriveKeys {
+				metadata[metaKeyDerivation] = keyDerivationHKDF
 			}
 		}
 	}
 
-	vol, err := volumes.Create(d.blockClient, volumes.CreateOpts{
+	opts := volumes.CreateOpts{
 		Size: sizeInt,
-		Name: r.Name,
+		Name: d.cinderName(r.Name),
 		VolumeType: volumeType,
-	}).Extract()
+		Metadata: metadata,
+	}
+	if snapshot != nil {
+		opts.SnapshotID = snapshot.ID
+	}
+
+	hints, err := d.schedulerHints(ctx, r.Options)
+	if err != nil {
+		logger.WithError(err).Error("Error parsing scheduler hints")
+		return err
+	}
+
+	if group, ok := r.Options["affinityGroup"]; ok && group != "" {
+		metadata[metaAffinityGroup] = group
+		if hints, err = d.affinityGroupHints(logger, group, &opts, hints); err != nil {
+			logger.WithError(err).Error("Error looking up affinity group")
+			return err
+		}
+	}
+
+	var createOpts volumes.CreateOptsBuilder = opts
+	if hints != nil {
+		logger.Debugf("Scheduler hints: %+v", *hints)
+		createOpts = schedulerhints.CreateOptsExt{
+			VolumeCreateOptsBuilder: createOpts,
+			SchedulerHints:          hints,
+		}
+	}
+
+	d.watchdog.step(r.Name, "creating volume")
+	vol, err := volumes.Create(d.block(ctx), createOpts).Extract()
 
 	if err != nil {
 		logger.WithError(err).Errorf("Error creating volume: %s", err.Error())
 		return err
 	}
+	d.notFound.forget(opts.Name)
+	d.creating.forget(r.Name)
 
 	logger.WithField("id", vol.ID).Debug("Volume created")
+	d.watchdog.identify(r.Name, vol.ID)
+
+	// derived key: recorded for the copies of its snapshots to derive the same one
+	if vol.Metadata[metaKeyDerivation] != "" && vol.Metadata[metaKeyDerivationID] == "" {
+		if updated, err := setVolumeMetadata(ctx, &d, vol, map[string]string{metaKeyDerivationID: vol.ID}); err != nil {
+			logger.WithError(err).Warn("Error recording key derivation ID")
+		} else {
+			vol = updated
+		}
+	}
+
+	// nothing left to do, unless restoring or encrypting
+	if backup == nil && !encryption {
+		return nil
+	}
+
+	// the volume key is derived from its ID, known now
+	if encryption && vol.Metadata[metaKeyDerivation] != "" {
+		if keyfile, err = d.keyFile(vol); err != nil {
+			logger.WithError(err).Error("Error deriving volume key")
+			return err
+		}
+	}
+
+	complete := func(ctx context.Context) error {
+		return d.completeCreate(logger.WithContext(ctx), r.Name, vol, backup, encryption, keyfile, luksType)
+	}
+
+	async := d.config.AsyncCreate
+	if a, ok := r.Options["async"]; ok {
+		async = strings.ToLower(a) == "true"
+	}
+	if async {
+		background = true
+		d.creating.start(r.Name, vol.ID)
+		logger.Info("Volume creation accepted, completing it in the background")
+		go func() {
+			defer release()
+			err := d.track("complete create", r.Name, complete)
+			if err != nil {
+				logger.WithError(err).Error("Error completing volume creation")
+			} else {
+				logger.Info("Volume creation completed")
+			}
+			d.creating.end(r.Name, err)
+		}()
+		return nil
+	}
+
+	return complete(ctx)
+}
+
+// Restore the backup into a created volume, or encrypt it
+func (d plugin) completeCreate(logger *log.Entry, name string, vol *volumes.Volume, backup *backups.Backup, encryption bool, keyfile string, luksType string) error {
+	var err error
+
+	if backup != nil {
+		d.watchdog.step(name, "restoring backup")
+		if err = d.restoreBackup(logger, vol, backup); err != nil {
+			logger.WithError(err).Errorf("Error restoring backup: %s", err.Error())
+			if err := volumes.Delete(d.blockClient, vol.ID, volumes.DeleteOpts{}).ExtractErr(); err != nil {
+				logger.WithError(err).Error("Error deleting volume")
+			}
+			return err
+		}
+	}
 
 
 	// attach & encrypt
@@ -162,21 +550,69 @@ func (d plugin) Create(r *volume.CreateRequest) error {
 	logger.Debugf("Encryption status: %t", encryption)
 	if encryption {
 		// attach
-		dev, err := attachVolume(&d, r.Name)
+		d.watchdog.step(name, "attaching volume")
+		dev, _, err := attachVolume(logger.Context, &d, name)
 		if err != nil {
 			logger.WithError(err).Errorf("Error attaching volume: %s", err.Error())
 			return err
 		}
 		// encrypt
 		logger.Debugf("Encrypting device %s with key %s", dev, keyfile)
-		err = luksFormat(dev, keyfile)
+		d.watchdog.step(name, "luksFormat")
+		// header stored off the volume: the volume alone can't even be attempted to decrypt
+		header := ""
+		if d.config.LuksHeaderStore != "" {
+			var cleanup func()
+			if header, cleanup, err = newHeaderFile(vol); err != nil {
+				logger.WithError(err).Error("Error creating LUKS header file")
+				return err
+			}
+			defer cleanup()
+		}
+		err = luksFormat(logger.Context, dev, keyfile, header, luksType)
 		if err != nil {
 			logger.WithError(err).Errorf("Error encrypting volume: %s", err.Error())
 			return err
 		}
 
+		metadata := make(map[string]string)
+		if header != "" {
+			d.watchdog.step(name, "storing LUKS header")
+			stored, err := d.storeDetachedHeader(logger.Context, header, vol)
+			if err != nil {
+				logger.WithError(err).Error("Error storing detached LUKS header")
+				return err
+			}
+			// recorded on its own: without it, the volume can't be opened whatever fails next
+			if vol, err = setVolumeMetadata(logger.Context, &d, vol, map[string]string{metaDetachedHeader: stored}); err != nil {
+				logger.WithError(err).Error("Error recording detached LUKS header")
+				return err
+			}
+		}
+
+		// checked at mount, to detect swapped volumes or tampered headers
+		uuid, err := luksUUID(headerOrDevice(header, dev))
+		if err == nil {
+			metadata[metaLuksUUID] = uuid
+			if fipsMode {
+				metadata[metaFIPS] = "true"
+			}
+			vol, err = setVolumeMetadata(logger.Context, &d, vol, metadata)
+		}
+		if err != nil {
+			logger.WithError(err).Errorf("Error recording LUKS UUID: %s", err.Error())
+			return err
+		}
+
+		if d.config.LuksHeaderBackup != "" {
+			if err = d.backupLuksHeader(logger.Context, dev, vol); err != nil {
+				// the volume is usable, but can't be recovered from a header corruption
+				logger.WithError(err).Error("Error backing up LUKS header")
+			}
+		}
+
 		// detach
-		vol, err := d.getByName(r.Name)
+		vol, err := d.getByName(logger.Context, name)
 		if err != nil {
 			logger.WithError(err).Error("Error retrieving volume")
 		} else {
@@ -194,20 +630,56 @@ func (d plugin) Get(r *volume.GetRequest) (*volume.GetResponse, error) {
 	logger := log.WithFields(log.Fields{"name": r.Name, "action": "get"})
 	logger.Debugf("Get: %+v", r)
 
-	vol, err := d.getByName(r.Name)
+	listed, err := d.lookupByName(context.Background(), r.Name)
 
 	if err != nil {
 		logger.WithError(err).Errorf("Error retrieving volume: %s", err.Error())
-		return nil, err
+		return nil, d.describeError("get", r.Name, nil, d.checkGhost(logger, r.Name, "get", err))
 	}
 
+	vol := &listed.Volume
+
 	response := &volume.GetResponse{
 		Volume: &volume.Volume{
 			Name:       r.Name,
 			CreatedAt:  vol.CreatedAt.Format(time.RFC3339),
-			Mountpoint: filepath.Join(d.config.MountDir, r.Name, d.config.VolumeSubDir),
+			Mountpoint: filepath.Join(d.volumeMountPath(r.Name, vol), d.volumeOptions(vol).SubDir),
+			Status:     make(map[string]interface{}),
 		},
 	}
+	if mountpoint := d.recordedMountpoint(r.Name); mountpoint != "" {
+		response.Volume.Mountpoint = mountpoint
+	}
+
+	// i.e. restoring-backup
+	response.Volume.Status["state"] = vol.Status
+	if metadataBool(vol, metaProtected, false) {
+		response.Volume.Status["protected"] = true
+	}
+	if metadataBool(vol, metaEncryption, false) {
+		response.Volume.Status["fips"] = fipsCompliant(vol.Metadata)
+	}
+	if status := d.creating.status(r.Name); status != "" {
+		response.Volume.Status["create"] = status
+	}
+	d.usageStatus(r.Name, vol, response.Volume.Status)
+	d.topologyStatus(listed, response.Volume.Status)
+	if stats, err := d.state.getStats(r.Name); err != nil {
+		logger.WithError(err).Warn("Error reading volume stats")
+	} else if stats != nil {
+		response.Volume.Status["stats"] = stats
+	}
+
+	// Capacity, when mounted on this host
+	path := d.mountPath(r.Name, vol)
+	if mounted, _ := isMounted(path); mounted {
+		usage, err := getDiskUsage(path)
+		if err != nil {
+			logger.WithError(err).Warn("Error reading disk usage")
+		} else {
+			response.Volume.Status["usage"] = usage
+		}
+	}
 
 	return response, nil
 }
@@ -218,15 +690,19 @@ func (d plugin) List() (*volume.ListResponse, error) {
 
 	var vols []*volume.Volume
 
-	pager := volumes.List(d.blockClient, volumes.ListOpts{})
+	pager := volumes.List(d.block(context.Background()), volumes.ListOpts{})
 	err := pager.EachPage(func(page pagination.Page) (bool, error) {
 		vList, _ := volumes.ExtractVolumes(page)
 
 		for _, v := range vList {
-			if len(v.Name) > 0 {
+			if len(v.Name) > 0 && !isTrashed(&v) && d.isPluginVolume(&v) {
+				name, _ := d.dockerName(&v)
+				status := map[string]interface{}{"state": v.Status}
+				d.usageStatus(name, &v, status)
 				vols = append(vols, &volume.Volume{
-					Name:      v.Name,
+					Name:      name,
 					CreatedAt: v.CreatedAt.Format(time.RFC3339),
+					Status:    status,
 				})
 			}
 		}
@@ -243,56 +719,158 @@ func (d plugin) List() (*volume.ListResponse, error) {
 }
 
 func (d plugin) Mount(r *volume.MountRequest) (*volume.MountResponse, error) {
-	logger := log.WithFields(log.Fields{"name": r.Name, "action": "mount"})
+	var resp *volume.MountResponse
+	err := d.watch("mount", r.Name, func(ctx context.Context) (err error) {
+		resp, err = d.mount(ctx, r)
+		return err
+	})
+	d.recordOp(r.Name, "mount", err)
+	return resp, err
+}
+
+func (d plugin) mount(ctx context.Context, r *volume.MountRequest) (*volume.MountResponse, error) {
+	logger := log.WithContext(ctx).WithFields(log.Fields{"name": r.Name, "action": "mount"})
 	logger.Infof("Mounting volume '%s' ...", r.Name)
 	logger.Debugf("Mount: %+v", r)
 
+	if _, err := d.authorize(logger, "mount", r.Name, nil, r.ID); err != nil {
+		return nil, err
+	}
+
+	release, err := d.ops.acquire(r.Name)
+	if err != nil {
+		logger.WithError(err).Error("Volume operation rejected")
+		return nil, err
+	}
+	defer release()
+	d.watchdog.step(r.Name, "started")
+
+	// created in the background: done once we get the volume's turn
+	if err = d.creating.failed(r.Name); err != nil {
+		logger.WithError(err).Error("Volume not usable")
+		return nil, err
+	}
+
+	path := d.mountPath(r.Name, nil)
+
+	// Another container on this host already uses the volume: share the mount
 	d.mutex.Lock()
-	defer d.mutex.Unlock()
+	if len(d.mounts[r.Name]) > 0 {
+		mounted, _ := isMounted(path)
+		if mounted || isBlockDevice(filepath.Join(path, rawDeviceName)) {
+			if !d.watchdog.settle(ctx) {
+				d.mutex.Unlock()
+				return nil, fmt.Errorf("Mount of volume %s given up", r.Name)
+			}
+			d.mounts[r.Name][r.ID] = true
+			d.saveRefs(r.Name)
+			logger.Debugf("Volume already mounted, %d mount(s) now using it", len(d.mounts[r.Name]))
+			mountpoint := d.mountpoints[r.Name]
+			d.mutex.Unlock()
+			return &volume.MountResponse{Mountpoint: mountpoint}, nil
+		}
+		logger.Warn("Volume referenced but not mounted anymore, mounting again")
+		delete(d.mounts, r.Name)
+		delete(d.mountpoints, r.Name)
+	}
+	d.mutex.Unlock()
 
 	var dev = ""
+	var luksName = ""
 
-	physdev, err := attachVolume(&d, r.Name)
+	d.watchdog.step(r.Name, "attaching volume")
+	attachStart := time.Now()
+	physdev, vol, err := attachVolume(ctx, &d, r.Name)
+	if err == nil {
+		d.recordAttachWait(r.Name, time.Since(attachStart))
+	}
 	if err != nil {
 		logger.WithError(err).Errorf("Error attaching volume: %s", err.Error())
         // cleanup: umount
-        fixUnmountRequest := &volume.UnmountRequest{Name: r.Name, ID: r.ID}
-        unmountErr := d.Unmount(fixUnmountRequest)
+        unmountErr := d.unmountVolume(logger, r.Name)
         if unmountErr != nil {
             logger.WithError(err).Errorf("Error unmounting: %s", unmountErr.Error())
         }
         time.Sleep(time.Duration(d.config.DelayDeviceWait) * time.Second)
-		return nil, err
+		return nil, d.checkGhost(logger, r.Name, "mount", err)
+	}
+
+	// what to undo if a later step fails
+	partial := &volumeState{VolumeID: vol.ID, Device: physdev}
+
+	// mount directory of the volume type, or its own
+	path = d.volumeMountPath(r.Name, vol)
+	if _, custom := vol.Metadata[metaMountpoint]; custom {
+		if mounted, _ := isMounted(path); mounted {
+			logger.Errorf("Mountpoint %s already in use", path)
+			d.abortMount(logger, r.Name, partial)
+			return nil, fmt.Errorf("Mountpoint %s of volume %s is already in use", path, r.Name)
+		}
+	}
+	partial.Path = path
+
+	// Volume from a snapshot, for inspection: never written to
+	readOnly := metadataBool(vol, metaReadOnly, false)
+	discard := !readOnly && metadataBool(vol, metaDiscard, d.config.Discard)
+	if readOnly {
+		if err = setReadOnly(physdev); err != nil {
+			logger.WithError(err).Warn("Error setting device read-only")
+		}
 	}
 
-	// Is it encrypted?
-	if result, err := isLuks(physdev); result == true {
-		logger.Debugf("Encrypted volume - using key file '%s'", d.config.EncryptionKey)
+	// Scratch volume: opened with a random key, never stored, so its data is lost once closed
+	ephemeral := metadataBool(vol, metaEphemeralKey, false)
+	if ephemeral {
+		d.watchdog.step(r.Name, "opening with ephemeral key")
+		luksName, err = openEphemeral(physdev, r.Name, discard)
+		if err != nil {
+			logger.WithError(err).Errorf("Opening device %s with an ephemeral key failed", physdev)
+			d.abortMount(logger, r.Name, partial)
+			return nil, err
+		}
+		partial.LuksName = luksName
+		dev = "/dev/mapper/"+luksName
+	} else if result, _ := isLuks(physdev); result == true || hasDetachedHeader(vol) {
+		// Encrypted with a stored key
+		keyfile, err := d.keyFile(vol)
+		logger.Debugf("Encrypted volume - using key file '%s'", keyfile)
 		// If yes, we must have a passphrase.
-		if d.config.EncryptionKey == "" {
-			logger.Errorf("Device %s is encrypted, and I have no pass to decrypt it.", physdev)
-            // cleanup: umount
-            fixUnmountRequest := &volume.UnmountRequest{Name: r.Name, ID: r.ID}
-            unmountErr := d.Unmount(fixUnmountRequest)
-            if unmountErr != nil {
-                logger.WithError(err).Errorf("Error unmounting: %s", unmountErr.Error())
-            }
+		if keyfile == "" || err != nil {
+			logger.WithError(err).Errorf("Device %s is encrypted, and I have no pass to decrypt it.", physdev)
+            d.abortMount(logger, r.Name, partial)
             time.Sleep(time.Duration(d.config.DelayDeviceWait) * time.Second)
+			if err == nil {
+				err = fmt.Errorf("Device %s is encrypted, and no key is configured", physdev)
+			}
+			return nil, err
+		}
+		if fipsMode && !fipsCompliant(vol.Metadata) {
+			logger.Warn("Volume was not encrypted in FIPS mode, its algorithms may not be FIPS-approved")
+		}
+		// detached header, only on this host while opening the device
+		header, removeHeader, err := d.fetchDetachedHeader(ctx, vol)
+		if err != nil {
+			logger.WithError(err).Error("Error fetching LUKS header")
+			d.abortMount(logger, r.Name, partial)
+			return nil, err
+		}
+		defer removeHeader()
+		// same header as when formatted
+		if err = d.verifyLuksUUID(logger, headerOrDevice(header, physdev), vol); err != nil {
+			logger.WithError(err).Error("LUKS header check failed")
+			d.abortMount(logger, r.Name, partial)
 			return nil, err
 		}
 		// luksOpen it, or quit with error.
-		luksName, err := luksOpen(physdev, d.config.EncryptionKey, r.Name)
+		d.watchdog.step(r.Name, "luksOpen")
+		luksName, err = luksOpen(physdev, keyfile, header, r.Name, readOnly, discard)
 		if err != nil {
-			logger.WithError(err).Errorf("Opening LUKS device %s with key %s failed", physdev, d.config.EncryptionKey)
-            // cleanup: umount
-            fixUnmountRequest := &volume.UnmountRequest{Name: r.Name, ID: r.ID}
-            unmountErr := d.Unmount(fixUnmountRequest)
-            if unmountErr != nil {
-                logger.WithError(err).Errorf("Error unmounting: %s", unmountErr.Error())
-            }
+			logger.WithError(err).Errorf("Opening LUKS device %s with key %s failed", physdev, keyfile)
+            d.abortMount(logger, r.Name, partial)
             time.Sleep(time.Duration(d.config.DelayDeviceWait) * time.Second)
 			return nil, err
 		}
+		partial.LuksName = luksName
 		// Select dm device
 		dev = "/dev/mapper/"+luksName
 	} else {
@@ -300,6 +878,52 @@ func (d plugin) Mount(r *volume.MountRequest) (*volume.MountResponse, error) {
 		dev = physdev
 	}
 
+	opts := d.volumeOptions(vol)
+
+	// Never expose an unencrypted device for a volume created encrypted
+	if opts.Encrypted && dev == physdev {
+		logger.Errorf("Volume was created encrypted, but device %s is not LUKS", physdev)
+		d.abortMount(logger, r.Name, partial)
+		time.Sleep(time.Duration(d.config.DelayDeviceWait) * time.Second)
+		if metadataBool(vol, metaEncryptionPending, false) {
+			return nil, fmt.Errorf("Volume %s encryption did not complete, run the encrypt command again", r.Name)
+		}
+		return nil, fmt.Errorf("Volume %s was created encrypted, but device %s is not LUKS", r.Name, physdev)
+	}
+
+
+	//
+	// Raw block volume: expose the device, no filesystem
+
+	if metadataBool(vol, metaRaw, false) {
+		if err = d.createMountDir(logger, path); err == nil {
+			err = createDeviceNode(dev, filepath.Join(path, rawDeviceName))
+		}
+		if err != nil {
+			logger.WithError(err).Error("Error creating raw device node")
+			d.abortMount(logger, r.Name, partial)
+			time.Sleep(time.Duration(d.config.DelayDeviceWait) * time.Second)
+			return nil, err
+		}
+
+		if !d.watchdog.settle(ctx) {
+			return nil, d.undoLateMount(logger, r.Name, partial)
+		}
+		d.mutex.Lock()
+		d.recordMount(r.Name, r.ID, &volumeState{
+			VolumeID:   vol.ID,
+			Device:     physdev,
+			LuksName:   luksName,
+			Path:       path,
+			Mountpoint: path,
+			Raw:        true,
+		})
+		d.mutex.Unlock()
+
+		logger.Debugf("Raw volume available as %s", filepath.Join(path, rawDeviceName))
+
+		return &volume.MountResponse{Mountpoint: path}, nil
+	}
 
 	//
 	// Check filesystem and format if needed
@@ -307,110 +931,153 @@ func (d plugin) Mount(r *volume.MountRequest) (*volume.MountResponse, error) {
 	fsType, err := getFilesystemType(dev)
 	if err != nil {
 		logger.WithError(err).Error("Detecting filesystem type failed")
-        // cleanup: umount
-        fixUnmountRequest := &volume.UnmountRequest{Name: r.Name, ID: r.ID}
-        unmountErr := d.Unmount(fixUnmountRequest)
-        if unmountErr != nil {
-            logger.WithError(err).Errorf("Error unmounting: %s", unmountErr.Error())
-        }
+        d.abortMount(logger, r.Name, partial)
         time.Sleep(time.Duration(d.config.DelayDeviceWait) * time.Second)
 		return nil, err
 	}
 
+	// new key, new filesystem, whatever random data looks like
+	if ephemeral {
+		fsType = ""
+	}
+
+	// subdirectory encrypted by the filesystem
+	_, fscrypt := vol.Metadata[metaFscrypt]
+
 	newVolumeFlag := false
 	// If not formated:
 	if fsType == "" {
+		if !ephemeral && (readOnly || metadataBool(vol, metaNoAutoFormat, d.config.NoAutoFormat)) {
+			logger.Errorf("Device %s has no filesystem, and automatic formatting is disabled", dev)
+			d.abortMount(logger, r.Name, partial)
+			time.Sleep(time.Duration(d.config.DelayDeviceWait) * time.Second)
+			return nil, fmt.Errorf("Device %s has no filesystem, refusing to format it (noAutoFormat)", dev)
+		}
+
 		newVolumeFlag = true
 
 		// Format it
 		logger.Debug("Volume is empty, formatting")
-		if out, err := formatFilesystem(dev, r.Name, d.config.Filesystem); err != nil {
+		d.watchdog.step(r.Name, "formatting")
+		fast := metadataBool(vol, metaFastFormat, d.config.FastFormat)
+		mkfsOptions := d.mkfsOptions(opts.Filesystem, fast)
+		if fscrypt {
+			mkfsOptions = append(mkfsOptions, fscryptFilesystems[opts.Filesystem]...)
+		}
+		if out, err := formatFilesystem(ctx, dev, r.Name, opts.Filesystem, mkfsOptions); err != nil {
 			logger.WithFields(log.Fields{
 				"output": out,
 				"error": err,
-				"filesystem": d.config.Filesystem,
+				"filesystem": opts.Filesystem,
 			}).Error("Formatting failed")
-            // cleanup: umount
-            fixUnmountRequest := &volume.UnmountRequest{Name: r.Name, ID: r.ID}
-            unmountErr := d.Unmount(fixUnmountRequest)
-            if unmountErr != nil {
-                logger.WithError(err).Errorf("Error unmounting: %s", unmountErr.Error())
-            }
+            d.abortMount(logger, r.Name, partial)
             time.Sleep(time.Duration(d.config.DelayDeviceWait) * time.Second)
 			return nil, err
 		}
 	}
 
+	// i.e. a volume restored from a backup of a filesystem formatted without the encrypt feature
+	if fscrypt && !newVolumeFlag && !readOnly {
+		if err = enableFscrypt(dev, fsType); err != nil {
+			logger.WithError(err).Error("Enabling fscrypt failed")
+			d.abortMount(logger, r.Name, partial)
+			return nil, err
+		}
+	}
+
+	fsSpec, knownFs := filesystems[fsType]
+	grow := !newVolumeFlag && !readOnly && d.config.AutoGrow && knownFs
+	if grow && !fsSpec.growMounted {
+		d.autoGrow(logger, vol, dev, path, fsType)
+	}
+
 	//
 	// Mount device
 
-	path := filepath.Join(d.config.MountDir, r.Name)
-
-	err = createMountDir(path)
+	err = d.createMountDir(logger, path)
 	if err != nil {
 		logger.WithError(err).Errorf("Error creating mount directory %s", path)
-        // cleanup: umount
-        fixUnmountRequest := &volume.UnmountRequest{Name: r.Name, ID: r.ID}
-        unmountErr := d.Unmount(fixUnmountRequest)
-        if unmountErr != nil {
-            logger.WithError(err).Errorf("Error unmounting: %s", unmountErr.Error())
-        }
+        d.abortMount(logger, r.Name, partial)
         time.Sleep(time.Duration(d.config.DelayDeviceWait) * time.Second)
 		return nil, err
 	}
 
-	logger.WithField("mount", path).Debug("Mounting volume...")
-	out, err := exec.Command("mount", dev, path).CombinedOutput()
+	mountArgs := []string{dev, path}
+	mountOpts := d.mountOptions(append(append([]string{}, fsSpec.mountOptions...), opts.MountOptions...))
+	if readOnly {
+		mountOpts = append(append(mountOpts, "ro"), fsSpec.roOptions...)
+	}
+	if discard {
+		mountOpts = append(mountOpts, "discard")
+	}
+	if len(mountOpts) > 0 {
+		mountArgs = append([]string{"-o", strings.Join(mountOpts, ",")}, mountArgs...)
+	}
+
+	logger.WithField("mount", path).Debugf("Mounting volume with options %v...", mountArgs)
+	d.watchdog.step(r.Name, "mounting")
+	out, err := hostCommandContext(ctx, "mount", mountArgs...).CombinedOutput()
 	if err != nil {
 		log.WithError(err).Errorf("%s", out)
-        // cleanup: umount
-        fixUnmountRequest := &volume.UnmountRequest{Name: r.Name, ID: r.ID}
-        unmountErr := d.Unmount(fixUnmountRequest)
-        if unmountErr != nil {
-            logger.WithError(err).Errorf("Error unmounting: %s", unmountErr.Error())
-        }
+        d.abortMount(logger, r.Name, partial)
         time.Sleep(time.Duration(d.config.DelayDeviceWait) * time.Second)
 		return nil, errors.New(string(out))
 	}
 
+	if grow && fsSpec.growMounted {
+		d.autoGrow(logger, vol, dev, path, fsType)
+	}
+
 	if newVolumeFlag {
 
 		// new volume settings
 		var perm = 0700
-		var uid = 0
-		var gid = 0
-		path := filepath.Join(d.config.MountDir, r.Name, d.config.VolumeSubDir)
+		var uid = opts.UID
+		var gid = opts.GID
+		path := filepath.Join(path, opts.SubDir)
 
-		logger.Debugf("New volume, creating VolumeSubDir %s, uid %d / gid %d / perm %o", d.config.VolumeSubDir, uid, gid, perm)
+		logger.Debugf("New volume, creating VolumeSubDir %s, uid %d / gid %d / perm %o", opts.SubDir, uid, gid, perm)
 
 		if err = os.MkdirAll(path, os.FileMode(perm)); err != nil {
 			logger.WithError(err).Error("Error creating VolumeSubDir")
-            // cleanup: umount
-            fixUnmountRequest := &volume.UnmountRequest{Name: r.Name, ID: r.ID}
-            unmountErr := d.Unmount(fixUnmountRequest)
-            if unmountErr != nil {
-                logger.WithError(err).Errorf("Error unmounting: %s", unmountErr.Error())
-            }
+            d.abortMount(logger, r.Name, partial)
             time.Sleep(time.Duration(d.config.DelayDeviceWait) * time.Second)
 			return nil, err
 		}
 		if err = os.Chown(path, uid, gid); err != nil {
 			logger.WithError(err).Error("Error creating VolumeSubDir")
-            // cleanup: umount
-            fixUnmountRequest := &volume.UnmountRequest{Name: r.Name, ID: r.ID}
-            unmountErr := d.Unmount(fixUnmountRequest)
-            if unmountErr != nil {
-                logger.WithError(err).Errorf("Error unmounting: %s", unmountErr.Error())
-            }
+            d.abortMount(logger, r.Name, partial)
             time.Sleep(time.Duration(d.config.DelayDeviceWait) * time.Second)
 			return nil, err
 		}
 	}
 
+	if fscrypt {
+		d.watchdog.step(r.Name, "unlocking fscrypt subdirectory")
+		if err = d.unlockFscrypt(logger, vol, path, opts.SubDir, readOnly); err != nil {
+			logger.WithError(err).Error("Unlocking encrypted subdirectory failed")
+			d.abortMount(logger, r.Name, partial)
+			return nil, err
+		}
+	}
+
 	resp := volume.MountResponse{
-		Mountpoint: filepath.Join(path, d.config.VolumeSubDir),
+		Mountpoint: filepath.Join(path, opts.SubDir),
 	}
 
+	if !d.watchdog.settle(ctx) {
+		return nil, d.undoLateMount(logger, r.Name, partial)
+	}
+	d.mutex.Lock()
+	d.recordMount(r.Name, r.ID, &volumeState{
+		VolumeID:   vol.ID,
+		Device:     physdev,
+		LuksName:   luksName,
+		Path:       path,
+		Mountpoint: resp.Mountpoint,
+	})
+	d.mutex.Unlock()
+
 	logger.Debug("Volume successfully mounted")
 
 	return &resp, nil
@@ -420,60 +1087,268 @@ func (d plugin) Path(r *volume.PathRequest) (*volume.PathResponse, error) {
 	logger := log.WithFields(log.Fields{"name": r.Name, "action": "path"})
 	logger.Debugf("Path: %+v", r)
 
+	// not in use on this host: its metadata tells where it would be mounted
+	recorded := d.recordedMountpoint(r.Name)
+	var vol *volumes.Volume
+	if recorded == "" {
+		var err error
+		if vol, err = d.getByName(context.Background(), r.Name); err != nil {
+			logger.WithError(err).Warn("Error retrieving volume, using default mount directory and volumeSubDir")
+			vol = nil
+		}
+	}
+	path := d.mountPath(r.Name, vol)
+
+	if isBlockDevice(filepath.Join(path, rawDeviceName)) {
+		return &volume.PathResponse{Mountpoint: path}, nil
+	}
+
+	mountDevice, err := getMountDevice(path)
+	if err != nil {
+		logger.WithError(err).Error("Error checking mount state")
+		return nil, err
+	}
+
+	// Not mounted: no mountpoint to report
+	if mountDevice == "" {
+		logger.Debug("Volume is not mounted")
+		return &volume.PathResponse{}, nil
+	}
+
+	// Mounted, but the device behind it disappeared (detached under our feet)
+	if _, err := os.Stat(mountDevice); err != nil {
+		logger.WithError(err).Errorf("Volume mounted but device %s is gone", mountDevice)
+		return nil, fmt.Errorf("Volume %s is mounted but its device %s is gone", r.Name, mountDevice)
+	}
+
+	// LUKS volume: the mapping must still be active
+	if strings.HasPrefix(mountDevice, "/dev/mapper/") {
+		if _, _, _, err := getLuksInfo(path); err != nil {
+			logger.WithError(err).Errorf("Volume mounted but LUKS mapping %s is broken", mountDevice)
+			return nil, fmt.Errorf("Volume %s is mounted but its LUKS mapping is broken: %w", r.Name, err)
+		}
+	}
+
+	// in use on this host: mountpoint known without asking Cinder
+	if recorded != "" {
+		return &volume.PathResponse{Mountpoint: recorded}, nil
+	}
+
+	// volume subdir is stored in Cinder metadata
+	subDir := d.config.VolumeSubDir
+	if vol != nil {
+		subDir = d.volumeOptions(vol).SubDir
+	}
+
 	resp := volume.PathResponse{
-		Mountpoint: filepath.Join(d.config.MountDir, r.Name, d.config.VolumeSubDir),
+		Mountpoint: filepath.Join(path, subDir),
 	}
 
 	return &resp, nil
 }
 
 func (d plugin) Remove(r *volume.RemoveRequest) error {
-	logger := log.WithFields(log.Fields{"name": r.Name, "action": "remove"})
+	err := d.track("remove", r.Name, func(ctx context.Context) error {
+		return d.remove(ctx, r)
+	})
+	d.recordOp(r.Name, "remove", err)
+	return err
+}
+
+func (d plugin) remove(ctx context.Context, r *volume.RemoveRequest) error {
+	logger := log.WithContext(ctx).WithFields(log.Fields{"name": r.Name, "action": "remove"})
 	logger.Infof("Removing volume '%s' ...", r.Name)
 	logger.Debugf("Remove: %+v", r)
 
-	vol, err := d.getByName(r.Name)
+	if _, err := d.authorize(logger, "remove", r.Name, nil, ""); err != nil {
+		return err
+	}
 
+	release, err := d.ops.acquireCleanup(r.Name)
+	if err != nil {
+		logger.WithError(err).Error("Volume operation rejected")
+		return err
+	}
+	defer release()
+
+	vol, err := d.getByName(ctx, r.Name)
+
+	if errors.Is(err, errNotFound) {
+		// deleted out of band: let Docker drop its record
+		logger.Warn("Volume already deleted from Cinder")
+		d.removeGhost(logger, r.Name)
+		return nil
+	}
 	if err != nil {
 		logger.WithError(err).Errorf("Error retriving volume: %s", err.Error())
 		return err
 	}
 
 	logger = logger.WithField("id", vol.ID)
+	d.watchdog.identify(r.Name, vol.ID)
+
+	if metadataBool(vol, metaProtected, false) {
+		logger.Error("Volume is protected, not removing it")
+		return fmt.Errorf("Volume %s is protected against removal, clear it with the unprotect command first", r.Name)
+	}
+	// whatever managedOnly, volumes of other systems are never deleted through Docker
+	if vol.Metadata[metaManaged] != "true" {
+		logger.Error("Volume not created by the plugin, not removing it")
+		return fmt.Errorf("Volume %s was not created by the plugin, tag it with the adopt command to remove it through Docker", r.Name)
+	}
+	if err = d.checkEngine(vol); err != nil {
+		logger.WithError(err).Error("Volume created by another Docker engine, not removing it")
+		return err
+	}
 
 	if len(vol.Attachments) > 0 {
 		logger.Debug("Volume still attached, detaching first")
-		if vol, err = d.detachVolume(logger.Context, vol); err != nil {
-			logger.WithError(err).Error("Error detaching volume")
+		if _, err = d.detachVolume(logger.Context, vol); err != nil {
+			if !d.config.ForceRemove {
+				logger.WithError(err).Error("Error detaching volume")
+				return err
+			}
+			logger.WithError(err).Warn("Error detaching volume, force-detaching")
+			if err = forceDetach(d.block(ctx), vol); err != nil {
+				logger.WithError(err).Error("Error force-detaching volume")
+				return err
+			}
+		}
+	}
+
+	go d.purgeExpiredVolumes()
+
+	if d.wantSnapshotBeforeDelete(vol) {
+		if err = d.trashVolume(logger, vol); err != nil {
+			logger.WithError(err).Error("Error keeping volume for recovery, not deleting it")
 			return err
 		}
+		d.creating.forget(r.Name)
+		return nil
+	}
+
+	if vol.Status == "error_deleting" && d.config.ResetErrorState {
+		// a previous delete failed: Cinder only retries it from 'error'
+		logger.Warn("Volume is in 'error_deleting' state, resetting it to 'error' to retry")
+		if err = resetStatus(d.block(ctx), vol.ID, "error"); err != nil {
+			logger.WithError(err).Warn("Error resetting volume state")
+		}
 	}
 
 	logger.Debug("Deleting block volume...")
 
-	err = volumes.Delete(d.blockClient, vol.ID, volumes.DeleteOpts{}).ExtractErr()
+	err = volumes.Delete(d.block(ctx), vol.ID, volumes.DeleteOpts{}).ExtractErr()
+	if err != nil && d.config.ForceRemove {
+		// i.e. volume stuck in "error_deleting"
+		logger.WithError(err).Warnf("Error deleting volume in '%s' state, force-deleting", vol.Status)
+		err = volumeactions.ForceDelete(d.block(ctx), vol.ID).ExtractErr()
+	}
 	if err != nil {
 		logger.WithError(err).Errorf("Error deleting volume: %s", err.Error())
 		return err
 	}
 
 	logger.Debug("Volume deleted")
+	d.creating.forget(r.Name)
+	d.releaseDetachedHeader(logger, vol)
 
 	return nil
 }
 
 func (d plugin) Unmount(r *volume.UnmountRequest) error {
-	logger := log.WithFields(log.Fields{"name": r.Name, "action": "unmount"})
+	err := d.track("unmount", r.Name, func(ctx context.Context) error {
+		return d.unmount(ctx, r)
+	})
+	d.recordOp(r.Name, "unmount", err)
+	return err
+}
+
+func (d plugin) unmount(ctx context.Context, r *volume.UnmountRequest) error {
+	logger := log.WithContext(ctx).WithFields(log.Fields{"name": r.Name, "action": "unmount"})
 	logger.Infof("Unmounting volume '%s' ...", r.Name)
 	logger.Debugf("Unmount: %+v", r)
 
+	release, err := d.ops.acquireCleanup(r.Name)
+	if err != nil {
+		logger.WithError(err).Error("Volume operation rejected")
+		return err
+	}
+	defer release()
+
+	// Keep the volume mounted and attached while other containers use it
 	d.mutex.Lock()
-	defer d.mutex.Unlock()
+	ref := r.ID
+	refs, mounted := d.mounts[r.Name]
+	mountpoint := d.mountpoints[r.Name]
+	if mounted {
+		if adopted := adoptedRefOf(refs); !refs[r.ID] && adopted != "" {
+			// mounted before the plugin started, by a container it doesn't know
+			ref = adopted
+		}
+		delete(refs, ref)
+		d.saveRefs(r.Name)
+		if len(refs) > 0 {
+			logger.Infof("Volume still used by %d other mount(s), not unmounting", len(refs))
+			d.mutex.Unlock()
+			return nil
+		}
+		delete(d.mounts, r.Name)
+		delete(d.mountpoints, r.Name)
+	}
+	d.mutex.Unlock()
+
+	if err = d.unmountVolume(logger, r.Name); err != nil && mounted {
+		// still mounted (i.e. busy): keep the reference, so that a retried Unmount
+		// closes the LUKS mapping and detaches the volume once it is released
+		d.mutex.Lock()
+		if d.mounts[r.Name] == nil {
+			d.mounts[r.Name] = map[string]bool{}
+		}
+		d.mounts[r.Name][ref] = true
+		if mountpoint != "" {
+			d.mountpoints[r.Name] = mountpoint
+		}
+		d.saveRefs(r.Name)
+		d.mutex.Unlock()
+	}
+	return err
+}
 
-	path := filepath.Join(d.config.MountDir, r.Name)
+// Unmount a volume, close its LUKS device if any, and detach it.
+// Caller must hold the volume's turn in the operation queue.
+// It runs to its end, also to clean up after a cancelled operation.
+func (d plugin) unmountVolume(logger *log.Entry, name string) error {
+	logger = logger.WithContext(context.Background())
+	path := d.mountPath(name, nil)
+
+	// find device behind volume and luks volume name (in case it is a luks encrypted volume):
+	// recorded when mounted, or found from the mount table
+	var luksName, baseDevice string
+	state, err := d.state.get(name)
+	if err != nil {
+		logger.WithError(err).Error("Error reading volume state")
+	}
+	if state != nil {
+		luksName, baseDevice = state.LuksName, state.Device
+	} else {
+		_, luksName, baseDevice, err = getLuksInfo(path)
+	}
 
-	// find device behind volume and luks volume name (in case it is a luks encrypted volume)
-	_, luksName, baseDevice, err := getLuksInfo(path)
+	// raw block volume: nothing mounted, remove the device node
+	rawNode := filepath.Join(path, rawDeviceName)
+	raw := isBlockDevice(rawNode)
+	if raw {
+		logger.Debugf("Removing raw device node %s", rawNode)
+		if err := os.Remove(rawNode); err != nil {
+			logger.WithError(err).Errorf("Error removing %s", rawNode)
+		}
+		if state == nil {
+			luksName = luksMapperName(name)
+			if _, err := os.Stat("/dev/mapper/" + luksName); err == nil {
+				baseDevice, _ = getLuksBaseDevice(luksName)
+			}
+		}
+	}
 
 	exists, err := isDirectoryPresent(path)
 	if err != nil {
@@ -482,25 +1357,40 @@ func (d plugin) Unmount(r *volume.UnmountRequest) error {
 
 	// error with "stats" usually means it exists but we can't reach it
 	// that means mounted but broken. So we must unmount it.
-	if exists || (err != nil) {
-		err = syscall.Unmount(path, 0)
-		if err != nil {
+	if !raw && (exists || (err != nil)) {
+		if holders := waitForOpenFiles(logger.Context, path, d.config.TimeoutOpenFiles); len(holders) > 0 {
+			logger.Warnf("Files still open in %s by: %s", path, strings.Join(holders, ", "))
+		}
+
+		d.watchdog.step(name, "unmounting")
+		if err = unmountSubmounts(logger, path); err != nil {
+			logger.WithError(err).Error("Error unmounting submounts")
+		}
+		err = unmount(path)
+		if err == syscall.EBUSY {
+			holders := getOpenFileHolders(path)
+			logger.WithError(err).Errorf("Error unmount %s, still in use by: %s", path, strings.Join(holders, ", "))
+			return fmt.Errorf("Unmount %s failed: device busy, files open by: %s", path, strings.Join(holders, ", "))
+		} else if err != nil {
 			logger.WithError(err).Errorf("Error unmount %s", path)
 		}
 	}
 
-	// Now the volume is unmounted, we close the luks volume (if it is one):
+	// Now the volume is unmounted, we close the luks volume (if it is one),
+	// or the plain dm-crypt device of an ephemeral key:
 	if baseDevice != "" {
-		if result, _ := isLuks(baseDevice); result == true {
+		if result, _ := isLuks(baseDevice); result == true || luksName != "" {
 			logger.Debugf("Closing LUKS device %s", luksName)
-			luksCloseOutput, err := exec.Command("cryptsetup", "luksClose", luksName).CombinedOutput()
+			d.watchdog.step(name, "luksClose")
+			luksCloseOutput, err := hostCommand("cryptsetup", "luksClose", luksName).CombinedOutput()
 			if err != nil {
 				logger.WithError(err).Errorf("Error closing LUKS volume - %s", luksCloseOutput)
 			}
 		}
 	}
 
-	vol, err := d.getByName(r.Name)
+	d.watchdog.step(name, "detaching")
+	vol, err := d.getByName(logger.Context, name)
 	if err != nil {
 		logger.WithError(err).Error("Error retrieving volume")
 	} else {
@@ -510,26 +1400,166 @@ func (d plugin) Unmount(r *volume.UnmountRequest) error {
 		}
 	}
 
+	if err = d.state.delete(name); err != nil {
+		logger.WithError(err).Error("Error removing volume state")
+	}
+
 	return nil
 }
 
-func (d plugin) getByName(name string) (*volumes.Volume, error) {
+// Undo a mount completed after timeoutOperation: Docker was told it failed, and won't unmount it
+func (d plugin) undoLateMount(logger *log.Entry, name string, partial *volumeState) error {
+	logger.Warn("Mount completed after it was given up, undoing it")
+	d.abortMount(logger, name, partial)
+	return fmt.Errorf("Mount of volume %s completed after it was given up, undone", name)
+}
+
+// Undo a mount failed after attaching the volume: unmount, close the LUKS mapping and detach,
+// so that the next attempt starts over. The volume is recorded as partially set up for unmountVolume,
+// which otherwise finds the mapping from the mount table, i.e. not when the failure came before mounting.
+func (d plugin) abortMount(logger *log.Entry, name string, partial *volumeState) {
+	if err := d.state.put(name, partial); err != nil {
+		logger.WithError(err).Error("Error saving volume state")
+	}
+	if err := d.unmountVolume(logger, name); err != nil {
+		logger.WithError(err).Errorf("Error unmounting: %s", err.Error())
+	}
+}
+
+// Grow the filesystem if its volume was extended, and the LUKS mapping under it first
+func (d plugin) autoGrow(logger *log.Entry, vol *volumes.Volume, dev string, path string, fsType string) {
+	if strings.HasPrefix(dev, "/dev/mapper/") {
+		if err := d.resizeLuks(logger, vol, strings.TrimPrefix(dev, "/dev/mapper/")); err != nil {
+			logger.WithError(err).Warn("Error resizing LUKS mapping, not growing filesystem")
+			return
+		}
+	}
+	grown, err := growFilesystemIfNeeded(dev, path, fsType)
+	if err != nil {
+		// not fatal, the volume is still usable at its previous size
+		logger.WithError(err).Warn("Error checking or growing filesystem")
+	} else if grown {
+		logger.Infof("Volume was extended, %s filesystem grown", fsType)
+	}
+}
+
+// Extra mkfs options for a filesystem
+// fast: defer inode tables and journal initialization, skip discard
+func (d plugin) mkfsOptions(filesystem string, fast bool) []string {
+	var opts []string
+
+	switch filesystem {
+	case "ext2", "ext3", "ext4":
+		if d.config.ReservedBlocksPercent >= 0 {
+			opts = append(opts, "-m", strconv.Itoa(d.config.ReservedBlocksPercent))
+		}
+	}
+
+	if fast {
+		opts = append(opts, filesystems[filesystem].fastOptions...)
+	}
+
+	return opts
+}
+
+// Directory where a volume is mounted: the one it was recorded mounted in,
+// or the one of its metadata when the volume is given (mountpoint option, volume type),
+// or found mounted in with mountDirs, mountDir's when not mounted.
+func (d plugin) mountPath(name string, vol *volumes.Volume) string {
+	if state, _ := d.state.get(name); state != nil && state.Path != "" {
+		return state.Path
+	}
+	if vol != nil {
+		return d.volumeMountPath(name, vol)
+	}
+
+	short := shortenName(name, maxFileNameLength)
+	if len(d.config.MountDirs) == 0 {
+		return filepath.Join(d.config.MountDir, short)
+	}
+	for _, root := range d.config.mountRoots() {
+		path := filepath.Join(root, short)
+		if mounted, _ := isMounted(path); mounted || isBlockDevice(filepath.Join(path, rawDeviceName)) {
+			return path
+		}
+	}
+	return filepath.Join(d.config.MountDir, short)
+}
+
+// Directory where a volume is mounted, according to its mountpoint option or its type
+func (d plugin) volumeMountPath(name string, vol *volumes.Volume) string {
+	if mountpoint, ok := vol.Metadata[metaMountpoint]; ok {
+		return mountpoint
+	}
+	return filepath.Join(d.config.mountRoot(vol.VolumeType), shortenName(name, maxFileNameLength))
+}
+
+// Mount options: volume options, then the ones enforced on every volume
+func (d plugin) mountOptions(volumeOpts []string) []string {
+	opts := append([]string{}, volumeOpts...)
+
+	if d.config.SecureMount {
+		opts = append(opts, "nosuid", "nodev")
+	}
+	if d.config.NoExec {
+		opts = append(opts, "noexec")
+	}
+
+	return opts
+}
+
+func (d plugin) getByName(ctx context.Context, name string) (*volumes.Volume, error) {
+	vol, err := d.lookupByName(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &vol.Volume, nil
+}
+
+// Volume as listed by Cinder, with the attributes gophercloud's Volume leaves out
+type listedVolume struct {
+	volumes.Volume
+	// Cinder backend (host@backend#pool), only listed for admins
+	Host string
+}
+
+// Backend attribute of a listed volume
+type volumeHost struct {
+	Host string `json:"os-vol-host-attr:host"`
+}
+
+func (d plugin) lookupByName(ctx context.Context, name string) (*listedVolume, error) {
 	logger := log.WithFields(log.Fields{"name": name, "action": "getByName"})
 	logger.Debugf("GetbyName")
 
-	var volume *volumes.Volume
+	var volume *listedVolume
+
+	name = d.cinderName(name)
+	if d.notFound.has(name) {
+		logger.Debug("Volume recently not found")
+		return nil, errNotFound
+	}
 
-	pager := volumes.List(d.blockClient, volumes.ListOpts{Name: name})
+	pager := volumes.List(d.block(ctx), volumes.ListOpts{Name: name})
 	err := pager.EachPage(func(page pagination.Page) (bool, error) {
 		vList, err := volumes.ExtractVolumes(page)
 
 		if err != nil {
 			return false, err
 		}
+		// same page, for the attributes Volume doesn't decode
+		var hosts []volumeHost
+		if err = volumes.ExtractVolumesInto(page, &hosts); err != nil || len(hosts) != len(vList) {
+			hosts = make([]volumeHost, len(vList))
+		}
 
-		for _, v := range vList {
+		for i, v := range vList {
 			if v.Name == name {
-				volume = &v
+				if !d.isPluginVolume(&v) {
+					logger.WithField("id", v.ID).Debug("Ignoring boot or foreign volume")
+					continue
+				}
+				volume = &listedVolume{Volume: v, Host: hosts[i].Host}
 				return false, nil
 			}
 		}
@@ -537,16 +1567,48 @@ func (d plugin) getByName(name string) (*volumes.Volume, error) {
 		return true, nil
 	})
 
-	if len(volume.ID) == 0 {
-		return nil, errors.New("Not Found")
+	if err != nil {
+		return nil, err
+	}
+
+	if volume == nil || len(volume.ID) == 0 {
+		d.notFound.add(name)
+		return nil, errNotFound
 	}
 
-	return volume, err
+	return volume, nil
+}
+
+// Boot disks are never handled by the plugin,
+// and with managedOnly, neither are volumes it did not create (which are never removed anyway).
+// With listFilterPrefix, only volumes with this name prefix are handled.
+func (d plugin) isPluginVolume(vol *volumes.Volume) bool {
+	if vol.Bootable == "true" {
+		return false
+	}
+	if d.config.ManagedOnly && vol.Metadata[metaManaged] != "true" {
+		return false
+	}
+	name, ok := d.dockerName(vol)
+	if !ok || !strings.HasPrefix(name, d.config.ListFilterPrefix) {
+		return false
+	}
+	return true
 }
 
 func (d plugin) detachVolume(ctx context.Context, vol *volumes.Volume) (*volumes.Volume, error) {
+	logger := log.WithContext(ctx).WithFields(log.Fields{"id": vol.ID, "action": "detachVolume"})
+
 	for _, att := range vol.Attachments {
-		err := volumeattach.Delete(d.computeClient, att.ServerID, att.ID).ExtractErr()
+		var err error
+		if att.ServerID == "" && d.local != nil {
+			// attached without Nova
+			err = d.localDetach(logger, vol, att)
+		} else if d.computeClient == nil {
+			err = fmt.Errorf("Volume attached to server %s through Nova, which is not used in standalone mode", att.ServerID)
+		} else {
+			err = volumeattach.Delete(d.compute(ctx), att.ServerID, att.ID).ExtractErr()
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -555,28 +1617,72 @@ func (d plugin) detachVolume(ctx context.Context, vol *volumes.Volume) (*volumes
 	return vol, nil
 }
 
+// Whether an attachment is to the host running the plugin
+func (d plugin) isAttachedHere(att volumes.Attachment) bool {
+	if d.local != nil {
+		return att.ServerID == "" && att.HostName == d.hostname
+	}
+	return att.ServerID == d.machineID()
+}
+
+// Poll a volume until it reaches status, with exponential backoff from pollVolumeState
+// up to maxPollVolumeState. Fails fast when the volume goes to an error state, when ctx is cancelled,
+// or after retriesVolumeState API errors.
 func (d plugin) waitOnVolumeState(ctx context.Context, vol *volumes.Volume, status string) (*volumes.Volume, error) {
+	return d.waitOnVolumeStateFor(ctx, vol, status, d.config.TimeoutVolumeState)
+}
+
+// Poll a volume until it reaches status, for at most timeout seconds
+func (d plugin) waitOnVolumeStateFor(ctx context.Context, vol *volumes.Volume, status string, timeout int) (*volumes.Volume, error) {
 	if vol.Status == status {
 		return vol, nil
 	}
 
-	timeout := d.config.TimeoutVolumeState
+	ctx, cancel := context.WithTimeout(nonNilContext(ctx), time.Duration(timeout)*time.Second)
+	defer cancel()
 
-	for i := 1; i <= timeout; i++ {
-		time.Sleep(1000 * time.Millisecond)
+	interval := time.Duration(d.config.PollVolumeState) * time.Millisecond
+	if interval <= 0 {
+		interval = time.Second
+	}
+	maxInterval := time.Duration(d.config.MaxPollVolumeState) * time.Millisecond
+	if maxInterval < interval {
+		maxInterval = interval
+	}
+	failures := 0
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.WithContext(ctx).Debugf("Volume did not become %s: %+v", status, vol)
+			return nil, fmt.Errorf("Volume %s did not become %s, still %s", vol.ID, status, vol.Status)
+		case <-timer.C:
+		}
 
-		vol, err := volumes.Get(d.blockClient, vol.ID).Extract()
+		current, err := volumes.Get(d.block(ctx), vol.ID).Extract()
 		if err != nil {
-			return nil, err
+			if failures++; failures > d.config.RetriesVolumeState {
+				return nil, err
+			}
+			log.WithContext(ctx).WithError(err).Debugf("Error polling volume %s, retrying", vol.ID)
+			timer.Reset(interval)
+			continue
 		}
+		vol = current
 
 		if vol.Status == status {
 			time.Sleep(time.Duration(d.config.DelayVolumeState) * time.Second)
 			return vol, nil
 		}
-	}
-
-	log.WithContext(ctx).Debugf("Volume did not become %s: %+v", status, vol)
+		if strings.HasPrefix(vol.Status, "error") {
+			return nil, fmt.Errorf("Volume %s status became %s", vol.ID, vol.Status)
+		}
 
-	return nil, fmt.Errorf("Volume status became %s", vol.Status)
+		if interval *= 2; interval > maxInterval {
+			interval = maxInterval
+		}
+		timer.Reset(interval)
+	}
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Request sent to the policy hook
+type policyRequest struct {
+	Action  string            `json:"action"`
+	Name    string            `json:"name"`
+	Options map[string]string `json:"options,omitempty"`
+	// container mount ID, for mount
+	ID string `json:"id,omitempty"`
+	// host, to tell requests of several hosts apart
+	Host string `json:"host,omitempty"`
+}
+
+// Decision of the policy hook. Options, when set, replace the create options.
+type policyResponse struct {
+	Allow   bool              `json:"allow"`
+	Reason  string            `json:"reason,omitempty"`
+	Options map[string]string `json:"options,omitempty"`
+}
+
+// Ask the policy hook whether an operation is allowed, and return the options to use.
+// Without policyHook, everything is allowed. Hook errors deny the operation.
+func (d plugin) authorize(logger *log.Entry, action string, name string, options map[string]string, id string) (map[string]string, error) {
+	if d.config.PolicyHook == "" {
+		return options, nil
+	}
+
+	request := policyRequest{Action: action, Name: name, Options: options, ID: id, Host: d.hostname}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(d.config.PolicyTimeout)*time.Second)
+	defer cancel()
+
+	var out []byte
+	if strings.HasPrefix(d.config.PolicyHook, "http://") || strings.HasPrefix(d.config.PolicyHook, "https://") {
+		out, err = postPolicyRequest(ctx, d.config.PolicyHook, body)
+	} else {
+		cmd := exec.CommandContext(ctx, d.config.PolicyHook)
+		cmd.Stdin = bytes.NewReader(body)
+		out, err = cmd.Output()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			err = fmt.Errorf("%w (%s)", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+	}
+	if err != nil {
+		logger.WithError(err).Error("Policy hook failed")
+		return nil, fmt.Errorf("Policy hook failed, %s of volume %s denied: %w", action, name, err)
+	}
+
+	var response policyResponse
+	if err = json.Unmarshal(out, &response); err != nil {
+		logger.WithError(err).Errorf("Invalid policy hook response: %s", out)
+		return nil, fmt.Errorf("Invalid policy hook response, %s of volume %s denied", action, name)
+	}
+	if !response.Allow {
+		logger.WithField("reason", response.Reason).Warn("Operation denied by policy hook")
+		if response.Reason == "" {
+			return nil, fmt.Errorf("%s of volume %s denied by policy", action, name)
+		}
+		return nil, fmt.Errorf("%s of volume %s denied by policy: %s", action, name, response.Reason)
+	}
+
+	if response.Options != nil {
+		logger.Debugf("Options set by policy hook: %v", response.Options)
+		return response.Options, nil
+	}
+	return options, nil
+}
+
+func postPolicyRequest(ctx context.Context, url string, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var out bytes.Buffer
+	if _, err = out.ReadFrom(resp.Body); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, errors.New(resp.Status)
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+)
+
+// Docker engine ID file, on the host (Docker 23 and later)
+const dockerEngineIDFile = "/var/lib/docker/engine-id"
+
+// ID of the Docker engine using the plugin, marking the volumes it creates:
+// engineID config, else Docker's engine ID, else the host name
+func resolveEngineID(config *tConfig, hostname string) string {
+	if config.EngineID != "" {
+		return config.EngineID
+	}
+	content, err := ioutil.ReadFile(filepath.Join(procDir(), "root", dockerEngineIDFile))
+	if id := strings.TrimSpace(string(content)); err == nil && id != "" {
+		return id
+	}
+	return hostname
+}
+
+// With pruneProtection, refuse to remove a volume created by another Docker engine:
+// Docker doesn't tell a prune from a removal, and volumes are global, so a prune on one host
+// would remove the volumes of other hosts. Volumes created before the mark are not protected.
+func (d plugin) checkEngine(vol *volumes.Volume) error {
+	owner, ok := vol.Metadata[metaEngineID]
+	if !d.config.PruneProtection || !ok || owner == d.engineID {
+		return nil
+	}
+	return fmt.Errorf("Volume %s was created by Docker engine %s, not removing it from this one (pruneProtection): remove it from its engine, or run the adopt command here first", d.volumeName(vol), owner)
+}
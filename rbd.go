@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Attach Ceph RBD volumes with the kernel rbd driver.
+// The host needs the ceph client config and the keyring of the Cinder user.
+type rbdConnector struct{}
+
+func (rbdConnector) volumeType() string {
+	return "rbd"
+}
+
+func (rbdConnector) properties(hostname string) (map[string]interface{}, error) {
+	properties := baseProperties(hostname)
+	properties["do_local_attach"] = true
+	return properties, nil
+}
+
+func (rbdConnector) connect(ctx context.Context, data map[string]interface{}, timeout int) (string, error) {
+	name, _ := data["name"].(string)
+	if name == "" {
+		return "", errors.New("Incomplete RBD connection data")
+	}
+
+	// udev link: /dev/rbd/<pool>/<image>
+	devpath := filepath.Join("/dev/rbd", name)
+	if isBlockDevice(devpath) {
+		return devpath, nil
+	}
+
+	out, err := hostCommand("rbd", rbdArgs(data, "map", name)...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("rbd map %s failed - %s", name, out)
+	}
+
+	dev, err := waitFor(ctx, []string{"/dev"}, func() (string, error) {
+		if isBlockDevice(devpath) {
+			return devpath, nil
+		}
+		return "", nil
+	}, timeout)
+	if err == nil && dev == "" {
+		// no udev rule for the link: use the device rbd printed
+		dev = strings.TrimSpace(string(out))
+	}
+	return dev, err
+}
+
+func (rbdConnector) disconnect(data map[string]interface{}) error {
+	name, _ := data["name"].(string)
+	devpath := filepath.Join("/dev/rbd", name)
+	if name == "" || !isBlockDevice(devpath) {
+		return nil
+	}
+
+	out, err := hostCommand("rbd", rbdArgs(data, "unmap", devpath)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("rbd unmap %s failed - %s", name, out)
+	}
+	return nil
+}
+
+// rbd command arguments, with the cluster and user of the connection data
+func rbdArgs(data map[string]interface{}, args ...string) []string {
+	if cluster, ok := data["cluster_name"].(string); ok && cluster != "" {
+		args = append(args, "--cluster", cluster)
+	}
+	if user, ok := data["auth_username"].(string); ok && user != "" {
+		args = append(args, "--id", user)
+	}
+
+	hosts, _ := data["hosts"].([]interface{})
+	ports, _ := data["ports"].([]interface{})
+	var monitors []string
+	for i, host := range hosts {
+		if i < len(ports) {
+			monitors = append(monitors, fmt.Sprintf("%v:%v", host, ports[i]))
+		}
+	}
+	if len(monitors) > 0 {
+		args = append(args, "-m", strings.Join(monitors, ","))
+	}
+
+	return args
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/volumeattach"
+	log "github.com/sirupsen/logrus"
+)
+
+// Get a volume out of a state preventing its attachment when possible,
+// or return an error telling the operator what to do about it
+func (d plugin) recoverVolumeState(logger *log.Entry, vol *volumes.Volume) (*volumes.Volume, error) {
+	switch vol.Status {
+	case "maintenance":
+		// migration or retype in progress: it should end by itself
+		logger.Info("Volume is in 'maintenance' state, wait for 'available'...")
+		recovered, err := d.waitOnVolumeState(logger.Context, vol, "available")
+		if err != nil {
+			return nil, fmt.Errorf("Volume %s is still in maintenance (migration or retype in progress?), retry later or check 'openstack volume show %s'", vol.Name, vol.ID)
+		}
+		return recovered, nil
+
+	case "error", "error_extending":
+		// a failed extend leaves the volume's data in place, but plain 'error' may be a volume
+		// which creation failed, with no backing storage: it is never reset
+		if !d.config.ResetErrorState || vol.Status == "error" || len(vol.Attachments) > 0 {
+			return nil, fmt.Errorf("Volume %s is in '%s' state: check 'openstack volume show %s', and if its data is sound reset it with 'openstack volume set --state available %s'", vol.Name, vol.Status, vol.ID, vol.ID)
+		}
+
+		logger.Warnf("Volume is in '%s' state, resetting it to 'available'", vol.Status)
+		if err := resetStatus(d.block(logger.Context), vol.ID, "available"); err != nil {
+			return nil, fmt.Errorf("Volume %s is in '%s' state, and resetting it failed: %w", vol.Name, vol.Status, err)
+		}
+		return volumes.Get(d.block(logger.Context), vol.ID).Extract()
+
+	case "attaching":
+		// an attach in progress elsewhere, or one that never completed
+		logger.Info("Volume is in 'attaching' state, wait for 'in-use'...")
+		if attached, err := d.waitOnVolumeStateFor(logger.Context, vol, "in-use", d.config.attachTimeout()); err == nil {
+			return attached, nil
+		}
+		if vol, err := volumes.Get(d.block(logger.Context), vol.ID).Extract(); err != nil || vol.Status != "attaching" {
+			return vol, err
+		}
+		return d.resetStuckAttaching(logger, vol)
+
+	case "restoring-backup":
+		return nil, fmt.Errorf("Volume %s is being restored from a backup, retry when its state is available ('docker volume inspect %s')", vol.Name, d.volumeName(vol))
+
+	case "error_deleting":
+		return nil, fmt.Errorf("Volume %s failed to be deleted, remove it again ('docker volume rm %s') or check 'openstack volume show %s'", vol.Name, d.volumeName(vol), vol.ID)
+	}
+
+	return vol, nil
+}
+
+// Get a volume stuck in 'attaching' (i.e. Nova or the compute host failed midway) back to 'available':
+// delete its attachments to this host, then reset its status when it stays 'attaching',
+// resetErrorState allows it, and it has been 'attaching' for timeoutAttaching.
+// Attaches of other hosts may still be in progress: they are left alone.
+func (d plugin) resetStuckAttaching(logger *log.Entry, vol *volumes.Volume) (*volumes.Volume, error) {
+	mine := *vol
+	mine.Attachments = nil
+	for _, att := range vol.Attachments {
+		if d.isAttachedHere(att) {
+			mine.Attachments = append(mine.Attachments, att)
+		}
+	}
+
+	if len(mine.Attachments) > 0 {
+		logger.Warn("Volume stuck in 'attaching' state, deleting its attachments to this host")
+		if _, err := d.detachVolume(logger.Context, &mine); err != nil {
+			logger.WithError(err).Warn("Error deleting attachments of volume stuck in 'attaching' state")
+		}
+	}
+	recovered, err := d.waitOnVolumeStateFor(logger.Context, vol, "available", d.config.detachTimeout())
+	if err == nil {
+		return recovered, nil
+	}
+
+	if vol, err = volumes.Get(d.block(logger.Context), vol.ID).Extract(); err != nil || vol.Status != "attaching" {
+		return vol, err
+	}
+	others := 0
+	for _, att := range vol.Attachments {
+		if !d.isAttachedHere(att) {
+			others++
+		}
+	}
+	stuckFor := time.Since(vol.UpdatedAt)
+	if !d.config.ResetErrorState || others > 0 || vol.UpdatedAt.IsZero() || stuckFor < time.Duration(d.config.TimeoutAttaching)*time.Second {
+		return nil, fmt.Errorf("Volume %s is stuck in 'attaching' state: check 'openstack volume show %s', and reset it with 'openstack volume set --state available --detached %s'", vol.Name, vol.ID, vol.ID)
+	}
+
+	logger.Warnf("Volume in 'attaching' state for %s, resetting it to 'available'", stuckFor.Round(time.Second))
+	if err = forceDetach(d.block(logger.Context), vol); err != nil {
+		logger.WithError(err).Warn("Error force-detaching volume stuck in 'attaching' state")
+	}
+	if err = resetStatus(d.block(logger.Context), vol.ID, "available"); err != nil {
+		return nil, fmt.Errorf("Volume %s is stuck in 'attaching' state, and resetting it failed: %w", vol.Name, err)
+	}
+	return volumes.Get(d.block(logger.Context), vol.ID).Extract()
+}
+
+// Wait for a detached volume to become 'available'. A detach that never completes
+// (i.e. the instance it was attached to crashed) is forced after timeoutDetaching:
+// through Nova first, then on the Cinder side
+func (d plugin) waitDetached(logger *log.Entry, vol *volumes.Volume) (*volumes.Volume, error) {
+	if d.config.TimeoutDetaching <= 0 {
+		return d.waitOnVolumeStateFor(logger.Context, vol, "available", d.config.detachTimeout())
+	}
+
+	detached, err := d.waitOnVolumeStateFor(logger.Context, vol, "available", d.config.TimeoutDetaching)
+	if err == nil {
+		return detached, nil
+	}
+	if vol, err = volumes.Get(d.block(logger.Context), vol.ID).Extract(); err != nil {
+		return nil, err
+	}
+	if vol.Status != "detaching" {
+		return d.waitOnVolumeStateFor(logger.Context, vol, "available", d.config.detachTimeout())
+	}
+
+	logger.Warnf("Volume stuck in 'detaching' state for %ds, forcing detach", d.config.TimeoutDetaching)
+	for _, att := range vol.Attachments {
+		if att.ServerID == "" || d.computeClient == nil {
+			continue
+		}
+		if err = volumeattach.Delete(d.compute(logger.Context), att.ServerID, att.ID).ExtractErr(); err != nil {
+			logger.WithError(err).WithField("server", att.ServerID).Debug("Error deleting attachment through Nova")
+		}
+	}
+	if detached, err = d.waitOnVolumeStateFor(logger.Context, vol, "available", d.config.detachTimeout()); err == nil {
+		return detached, nil
+	}
+
+	if vol, err = volumes.Get(d.block(logger.Context), vol.ID).Extract(); err != nil {
+		return nil, err
+	}
+	if err = forceDetach(d.block(logger.Context), vol); err != nil {
+		return nil, fmt.Errorf("Volume %s is stuck in 'detaching' state, and force-detaching it failed (admin rights required?): %w, check 'openstack volume show %s'", vol.Name, err, vol.ID)
+	}
+	return d.waitOnVolumeStateFor(logger.Context, vol, "available", d.config.detachTimeout())
+}
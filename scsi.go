@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Time a device is waited for before the SCSI hosts are rescanned, then between rescans (0: never rescan)
+var scsiRescanDelay = 2 * time.Second
+
+// Wrap the find function of a device wait, to rescan the SCSI hosts while the device doesn't appear:
+// hot-plugged virtio-scsi disks and new LUNs of logged in iSCSI sessions are not always noticed by the kernel
+func withSCSIRescan(logger *log.Entry, find func() (string, error)) func() (string, error) {
+	if scsiRescanDelay <= 0 {
+		return find
+	}
+	next := time.Now().Add(scsiRescanDelay)
+	return func() (string, error) {
+		path, err := find()
+		if err != nil || path != "" || time.Now().Before(next) {
+			return path, err
+		}
+		logger.Debug("Device not found yet, rescanning SCSI hosts")
+		rescanSCSIHosts(logger)
+		next = time.Now().Add(scsiRescanDelay)
+		return find()
+	}
+}
+
+// Have every SCSI host scan all its channels, targets and LUNs
+func rescanSCSIHosts(logger *log.Entry) {
+	scans, err := filepath.Glob("/sys/class/scsi_host/*/scan")
+	if err != nil {
+		return
+	}
+	for _, scan := range scans {
+		if err = os.WriteFile(scan, []byte("- - -"), 0200); err != nil {
+			logger.WithError(err).Debugf("Error rescanning %s", filepath.Base(filepath.Dir(scan)))
+		}
+	}
+}
+
+// Flush and remove the SCSI device behind a device link, i.e. a LUN no longer exported to this host
+func removeSCSIDevice(path string) error {
+	realDev, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil
+	}
+	hostCommand("blockdev", "--flushbufs", realDev).Run()
+	return os.WriteFile(filepath.Join("/sys/block", filepath.Base(realDev), "device/delete"), []byte("1"), 0200)
+}
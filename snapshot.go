@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/snapshots"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/pagination"
+)
+
+// Removed volumes are renamed with this prefix while their snapshot is kept
+const trashPrefix = "docker-deleted-"
+
+// Should this volume be snapshotted before being removed?
+// The per-volume option (stored in metadata at creation) wins over config.
+func (d plugin) wantSnapshotBeforeDelete(vol *volumes.Volume) bool {
+	if metadataBool(vol, metaReadOnly, false) {
+		// temporary copy of a snapshot: nothing to keep
+		return false
+	}
+	return metadataBool(vol, metaSnapshotBeforeDelete, d.config.SnapshotBeforeDelete)
+}
+
+// Snapshot a volume, then hide it from Docker instead of deleting it.
+// Cinder refuses to delete volumes that still have snapshots, so the volume
+// is renamed and kept with its snapshot until the TTL expires.
+// Recover it by renaming it back, or by creating a new volume from the snapshot.
+func (d plugin) trashVolume(logger *log.Entry, vol *volumes.Volume) error {
+	expiresAt := time.Now().Add(time.Duration(d.config.SnapshotTTL) * time.Hour).UTC().Format(time.RFC3339)
+
+	logger.Debugf("Snapshotting volume before delete, expires at %s", expiresAt)
+	snap, err := d.takeSnapshot(logger, vol, snapshots.CreateOpts{
+		VolumeID:    vol.ID,
+		Name:        vol.Name,
+		Description: fmt.Sprintf("Taken by docker-plugin-cinder before removing volume %s", vol.Name),
+		Force:       true,
+		Metadata:    map[string]string{metaExpiresAt: expiresAt},
+	})
+	if err != nil {
+		return fmt.Errorf("Error creating snapshot before delete: %w", err)
+	}
+	logger.WithField("snapshot", snap.ID).Infof("Snapshot taken, volume kept until %s", expiresAt)
+
+	metadata := make(map[string]string)
+	for k, v := range vol.Metadata {
+		metadata[k] = v
+	}
+	metadata[metaExpiresAt] = expiresAt
+	metadata[metaDeletedName] = vol.Name
+
+	name := shortenName(fmt.Sprintf("%s%s-%.8s", trashPrefix, vol.Name, vol.ID), maxCinderNameLength)
+	_, err = volumes.Update(d.block(logger.Context), vol.ID, volumes.UpdateOpts{
+		Name:     &name,
+		Metadata: metadata,
+	}).Extract()
+	if err != nil {
+		return fmt.Errorf("Error renaming volume to %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// Take a Cinder snapshot of a volume.
+// When the volume is mounted on this host, its filesystem is frozen until the
+// snapshot is available, so the snapshot is filesystem-consistent.
+// The filesystem is thawed after timeoutFreeze seconds whatever happens.
+func (d plugin) takeSnapshot(logger *log.Entry, vol *volumes.Volume, opts snapshots.CreateOpts) (*snapshots.Snapshot, error) {
+	path := d.mountPath(d.volumeName(vol), vol)
+
+	mounted, _ := isMounted(path)
+	if mounted {
+		logger.Debugf("Freezing filesystem %s", path)
+		if err := fsFreeze(path); err != nil {
+			return nil, err
+		}
+
+		var once sync.Once
+		thaw := func() {
+			once.Do(func() {
+				logger.Debugf("Thawing filesystem %s", path)
+				if err := fsThaw(path); err != nil {
+					logger.WithError(err).Errorf("Error thawing filesystem %s", path)
+				}
+			})
+		}
+		// never leave a frozen filesystem behind
+		guard := time.AfterFunc(time.Duration(d.config.TimeoutFreeze)*time.Second, func() {
+			logger.Warnf("Snapshot still not available after %ds, thawing filesystem", d.config.TimeoutFreeze)
+			thaw()
+		})
+		defer guard.Stop()
+		defer thaw()
+	}
+
+	snap, err := snapshots.Create(d.block(logger.Context), opts).Extract()
+	if err != nil || !mounted {
+		return snap, err
+	}
+
+	return d.waitOnSnapshotState(logger.Context, snap, "available", d.config.TimeoutFreeze)
+}
+
+func (d plugin) waitOnSnapshotState(ctx context.Context, snap *snapshots.Snapshot, status string, timeout int) (*snapshots.Snapshot, error) {
+	for i := 0; i <= timeout; i++ {
+		if snap.Status == status {
+			return snap, nil
+		}
+		if strings.HasPrefix(snap.Status, "error") {
+			return nil, fmt.Errorf("Snapshot %s status became %s", snap.ID, snap.Status)
+		}
+
+		time.Sleep(1 * time.Second)
+
+		s, err := snapshots.Get(d.block(ctx), snap.ID).Extract()
+		if err != nil {
+			return nil, err
+		}
+		snap = s
+	}
+
+	return nil, fmt.Errorf("Snapshot %s did not become %s, still %s", snap.ID, status, snap.Status)
+}
+
+func isTrashed(vol *volumes.Volume) bool {
+	_, ok := vol.Metadata[metaExpiresAt]
+	return ok && strings.HasPrefix(vol.Name, trashPrefix)
+}
+
+// Purge expired volumes at startup, then every trashPurgeInterval,
+// so that the trash of a quiet host, where no volume is removed, is emptied too
+func (d plugin) purgeTrash() {
+	d.purgeExpiredVolumes()
+	if d.config.TrashPurgeInterval <= 0 {
+		return
+	}
+	for {
+		time.Sleep(time.Duration(d.config.TrashPurgeInterval) * time.Second)
+		d.purgeExpiredVolumes()
+	}
+}
+
+// Delete removed volumes (and their snapshots) whose TTL expired
+func (d plugin) purgeExpiredVolumes() {
+	logger := log.WithContext(context.Background()).WithFields(log.Fields{"action": "purgeExpiredVolumes"})
+
+	var expired []volumes.Volume
+
+	pager := volumes.List(d.block(logger.Context), volumes.ListOpts{})
+	err := pager.EachPage(func(page pagination.Page) (bool, error) {
+		vList, err := volumes.ExtractVolumes(page)
+		if err != nil {
+			return false, err
+		}
+
+		for _, v := range vList {
+			if !isTrashed(&v) {
+				continue
+			}
+			expiresAt, err := time.Parse(time.RFC3339, v.Metadata[metaExpiresAt])
+			if err != nil {
+				logger.WithError(err).Warnf("Invalid expiry date on volume %s", v.Name)
+				continue
+			}
+			if time.Now().After(expiresAt) {
+				expired = append(expired, v)
+			}
+		}
+
+		return true, nil
+	})
+	if err != nil {
+		logger.WithError(err).Error("Error listing volumes")
+		return
+	}
+
+	for _, v := range expired {
+		logger.WithField("id", v.ID).Infof("Snapshot TTL expired, deleting volume %s", v.Name)
+		err := volumes.Delete(d.block(logger.Context), v.ID, volumes.DeleteOpts{Cascade: true}).ExtractErr()
+		if err != nil {
+			logger.WithError(err).Errorf("Error deleting expired volume %s", v.Name)
+			continue
+		}
+		d.releaseDetachedHeader(logger.WithField("id", v.ID), &v)
+	}
+}
+
+// Find a snapshot by ID or name
+func (d plugin) getSnapshot(ctx context.Context, ref string) (*snapshots.Snapshot, error) {
+	if uuidRegex.MatchString(ref) {
+		return snapshots.Get(d.block(ctx), ref).Extract()
+	}
+
+	var found []snapshots.Snapshot
+	pager := snapshots.List(d.block(ctx), snapshots.ListOpts{Name: ref})
+	err := pager.EachPage(func(page pagination.Page) (bool, error) {
+		sList, err := snapshots.ExtractSnapshots(page)
+		if err != nil {
+			return false, err
+		}
+		for _, s := range sList {
+			if s.Name == ref {
+				found = append(found, s)
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(found) != 1 {
+		return nil, fmt.Errorf("Found %d snapshots named %s", len(found), ref)
+	}
+	return &found[0], nil
+}
+
+// Metadata a volume created from a snapshot inherits from the snapshot's volume:
+// how to decrypt and mount it
+func inheritedMetadata(source *volumes.Volume) map[string]string {
+	metadata := make(map[string]string)
+	for _, key := range []string{metaEncryption, metaKeySecret, metaKeyID, metaKeyDerivation, metaRaw, metaFilesystem, metaMountOptions, metaSubDir, metaDetachedHeader, metaFscrypt} {
+		if value, ok := source.Metadata[key]; ok {
+			metadata[key] = value
+		}
+	}
+	// the copy's key is derived like the source's, not from its own ID
+	if _, ok := metadata[metaKeyDerivation]; ok {
+		metadata[metaKeyDerivationID] = keyDerivationID(source)
+	}
+	return metadata
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Create the plugin socket: <socketDir>/<socketName>.sock, owned by socketGroup with socketMode
+func newUnixSocket(config *tConfig) (net.Listener, error) {
+	path := config.socketPath()
+
+	mode, err := strconv.ParseUint(config.SocketMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid socketMode %s: %w", config.SocketMode, err)
+	}
+
+	gid := -1
+	if config.SocketGroup != "" {
+		if gid, err = lookupGroup(config.SocketGroup); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err = syscall.Unlink(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// nobody can connect before permissions are set
+	mask := syscall.Umask(0777)
+	l, err := net.Listen("unix", path)
+	syscall.Umask(mask)
+	if err != nil {
+		return nil, err
+	}
+
+	if gid >= 0 {
+		if err = os.Chown(path, -1, gid); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	if err = os.Chmod(path, os.FileMode(mode)); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{"path": path, "mode": config.SocketMode, "group": config.SocketGroup}).Debug("Listening")
+	return l, nil
+}
+
+// Group ID from a group name or number
+func lookupGroup(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// Plugin socket path: socketName may be a full path
+func (c *tConfig) socketPath() string {
+	if filepath.IsAbs(c.SocketName) {
+		return c.SocketName
+	}
+	return filepath.Join(c.SocketDir, c.SocketName+".sock")
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	volumesBucket = []byte("volumes")
+	// volumes being completed in the background
+	creatingBucket = []byte("creating")
+)
+
+// What the plugin did with a volume on this host
+type volumeState struct {
+	VolumeID string `json:"volumeId"`
+	// attached block device, i.e. /dev/disk/by-id/virtio-...
+	Device string `json:"device"`
+	// device-mapper name, when encrypted
+	LuksName string `json:"luksName,omitempty"`
+	// where the volume is mounted (or its raw device node created),
+	// and the mountpoint given to Docker
+	Path       string `json:"path"`
+	Mountpoint string `json:"mountpoint"`
+	Raw        bool   `json:"raw,omitempty"`
+	// mount IDs using it
+	Refs      []string  `json:"refs"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Local state of the volumes in use on this host, persisted across plugin restarts.
+// A nil store keeps nothing.
+type stateStore struct {
+	db *bolt.DB
+}
+
+func openStateStore(path string) (*stateStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{volumesBucket, creatingBucket, statsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &stateStore{db: db}, nil
+}
+
+func (s *stateStore) get(name string) (*volumeState, error) {
+	if s == nil {
+		return nil, nil
+	}
+
+	var state *volumeState
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(volumesBucket).Get([]byte(name))
+		if data == nil {
+			return nil
+		}
+		state = &volumeState{}
+		return json.Unmarshal(data, state)
+	})
+	return state, err
+}
+
+func (s *stateStore) put(name string, state *volumeState) error {
+	if s == nil {
+		return nil
+	}
+
+	state.UpdatedAt = time.Now().UTC()
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(volumesBucket).Put([]byte(name), data)
+	})
+}
+
+func (s *stateStore) delete(name string) error {
+	if s == nil {
+		return nil
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(volumesBucket).Delete([]byte(name))
+	})
+}
+
+func (s *stateStore) all() (map[string]*volumeState, error) {
+	states := make(map[string]*volumeState)
+	if s == nil {
+		return states, nil
+	}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(volumesBucket).ForEach(func(name, data []byte) error {
+			state := &volumeState{}
+			if err := json.Unmarshal(data, state); err != nil {
+				return err
+			}
+			states[string(name)] = state
+			return nil
+		})
+	})
+	return states, err
+}
+
+// Record a volume mounted by a container. Caller must hold the mutex.
+func (d plugin) recordMount(name string, id string, state *volumeState) {
+	d.mounts[name] = map[string]bool{id: true}
+	d.mountpoints[name] = state.Mountpoint
+
+	state.Refs = []string{id}
+	if err := d.state.put(name, state); err != nil {
+		log.WithError(err).WithField("name", name).Error("Error saving volume state")
+	}
+}
+
+// Save the containers using a volume after they changed. Caller must hold the mutex.
+func (d plugin) saveRefs(name string) {
+	state, err := d.state.get(name)
+	if err != nil || state == nil {
+		return
+	}
+
+	state.Refs = make([]string, 0, len(d.mounts[name]))
+	for id := range d.mounts[name] {
+		state.Refs = append(state.Refs, id)
+	}
+	if err = d.state.put(name, state); err != nil {
+		log.WithError(err).WithField("name", name).Error("Error saving volume state")
+	}
+}
+
+// Restore the volumes in use recorded by a previous run of the plugin
+func (d *plugin) loadState() error {
+	states, err := d.state.all()
+	if err != nil {
+		return err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for name, state := range states {
+		if len(state.Refs) == 0 {
+			continue
+		}
+		d.mounts[name] = make(map[string]bool)
+		for _, id := range state.Refs {
+			d.mounts[name][id] = true
+		}
+		d.mountpoints[name] = state.Mountpoint
+		log.WithFields(log.Fields{"name": name, "mounts": len(state.Refs)}).Debug("Restored volume state")
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// volume name -> its stats
+var statsBucket = []byte("stats")
+
+// What happened to a volume on this host, kept across mounts until it is removed,
+// shown in docker volume inspect for troubleshooting
+type volumeStats struct {
+	Mounts      int        `json:"mounts"`
+	LastMount   *time.Time `json:"lastMount,omitempty"`
+	LastUnmount *time.Time `json:"lastUnmount,omitempty"`
+	// last failed operation, i.e. "mount: Volume ... did not become in-use"
+	LastError   string     `json:"lastError,omitempty"`
+	LastErrorAt *time.Time `json:"lastErrorAt,omitempty"`
+	// total time spent attaching the volume and waiting for its device
+	AttachWait float64 `json:"attachWaitSeconds"`
+}
+
+func (s *stateStore) getStats(name string) (*volumeStats, error) {
+	if s == nil {
+		return nil, nil
+	}
+
+	var stats *volumeStats
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(statsBucket).Get([]byte(name))
+		if data == nil {
+			return nil
+		}
+		stats = &volumeStats{}
+		return json.Unmarshal(data, stats)
+	})
+	return stats, err
+}
+
+// Change the stats of a volume in a single transaction
+func (s *stateStore) updateStats(name string, update func(stats *volumeStats)) error {
+	if s == nil {
+		return nil
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(statsBucket)
+		stats := &volumeStats{}
+		if data := bucket.Get([]byte(name)); data != nil {
+			if err := json.Unmarshal(data, stats); err != nil {
+				return err
+			}
+		}
+		update(stats)
+		data, err := json.Marshal(stats)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(name), data)
+	})
+}
+
+func (s *stateStore) deleteStats(name string) error {
+	if s == nil {
+		return nil
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(statsBucket).Delete([]byte(name))
+	})
+}
+
+// Count an operation on a volume in its stats: errors, mounts and unmounts.
+// Removed volumes lose their stats, and volumes not found get none.
+func (d plugin) recordOp(name string, action string, err error) {
+	if errors.Is(err, errNotFound) {
+		return
+	}
+
+	if action == "remove" && err == nil {
+		err = d.state.deleteStats(name)
+	} else {
+		now := time.Now().UTC()
+		err = d.state.updateStats(name, func(stats *volumeStats) {
+			switch {
+			case err != nil:
+				stats.LastError = fmt.Sprintf("%s: %s", action, err.Error())
+				stats.LastErrorAt = &now
+			case action == "mount":
+				stats.Mounts++
+				stats.LastMount = &now
+			case action == "unmount":
+				stats.LastUnmount = &now
+			}
+		})
+	}
+	if err != nil {
+		log.WithError(err).WithField("name", name).Error("Error saving volume stats")
+	}
+}
+
+// Add the time an attach took to the stats of a volume
+func (d plugin) recordAttachWait(name string, wait time.Duration) {
+	err := d.state.updateStats(name, func(stats *volumeStats) {
+		stats.AttachWait += wait.Seconds()
+	})
+	if err != nil {
+		log.WithError(err).WithField("name", name).Error("Error saving volume stats")
+	}
+}
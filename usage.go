@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+	log "github.com/sirupsen/logrus"
+)
+
+// Names of the servers volumes are attached to, looked up once
+type serverNameCache struct {
+	mutex sync.Mutex
+	// server ID -> name
+	names map[string]string
+}
+
+func newServerNameCache() *serverNameCache {
+	return &serverNameCache{names: make(map[string]string)}
+}
+
+// Name of a server, or its ID when it can't be looked up
+func (d plugin) serverName(id string) string {
+	d.serverNames.mutex.Lock()
+	name, ok := d.serverNames.names[id]
+	d.serverNames.mutex.Unlock()
+	if ok {
+		return name
+	}
+
+	if d.computeClient == nil {
+		return id
+	}
+	server, err := servers.Get(d.computeClient, id).Extract()
+	if err != nil {
+		log.WithError(err).WithField("server", id).Debug("Error looking up server name")
+		return id
+	}
+
+	d.serverNames.mutex.Lock()
+	d.serverNames.names[id] = server.Name
+	d.serverNames.mutex.Unlock()
+	return server.Name
+}
+
+// Who is using a volume: the servers (or hosts, without Nova) it is attached to,
+// and the containers using it on this host
+func (d plugin) usageStatus(name string, vol *volumes.Volume, status map[string]interface{}) {
+	attachedTo := make([]string, 0, len(vol.Attachments))
+	for _, att := range vol.Attachments {
+		if att.ServerID == "" {
+			attachedTo = append(attachedTo, att.HostName)
+		} else {
+			attachedTo = append(attachedTo, d.serverName(att.ServerID))
+		}
+	}
+	if len(attachedTo) > 0 {
+		status["attachedTo"] = attachedTo
+	}
+
+	d.mutex.Lock()
+	mounts := len(d.mounts[name])
+	d.mutex.Unlock()
+	status["mountedHere"] = mounts > 0
+	if mounts > 0 {
+		status["mounts"] = mounts
+	}
+}
+
+// Where a volume is: its availability zone, and its Cinder backend (host@backend#pool),
+// only visible with admin rights
+func (d plugin) topologyStatus(vol *listedVolume, status map[string]interface{}) {
+	if vol.AvailabilityZone != "" {
+		status["availabilityZone"] = vol.AvailabilityZone
+	}
+	if vol.Host != "" {
+		status["backend"] = vol.Host
+	}
+}
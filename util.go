@@ -1,23 +1,32 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 	"bufio"
 	"syscall"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/gophercloud/gophercloud"
 	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
 	"github.com/gophercloud/gophercloud/openstack/compute/v2/extensions/volumeattach"
 
 )
 
 func getFilesystemType(dev string) (string, error) {
-	out, err := exec.Command("blkid", "-s", "TYPE", "-o", "value", dev).CombinedOutput()
+	// probe the device: the blkid cache remembers the filesystem of the previous volume with the same device name
+	out, err := hostCommand("blkid", "-p", "-s", "TYPE", "-o", "value", dev).CombinedOutput()
 
 	if err != nil {
 		if len(out) == 0 {
@@ -27,7 +36,7 @@ func getFilesystemType(dev string) (string, error) {
 		return "", errors.New(string(out))
 	}
 
-	return string(out), nil
+	return strings.TrimSpace(string(out)), nil
 }
 
 // Retrieves info for a LUKS-encrypted volume
@@ -41,42 +50,15 @@ func getFilesystemType(dev string) (string, error) {
 // When the volume is not LUKS, returns empty values.
 // if "error" contains something, that's a real error !
 func getLuksInfo(mountPath string) (string, string, string, error) {
-	mountDevice := ""
-	baseDevice := ""
-
 	logger := log.WithFields(log.Fields{"mountPath": mountPath, "action": "getLuksInfo"})
 
-	// /proc/mounts lists all current mounts
-	procsMount := "/proc/mounts"
-
-	// Open list of current mounts
-	f, err := os.Open(procsMount)
+	mountDevice, err := getMountDevice(mountPath)
 	if err != nil {
-		return "", "", "", errors.New(fmt.Sprintf("Failed opening %s - %s", procsMount, err))
-	}
-	defer func() {
-		if err = f.Close(); err != nil {
-			os.Exit(1)
-		}
-	}()
-
-	// read line by line
-	// format: [device] [mountpath] [other info we don't care about]
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		testArray := strings.Fields(scanner.Text())
-		if testArray[1] == mountPath {
-			// mount found !
-			mountDevice = testArray[0]
-		}
-	}
-	if err := scanner.Err(); err != nil {
-		fmt.Fprintln(os.Stderr, "error:", err)
-		return "", "", "", errors.New(fmt.Sprintf("Error scanning %s contents: %s", procsMount, err))
+		return "", "", "", err
 	}
 	// fail if no mount found
 	if mountDevice == "" {
-		return "", "", "", errors.New(fmt.Sprintf("mount %s not found in %s", mountPath, procsMount))
+		return "", "", "", errors.New(fmt.Sprintf("mount %s not found in %s", mountPath, procMounts()))
 	}
 
 	// device should start with /dev/mapper - keep the part that is after
@@ -87,38 +69,142 @@ func getLuksInfo(mountPath string) (string, string, string, error) {
 	}
 	luksName := strings.TrimPrefix(mountDevice, "/dev/mapper/")
 
+	baseDevice, err := getLuksBaseDevice(luksName)
+	if err != nil {
+		return "", "", "", err
+	}
+	// fail if no device found
+	if baseDevice == "" {
+		logger.Debugf("No \"Device:\" line found in cryptsetup output - probably not a LUKS device")
+		// again, not an error to not be LUKS
+		return "", "", "", nil
+	}
+
+	// All went well, here is the retrieved info
+	logger.Debugf("Mount found for '%s' - device '%s' - luks name '%s' - base device '%s'", mountPath, mountDevice, luksName, baseDevice)
+	return mountDevice, luksName, baseDevice, nil
+}
+
+// Returns the base block device of an opened LUKS device (i.e. /dev/sdb),
+// or an empty string when cryptsetup does not report any.
+func getLuksBaseDevice(luksName string) (string, error) {
+	baseDevice := ""
+
 	// status shows us the base block device path
-	cryptStatusOut, err := exec.Command("cryptsetup", "status", luksName).CombinedOutput()
+	cryptStatusOut, err := hostCommand("cryptsetup", "status", luksName).CombinedOutput()
 	if err != nil {
-		return "", "", "", errors.New(fmt.Sprintf("Error executing cryptsetup - %s", err))
+		return "", fmt.Errorf("Error executing cryptsetup - %w", err)
 	}
 	// read line by line, look for "device:"
-	scanner = bufio.NewScanner(strings.NewReader(string(cryptStatusOut,)))
+	scanner := bufio.NewScanner(strings.NewReader(string(cryptStatusOut,)))
 	for scanner.Scan() {
 		testArray := strings.Fields(scanner.Text())
-		if testArray[0] == "device:" {
+		if len(testArray) > 1 && testArray[0] == "device:" {
 			baseDevice = testArray[1]
 		}
 	}
 	if err := scanner.Err(); err != nil {
-		return "", "", "", errors.New("Error scanning cryptsetup output")
+		return "", errors.New("Error scanning cryptsetup output")
 	}
-	// fail if no device found
-	if baseDevice == "" {
-		logger.Debugf("No \"Device:\" line found in cryptsetup output - probably not a LUKS device")
-		// again, not an error to not be LUKS
-		return "", "", "", nil
+
+	return baseDevice, nil
+}
+
+// /proc/mounts lists all current mounts, in the mount namespace of volumes
+func procMounts() string {
+	return filepath.Join(procDir(), "mounts")
+}
+
+// Returns the device mounted on mountPath,
+// or an empty string when nothing is mounted there.
+func getMountDevice(mountPath string) (string, error) {
+	mountDevice := ""
+
+	// Open list of current mounts
+	f, err := os.Open(procMounts())
+	if err != nil {
+		return "", fmt.Errorf("Failed opening %s - %w", procMounts(), err)
 	}
+	defer f.Close()
 
-	// All went well, here is the retrieved info
-	logger.Debugf("Mount found for '%s' - device '%s' - luks name '%s' - base device '%s'", mountPath, mountDevice, luksName, baseDevice)
-	return mountDevice, luksName, baseDevice, nil
+	// read line by line
+	// format: [device] [mountpath] [other info we don't care about]
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		testArray := strings.Fields(scanner.Text())
+		if len(testArray) > 1 && testArray[1] == mountPath {
+			// mount found !
+			mountDevice = testArray[0]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("Error scanning %s contents: %w", procMounts(), err)
+	}
+
+	return mountDevice, nil
+}
+
+func isMounted(mountPath string) (bool, error) {
+	mountDevice, err := getMountDevice(mountPath)
+	return mountDevice != "", err
+}
+
+// Mountpoints under mountPath (not itself), deepest first
+func getSubmounts(mountPath string) ([]string, error) {
+	f, err := os.Open(filepath.Join(procDir(), "mountinfo"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var submounts []string
+	prefix := strings.TrimSuffix(mountPath, "/") + "/"
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// format: [id] [parent] [major:minor] [root] [mountpoint] ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		// spaces and such are octal-escaped, i.e. \040
+		mp, err := strconv.Unquote(`"` + fields[4] + `"`)
+		if err != nil {
+			mp = fields[4]
+		}
+		if strings.HasPrefix(mp, prefix) {
+			submounts = append(submounts, mp)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(submounts, func(i, j int) bool {
+		return strings.Count(submounts[i], "/") > strings.Count(submounts[j], "/")
+	})
+	return submounts, nil
+}
+
+// Unmount what containers or other processes mounted under mountPath, deepest first,
+// so that mountPath itself can be unmounted
+func unmountSubmounts(logger *log.Entry, mountPath string) error {
+	submounts, err := getSubmounts(mountPath)
+	if err != nil {
+		return err
+	}
+	for _, mp := range submounts {
+		logger.Infof("Unmounting submount %s", mp)
+		if err = unmount(mp); err != nil && err != syscall.EINVAL {
+			return fmt.Errorf("Unmount of submount %s failed: %w", mp, err)
+		}
+	}
+	return nil
 }
 
 func isLuks(dev string) (status bool, err error) {
 	logger := log.WithFields(log.Fields{"dev": dev, "action": "isLuks"})
 
-	execOut, err := exec.Command("cryptsetup", "isLuks", dev).CombinedOutput()
+	execOut, err := hostCommand("cryptsetup", "isLuks", dev).CombinedOutput()
 	if err != nil {
 		if len(execOut) > 0 {
 			logger.Errorf("isLuks command failed - %s", execOut)
@@ -128,11 +214,73 @@ func isLuks(dev string) (status bool, err error) {
 	return true, err
 }
 
-func luksOpen(devName string, keyfile string, volumeName string) (luksName string, err error) {
+// Name length limits
+const (
+	maxCinderNameLength = 255
+	maxFileNameLength   = 255
+	// device-mapper names are 128 bytes, including the final NUL
+	maxMapperNameLength = 127
+)
+
+// Shorten a name to max characters, deterministically:
+// long names are truncated and suffixed with a hash of the full name,
+// so long names sharing a prefix still get different short names.
+// Short limits (i.e. xfs labels) get a shorter hash, to keep more of the name.
+func shortenName(name string, max int) string {
+	if len(name) <= max {
+		return name
+	}
+	hashLength := 8
+	if max < 32 {
+		hashLength = 4
+	}
+	sum := sha256.Sum256([]byte(name))
+	suffix := "-" + hex.EncodeToString(sum[:])[:hashLength]
+	return name[:max-len(suffix)] + suffix
+}
+
+// Filesystem label of a volume, at most max characters. Names too long are shortened from
+// their last part, the volume's own name in Compose names (<project>_<volume>).
+func volumeLabel(name string, max int) string {
+	if len(name) <= max {
+		return name
+	}
+	if i := strings.LastIndex(name, "_"); i >= 0 && i < len(name)-1 {
+		sum := sha256.Sum256([]byte(name))
+		suffix := "-" + hex.EncodeToString(sum[:])[:4]
+		base := name[i+1:]
+		if len(base) > max-len(suffix) {
+			base = base[:max-len(suffix)]
+		}
+		return base + suffix
+	}
+	return shortenName(name, max)
+}
+
+// Name of the device-mapper device of an opened LUKS volume
+func luksMapperName(volumeName string) string {
+	return shortenName(volumeName, maxMapperNameLength-len("_luks"))+"_luks"
+}
+
+func luksOpen(devName string, keyfile string, header string, volumeName string, readOnly bool, discard bool) (luksName string, err error) {
 	logger := log.WithFields(log.Fields{"dev": devName, "key": keyfile, "action": "luksOpen"})
 
-	luksName = volumeName+"_luks"
-	cmd := exec.Command("cryptsetup", "luksOpen", "-d", keyfile, devName, luksName )
+	luksName = luksMapperName(volumeName)
+	keys := &keyFiles{}
+	defer keys.close()
+	key, err := keys.path(keyfile)
+	if err != nil {
+		return "", err
+	}
+	args := append([]string{"luksOpen", "-d", key}, headerArgs(header)...)
+	if readOnly {
+		args = append(args, "--readonly")
+	}
+	// let TRIM through to the backend, at the cost of revealing free blocks
+	if discard {
+		args = append(args, "--allow-discards")
+	}
+	cmd := keys.attach(hostCommand("cryptsetup", append(args, devName, luksName)...))
 
 	execOut, err := cmd.CombinedOutput()
 	if err != nil {
@@ -145,10 +293,23 @@ func luksOpen(devName string, keyfile string, volumeName string) (luksName strin
 	return luksName, err
 }
 
-func luksFormat(devName string, keyfile string) (error) {
+func luksFormat(ctx context.Context, devName string, keyfile string, header string, luksType string) (error) {
 	logger := log.WithFields(log.Fields{"dev": devName, "key": keyfile, "action": "luksOpen"})
 
-	cmd := exec.Command("cryptsetup", "luksFormat", "-q" ,"-d", keyfile, devName )
+	keys := &keyFiles{}
+	defer keys.close()
+	key, err := keys.path(keyfile)
+	if err != nil {
+		return err
+	}
+	args := append([]string{"luksFormat", "-q", "-d", key}, headerArgs(header)...)
+	if luksType != "" {
+		args = append(args, "--type", luksType)
+	}
+	if fipsMode {
+		args = append(args, fipsLuksArgs...)
+	}
+	cmd := keys.attach(hostCommandContext(ctx, "cryptsetup", append(args, devName)...))
 
 	execOut, err := cmd.CombinedOutput()
 	if err != nil {
@@ -167,119 +328,527 @@ func luksFormat(devName string, keyfile string) (error) {
 // * volume name
 // Output:
 // * device name
+// * volume
 // * error
-func attachVolume(d *plugin, volumeName string) (string, error) {
+func attachVolume(ctx context.Context, d *plugin, volumeName string) (string, *volumes.Volume, error) {
 
-	logger := log.WithFields(log.Fields{"name": volumeName, "action": "attachVolume"})
+	logger := log.WithContext(ctx).WithFields(log.Fields{"name": volumeName, "action": "attachVolume"})
 	logger.Infof("Attaching volume '%s' ...", volumeName)
 
-	vol, err := d.getByName(volumeName)
+	vol, err := d.getByName(ctx, volumeName)
 	if err != nil {
 		logger.WithError(err).Errorf("Error retrieving volume: %s", err.Error())
-		return "", err
+		return "", nil, err
 	}
 
 	logger = logger.WithField("id", vol.ID)
+	d.watchdog.identify(volumeName, vol.ID)
 
-	if vol.Status == "creating" || vol.Status == "detaching" {
+	if vol.Status == "creating" {
 		logger.Infof("Volume is in '%s' state, wait for 'available'...", vol.Status)
+		d.watchdog.step(volumeName, "waiting available")
 		if vol, err = d.waitOnVolumeState(logger.Context, vol, "available"); err != nil {
 			logger.Error(err.Error())
-			return "", err
+			return "", nil, err
 		}
 	}
 
-	if vol, err = volumes.Get(d.blockClient, vol.ID).Extract(); err != nil {
-		return "", err
+	if vol.Status == "detaching" {
+		logger.Infof("Volume is in '%s' state, wait for 'available'...", vol.Status)
+		d.watchdog.step(volumeName, "waiting detached")
+		if vol, err = d.waitDetached(logger, vol); err != nil {
+			logger.Error(err.Error())
+			return "", nil, err
+		}
 	}
 
+	if vol, err = volumes.Get(d.block(ctx), vol.ID).Extract(); err != nil {
+		return "", nil, err
+	}
+
+	if vol, err = d.recoverVolumeState(logger, vol); err != nil {
+		logger.Error(err.Error())
+		return "", nil, err
+	}
+
+	// after a plugin restart, the volume may still be attached here: reuse it
+	var dev string
+	if len(vol.Attachments) == 1 && d.isAttachedHere(vol.Attachments[0]) && vol.Status == "in-use" {
+		logger.Debug("Volume already attached to this machine, looking for its device")
+		d.watchdog.step(volumeName, "waiting device")
+		if d.local != nil {
+			dev, err = d.localReconnect(logger, vol, vol.Attachments[0])
+		} else {
+			dev, err = d.waitForVolumeDevice(logger, vol, vol.Attachments[0].Device, 0)
+		}
+		if err != nil {
+			logger.WithError(err).Warn("Device of existing attachment not found, attaching again")
+			dev = ""
+		}
+	}
+
+	if dev == "" {
+		var attached *volumes.Volume
+		dev, attached, err = d.attachToMachine(logger, vol)
+		// attach that never completed: clean it up and retry, attachRetries times
+		for retry := 0; err != nil && retry < d.config.AttachRetries; retry++ {
+			stuck, err2 := volumes.Get(d.block(ctx), vol.ID).Extract()
+			if err2 != nil || stuck.Status != "attaching" {
+				break
+			}
+			if stuck, err = d.resetStuckAttaching(logger, stuck); err != nil {
+				logger.Error(err.Error())
+				return "", nil, err
+			}
+			logger.Info("Volume reset after a stuck attach, attaching again")
+			dev, attached, err = d.attachToMachine(logger, stuck)
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		vol = attached
+	}
+
+	if tuning := d.config.deviceTuning(vol.VolumeType); len(tuning) > 0 {
+		if err = tuneDevice(dev, tuning); err != nil {
+			// not fatal, the device works with default settings
+			logger.WithError(err).Warn("Error tuning block device")
+		}
+	}
+
+	return dev, vol, nil
+}
+
+// Attach a volume to this machine, detaching it from others first,
+// and return its device
+func (d plugin) attachToMachine(logger *log.Entry, vol *volumes.Volume) (string, *volumes.Volume, error) {
+	var err error
+	name := d.volumeName(vol)
+
 	if len(vol.Attachments) > 0 {
 		logger.Debug("Volume already attached, detaching first")
+		d.watchdog.step(name, "detaching from other host")
 		if vol, err = d.detachVolume(logger.Context, vol); err != nil {
 			logger.WithError(err).Error("Error detaching volume")
-			return "", err
+			return "", nil, err
 		}
 
-		if vol, err = d.waitOnVolumeState(logger.Context, vol, "available"); err != nil {
+		if vol, err = d.waitDetached(logger, vol); err != nil {
 			logger.WithError(err).Error("Error detaching volume")
-			return "", err
+			return "", nil, err
 		}
 	}
 
 	if vol.Status != "available" {
 		logger.Debugf("Volume: %+v\n", vol)
 		logger.Errorf("Invalid volume state for mounting: %s", vol.Status)
-		return "", errors.New("Invalid Volume State")
+		return "", nil, errors.New("Invalid Volume State")
+	}
+
+	// read-only at the storage layer too, and visible to cloud admins
+	if metadataBool(vol, metaReadOnly, false) && !strings.EqualFold(vol.Metadata["readonly"], "true") {
+		if err = setReadOnlyFlag(d.block(logger.Context), vol.ID, true); err != nil {
+			logger.WithError(err).Warn("Error setting Cinder read-only flag, only the device is read-only")
+		}
+	}
+
+	d.watchdog.step(name, "attaching")
+	if d.local != nil {
+		logger.Debugf("Attaching volume %s to host %s with %s connector", vol.ID, d.hostname, d.config.Connector)
+		dev, err := d.localAttach(logger, vol)
+		if err != nil {
+			logger.WithError(err).Errorf("Error attaching volume: %s", err.Error())
+			return "", nil, err
+		}
+		return d.waitAttached(logger, vol, dev)
 	}
 
 	//
 	// Attaching block volume to compute instance
 
+	if vol, err = d.checkAvailabilityZone(logger, vol); err != nil {
+		logger.WithError(err).Error("Volume can't be attached here")
+		return "", nil, err
+	}
+
 	opts := volumeattach.CreateOpts{VolumeID: vol.ID}
-	logger.Debugf("Attaching volume %s to Machine %s", vol.ID, d.config.MachineID)
-	_, err = volumeattach.Create(d.computeClient, d.config.MachineID, opts).Extract()
+	logger.Debugf("Attaching volume %s to Machine %s", vol.ID, d.machineID())
+	attachment, err := volumeattach.Create(d.compute(logger.Context), d.machineID(), opts).Extract()
+	if _, notFound := err.(gophercloud.ErrDefault404); notFound && d.refreshMachineID(logger) {
+		// instance rebuilt or moved
+		attachment, err = volumeattach.Create(d.compute(logger.Context), d.machineID(), opts).Extract()
+	}
 
 	if err != nil {
 		logger.WithError(err).Errorf("Error attaching volume: %s", err.Error())
-		return "", err
+		return "", nil, err
 	}
 
 	//
 	// Waiting for device appearance
 
-	// ID is sometimes truncated in device filename
-	devid := fmt.Sprintf("%.20s", vol.ID)
-	devpath := "/dev/disk/by-id"
-	logger.WithField("devid", devid).Debug("Waiting for device to appear...")
-	dev, err := waitForDevice(devpath, devid, d.config.TimeoutDeviceWait)
+	d.watchdog.step(name, "waiting device")
+	dev, err := d.waitForVolumeDevice(logger, vol, attachment.Device, d.config.TimeoutDeviceWait)
 	time.Sleep(time.Duration(d.config.DelayDeviceWait) * time.Second)
-	logger.WithField("dev", dev).Debug("Device found")
+
+	if err != nil && d.refreshMachineID(logger) {
+		// attached to the server this machine was before: move it here
+		logger.Warnf("Volume attached to former machine ID %s, attaching again", attachment.ServerID)
+		if err = volumeattach.Delete(d.compute(logger.Context), attachment.ServerID, attachment.ID).ExtractErr(); err != nil {
+			logger.WithError(err).Error("Error detaching volume")
+			return "", nil, err
+		}
+		if vol, err = volumes.Get(d.block(logger.Context), vol.ID).Extract(); err != nil {
+			return "", nil, err
+		}
+		if vol, err = d.waitOnVolumeStateFor(logger.Context, vol, "available", d.config.detachTimeout()); err != nil {
+			logger.WithError(err).Error("Error detaching volume")
+			return "", nil, err
+		}
+		return d.attachToMachine(logger, vol)
+	}
 
 	if err != nil {
 		logger.WithError(err).Error("Expected block device not found")
+		return "", nil, err
+	}
+
+	return d.waitAttached(logger, vol, dev)
+}
+
+// Wait for an attached volume to become in-use, timeoutAttach: its device may show up
+// before Nova (or the connector) completes the attach in Cinder
+func (d plugin) waitAttached(logger *log.Entry, vol *volumes.Volume, dev string) (string, *volumes.Volume, error) {
+	d.watchdog.step(d.volumeName(vol), "waiting in-use")
+	attached, err := d.waitOnVolumeStateFor(logger.Context, vol, "in-use", d.config.attachTimeout())
+	if err != nil {
+		logger.WithError(err).Error("Error waiting for volume to be in-use")
+		return "", nil, err
+	}
+	return dev, attached, nil
+}
+
+// Wait for the device of an attached volume.
+// Device reported by Nova, used when its serial (or WWN) proves it right:
+// the guest may name devices differently.
+// Else, ID is truncated in device filenames (deviceIDLength characters), or the disk only has the volume's WWN
+func (d plugin) waitForVolumeDevice(logger *log.Entry, vol *volumes.Volume, reported string, timeout int) (string, error) {
+	devid := fmt.Sprintf("%.*s", d.config.DeviceIDLength, vol.ID)
+	devpath := "/dev/disk/by-id"
+	wwn := d.attachmentWWN(logger.Context, vol)
+	logger.WithFields(log.Fields{"devid": devid, "wwn": wwn, "reported": reported}).Debug("Waiting for device to appear...")
+
+	// an attach failing in Cinder ends the wait, rather than its timeout
+	ctx := logger.Context
+	stop := func() error { return nil }
+	if timeout > 0 {
+		ctx, stop = d.watchAttach(ctx, vol)
+	}
+	taken := d.otherVolumesDevices(vol.ID)
+	dev, err := waitFor(ctx, []string{"/dev", devpath}, withSCSIRescan(logger, func() (string, error) {
+		if reported != "" && wwn != "" && deviceWWN(reported) == wwn {
+			return reported, nil
+		}
+		if dev, err := findVolumeDevice(reported, devpath, vol.ID, d.config.DeviceIDLength, taken); err != nil || dev != "" || wwn == "" {
+			return dev, err
+		}
+		return findDeviceByWWN(wwn)
+	}), timeout)
+
+	if failed := stop(); failed != nil {
+		return "", failed
+	}
+	if err != nil {
+		return "", err
+	}
+	if dev == "" {
 		return "", fmt.Errorf("Block device not found: %s", devid)
 	}
 
+	logger.WithField("dev", dev).Debug("Device found")
 	return dev, nil
 }
 
 
-func formatFilesystem(dev string, label string, filesystem string) (string, error) {
+func formatFilesystem(ctx context.Context, dev string, label string, filesystem string, options []string) (string, error) {
 	mkfsBin := fmt.Sprintf("mkfs.%s", filesystem)
-	if len(label) > 12 {
-		label=label[:12]
+	spec, ok := filesystems[filesystem]
+	if !ok {
+		return "", fmt.Errorf("Unsupported filesystem %s", filesystem)
 	}
+	label = volumeLabel(label, spec.labelLength)
 
-	out, err := exec.Command(mkfsBin, "-L", label, dev).CombinedOutput()
+	args := append(append([]string{}, options...), spec.labelOption, label, dev)
+	out, err := hostCommandContext(ctx, mkfsBin, args...).CombinedOutput()
 
 	if err != nil {
-		return string(out), errors.New(fmt.Sprintf("Command: '%s -L %s %s' - err: '%s'", mkfsBin, label, dev, err))
+		return string(out), fmt.Errorf("Command: '%s %s' - err: '%w'", mkfsBin, strings.Join(args, " "), err)
 	}
 
 	return "", nil
 }
 
-// look for a device which name contains id, under dir
-// and return the full path+filename
-func waitForDevice(dir string, id string, timeout int) (string, error) {
+// Poll the status of a volume being attached, with the backoff of waitOnVolumeState, and cancel
+// the returned context once Cinder reports the attach failed: the volume in error, or available again
+// (Nova gave up and rolled back). stop ends the polling, and returns why the context was cancelled, if it was.
+func (d plugin) watchAttach(ctx context.Context, vol *volumes.Volume) (context.Context, func() error) {
+	ctx, cancel := context.WithCancel(nonNilContext(ctx))
+	done := make(chan struct{})
+	var failed error
 
-	for i := 0; i <= timeout; i++ {
+	go func() {
+		defer close(done)
+		interval := time.Duration(d.config.PollVolumeState) * time.Millisecond
+		maxInterval := time.Duration(d.config.MaxPollVolumeState) * time.Millisecond
+		timer := time.NewTimer(interval)
+		defer timer.Stop()
+		available := 0
 
-		files, err := os.ReadDir(dir)
-		if err != nil {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+			}
+
+			current, err := volumes.Get(d.block(ctx), vol.ID).Extract()
+			if err != nil {
+				log.WithContext(ctx).WithError(err).Debugf("Error polling volume %s while waiting for its device", vol.ID)
+			} else if strings.HasPrefix(current.Status, "error") {
+				failed = fmt.Errorf("Attaching volume %s failed: its status became %s", vol.ID, current.Status)
+			} else if current.Status == "available" {
+				// twice in a row, not to mistake a status not updated yet for a rollback
+				if available++; available > 1 {
+					failed = fmt.Errorf("Attaching volume %s failed: it became available again, the attach was rolled back", vol.ID)
+				}
+			} else {
+				available = 0
+			}
+			if failed != nil {
+				cancel()
+				return
+			}
+
+			if interval *= 2; interval > maxInterval {
+				interval = maxInterval
+			}
+			timer.Reset(interval)
+		}
+	}()
+
+	return ctx, func() error {
+		cancel()
+		<-done
+		return failed
+	}
+}
+
+// Interval of device checks while waiting for one, without events to wait for
+var devicePollInterval = time.Second
+
+// Call find until it returns a path, an error, or timeout is reached (empty path, no error)
+// Woken up by inotify when entries are created under dirs, polls every pollDeviceWait without it.
+// Gives up with ctx's error when ctx is cancelled.
+func waitFor(ctx context.Context, dirs []string, find func() (string, error), timeout int) (string, error) {
+	ctx = nonNilContext(ctx)
+	deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+
+	events, err := watchDirectories(dirs)
+	if err != nil {
+		log.WithError(err).Debugf("Can't watch %s, polling", strings.Join(dirs, ", "))
+	} else {
+		defer events.Close()
+	}
+
+	buf := make([]byte, 4096)
+	for {
+		// look after the watch is set, not to miss an entry created in between
+		path, err := find()
+		if err != nil || path != "" {
+			return path, err
+		}
+
+		if !time.Now().Before(deadline) {
+			return "", nil
+		}
+		if err = ctx.Err(); err != nil {
 			return "", err
 		}
 
-		for _, file := range files {
-			if strings.Contains(file.Name(), id) {
-				return fmt.Sprintf("%s/%s", dir, file.Name()), nil
+		// check for cancellation at least every pollDeviceWait
+		wake := time.Now().Add(devicePollInterval)
+		if deadline.Before(wake) {
+			wake = deadline
+		}
+
+		if events == nil {
+			time.Sleep(time.Until(wake))
+			continue
+		}
+
+		// any event means something changed: look again
+		events.SetReadDeadline(wake)
+		if _, err = events.Read(buf); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			return "", err
+		}
+	}
+}
+
+// How well the serial of a device matches a volume ID
+const (
+	serialMismatch = iota
+	// no serial to check
+	serialUnknown
+	// truncated volume ID (virtio-blk serials are 20 characters at most)
+	serialPrefix
+	// whole volume ID
+	serialExact
+)
+
+// Devices (resolved) recorded for the volumes in use on this host, but volumeID
+func (d plugin) otherVolumesDevices(volumeID string) map[string]bool {
+	taken := make(map[string]bool)
+	states, _ := d.state.all()
+	for _, state := range states {
+		if state.VolumeID == volumeID || state.Device == "" {
+			continue
+		}
+		if target, err := filepath.EvalSymlinks(state.Device); err == nil {
+			taken[target] = true
+		}
+	}
+	return taken
+}
+
+// Look for the device of a volume: reported (by Nova), or whose name under dir (/dev/disk/by-id)
+// contains the first idLength characters of the volume ID, checked against the serial read from sysfs.
+// A device with the whole volume ID as serial wins; else the only one with it truncated, or without serial
+// (by name only). Several candidates sharing the truncated ID are an error rather than a guess.
+// Devices matched by truncated ID or name only are skipped when taken (recorded for another volume)
+// or in use (mounted, or held by a mapping): they belong to another volume sharing the truncated ID,
+// and the volume's own device is waited for instead.
+func findVolumeDevice(reported string, dir string, volumeID string, idLength int, taken map[string]bool) (string, error) {
+	candidates := []string{}
+	if reported != "" {
+		candidates = append(candidates, reported)
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	id := volumeID
+	if len(id) > idLength {
+		id = id[:idLength]
+	}
+	for _, file := range files {
+		if strings.Contains(file.Name(), id) && !strings.Contains(file.Name(), "-part") {
+			candidates = append(candidates, filepath.Join(dir, file.Name()))
+		}
+	}
+
+	// the same device is linked under several names (i.e. virtio- and scsi-)
+	seen := make(map[string]bool)
+	var prefix, unknown []string
+	for i, dev := range candidates {
+		target, err := filepath.EvalSymlinks(dev)
+		if err != nil || seen[target] || !isBlockDevice(target) {
+			continue
+		}
+		match := matchVolumeSerial(target, volumeID)
+		if (match == serialPrefix || match == serialUnknown) && (taken[target] || deviceInUse(target)) {
+			seen[target] = true
+			continue
+		}
+		switch match {
+		case serialExact:
+			return dev, nil
+		case serialPrefix:
+			prefix = append(prefix, dev)
+		case serialUnknown:
+			// the reported device is not trusted without a serial: the guest may name devices differently.
+			// Not seen then, so a by-id link to the same device still counts.
+			if reported != "" && i == 0 {
+				continue
 			}
+			unknown = append(unknown, dev)
+		}
+		seen[target] = true
+	}
+
+	if len(prefix) > 1 {
+		return "", fmt.Errorf("Devices %s all have a serial matching volume %s, can't tell which is its device", strings.Join(prefix, ", "), volumeID)
+	}
+	if len(prefix) == 1 {
+		return prefix[0], nil
+	}
+	if len(unknown) > 1 {
+		return "", fmt.Errorf("Devices %s all match volume %s, can't tell which is its device", strings.Join(unknown, ", "), volumeID)
+	}
+	if len(unknown) == 1 {
+		return unknown[0], nil
+	}
+	return "", nil
+}
+
+// inotify file descriptor notified of entries created or moved under dirs,
+// non-blocking so that reads honour deadlines
+func watchDirectories(dirs []string) (*os.File, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dir := range dirs {
+		if _, err = syscall.InotifyAddWatch(fd, dir, syscall.IN_CREATE|syscall.IN_MOVED_TO); err != nil {
+			syscall.Close(fd)
+			return nil, err
 		}
+	}
+
+	return os.NewFile(uintptr(fd), "inotify"), nil
+}
 
-		time.Sleep(1 * time.Second)
+// Make the kernel refuse writes to a block device
+func setReadOnly(dev string) error {
+	out, err := hostCommand("blockdev", "--setro", dev).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("blockdev --setro failed - %s", out)
 	}
+	return nil
+}
+
+// Serial number of a block device (i.e. /dev/vdb), as seen by the guest:
+// virtio-blk serial, or SCSI unit serial number
+func deviceSerial(dev string) string {
+	sys := filepath.Join("/sys/block", filepath.Base(dev))
 
-	return "", fmt.Errorf("Timeout waiting for file: %s", id)
+	if out, err := os.ReadFile(filepath.Join(sys, "serial")); err == nil {
+		return strings.TrimSpace(string(out))
+	}
+
+	// VPD page 0x80: 4 bytes header, then the serial
+	if out, err := os.ReadFile(filepath.Join(sys, "device/vpd_pg80")); err == nil && len(out) > 4 {
+		return strings.TrimSpace(string(out[4:]))
+	}
+
+	return ""
+}
+
+// Check dev against a volume ID, from its serial:
+// hypervisors set it to the volume ID, possibly truncated, with or without dashes
+func matchVolumeSerial(dev string, volumeID string) int {
+	serial := strings.ToLower(strings.ReplaceAll(deviceSerial(dev), "-", ""))
+	id := strings.ToLower(strings.ReplaceAll(volumeID, "-", ""))
+	switch {
+	case serial == "":
+		return serialUnknown
+	case serial == id:
+		return serialExact
+	case len(serial) >= 8 && strings.HasPrefix(id, serial):
+		return serialPrefix
+	}
+	return serialMismatch
 }
 
 func isDirectoryPresent(path string) (bool, error) {
@@ -294,7 +863,8 @@ func isDirectoryPresent(path string) (bool, error) {
 	}
 }
 
-func createMountDir(path string) (error) {
+// Create the directory a volume is mounted in
+func (d plugin) createMountDir(logger *log.Entry, path string) error {
 	// Sometimes mkdir fails, and I've observed it is a symptom of a bug
 	// where volume is half-mounted (?)
 	// this can be solved with umount
@@ -305,23 +875,374 @@ func createMountDir(path string) (error) {
 	// may be too fast (or maybe at the same time?),
 	// I prefer to wait a bit before retrying the unmount.
 
-	logger := log.WithFields(log.Fields{"action": "createMountDir"})
-	sleep := 1 * time.Second
-	for retry := 0; retry < 3; retry++ {
+	// So each failed attempt looks at what is mounted there, and only unmounts that:
+	// lazily when it is busy or its filesystem is gone (i.e. "transport endpoint is not connected").
+	// Other errors (i.e. permission denied, no space left) are not helped by retrying.
+
+	logger = logger.WithFields(log.Fields{"action": "createMountDir", "path": path})
+	sleep := time.Duration(d.config.MountDirRetryDelay) * time.Millisecond
+	var err error
+	for attempt := 1; ; attempt++ {
 
 		// If mkdir is OK, proceed to next step
-		if err := os.MkdirAll(path, 0700); err == nil {
+		if err = os.MkdirAll(path, 0700); err == nil {
 			return nil
 		}
 
+		mountDevice, _ := getMountDevice(path)
+		stale := isStaleMount(err)
+		attemptLogger := logger.WithError(err).WithFields(log.Fields{"attempt": attempt, "device": mountDevice, "stale": stale})
+		if mountDevice == "" && !stale {
+			attemptLogger.Error("Error creating mount directory, nothing mounted there to clean up")
+			return fmt.Errorf("Failed creating directory %s: %w", path, err)
+		}
+		if attempt > d.config.MountDirRetries {
+			break
+		}
+		attemptLogger.Warn("Error creating mount directory, unmounting what is left there")
+
 		// exponential backoff
 		time.Sleep(sleep)
 		sleep = sleep * 2
 
-		err := syscall.Unmount(path, 0)
+		unmountErr := unmount(path)
+		if unmountErr == syscall.EBUSY || (unmountErr != nil && stale) {
+			attemptLogger.WithField("unmountError", unmountErr.Error()).Warn("Unmount failed, detaching the mount lazily")
+			unmountErr = lazyUnmount(path)
+		}
+		if unmountErr != nil && unmountErr != syscall.EINVAL {
+			attemptLogger.WithField("unmountError", unmountErr.Error()).Error("Error unmounting")
+		}
+	}
+	return fmt.Errorf("Failed creating directory %s after %d attempts: %w", path, d.config.MountDirRetries+1, err)
+}
+
+// Whether an error comes from a mount which filesystem is gone (i.e. FUSE or network filesystem, or a detached device)
+func isStaleMount(err error) bool {
+	return errors.Is(err, syscall.ENOTCONN) || errors.Is(err, syscall.ESTALE) || errors.Is(err, syscall.EIO)
+}
+
+// Lists processes holding files open under path
+// (open file descriptors, working directory or root directory),
+// as "pid (command)" strings.
+func getOpenFileHolders(path string) []string {
+	var holders []string
+
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return holders
+	}
+
+	self := os.Getpid()
+	isUnder := func(target string) bool {
+		return target == path || strings.HasPrefix(target, path+"/")
+	}
+
+	for _, proc := range procs {
+		pid, err := strconv.Atoi(proc.Name())
+		if err != nil || pid == self {
+			continue
+		}
+		procDir := filepath.Join("/proc", proc.Name())
+
+		links := []string{filepath.Join(procDir, "cwd"), filepath.Join(procDir, "root")}
+		if fds, err := os.ReadDir(filepath.Join(procDir, "fd")); err == nil {
+			for _, fd := range fds {
+				links = append(links, filepath.Join(procDir, "fd", fd.Name()))
+			}
+		}
+
+		for _, link := range links {
+			if target, err := os.Readlink(link); err == nil && isUnder(target) {
+				comm, _ := os.ReadFile(filepath.Join(procDir, "comm"))
+				holders = append(holders, fmt.Sprintf("%d (%s)", pid, strings.TrimSpace(string(comm))))
+				break
+			}
+		}
+	}
+
+	return holders
+}
+
+// wait for processes to release files under path
+// and return the ones still holding files after timeout, or when ctx is cancelled
+func waitForOpenFiles(ctx context.Context, path string, timeout int) []string {
+	ctx = nonNilContext(ctx)
+	holders := getOpenFileHolders(path)
+
+	for i := 0; i < timeout && len(holders) > 0; i++ {
+		select {
+		case <-ctx.Done():
+			return holders
+		case <-time.After(1 * time.Second):
+		}
+		holders = getOpenFileHolders(path)
+	}
+
+	return holders
+}
+
+// Contexts of loggers are nil when not set
+func nonNilContext(ctx context.Context) context.Context {
+	if ctx == nil {
+		return context.Background()
+	}
+	return ctx
+}
+
+// Boolean volume setting from Cinder metadata:
+// anything else than "false" means true, defaults to def when not set.
+func metadataBool(vol *volumes.Volume, key string, def bool) bool {
+	if v, ok := vol.Metadata[key]; ok {
+		return strings.ToLower(v) != "false"
+	}
+	return def
+}
+
+// Set metadata keys of a volume, keeping the others
+func setVolumeMetadata(ctx context.Context, d *plugin, vol *volumes.Volume, values map[string]string) (*volumes.Volume, error) {
+	metadata := make(map[string]string)
+	for k, v := range vol.Metadata {
+		metadata[k] = v
+	}
+	for k, v := range values {
+		metadata[k] = v
+	}
+	return volumes.Update(d.block(ctx), vol.ID, volumes.UpdateOpts{Metadata: metadata}).Extract()
+}
+
+func fsFreeze(path string) error {
+	out, err := hostCommand("fsfreeze", "-f", path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("fsfreeze -f %s failed: %s", path, out)
+	}
+	return nil
+}
+
+func fsThaw(path string) error {
+	out, err := hostCommand("fsfreeze", "-u", path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("fsfreeze -u %s failed: %s", path, out)
+	}
+	return nil
+}
+
+// Size of a block device, in bytes
+func getDeviceSize(dev string) (int64, error) {
+	out, err := hostCommand("blockdev", "--getsize64", dev).CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("blockdev --getsize64 %s failed: %s", dev, out)
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+}
+
+var (
+	dumpe2fsBlockCount = regexp.MustCompile(`(?m)^Block count:\s+(\d+)`)
+	dumpe2fsBlockSize  = regexp.MustCompile(`(?m)^Block size:\s+(\d+)`)
+	xfsInfoData        = regexp.MustCompile(`data\s+=\s+bsize=(\d+)\s+blocks=(\d+)`)
+	btrfsDeviceSize    = regexp.MustCompile(`devid\s+\d+\s+size\s+(\d+)`)
+	f2fsBlockCount     = regexp.MustCompile(`(?m)^block_count\s+\[0x\s*[0-9a-f]+\s*:\s*(\d+)\]`)
+)
+
+// Size of a filesystem, in bytes, as seen by the filesystem itself
+// (statfs would not count the filesystem metadata)
+func getFilesystemSize(dev string, mountPath string, filesystem string) (int64, error) {
+	var blockSize, blockCount string
+
+	switch filesystem {
+	case "ext2", "ext3", "ext4":
+		out, err := hostCommand("dumpe2fs", "-h", dev).Output()
+		if err != nil {
+			return 0, fmt.Errorf("dumpe2fs -h %s failed: %w", dev, err)
+		}
+		count := dumpe2fsBlockCount.FindSubmatch(out)
+		size := dumpe2fsBlockSize.FindSubmatch(out)
+		if count == nil || size == nil {
+			return 0, fmt.Errorf("Unexpected dumpe2fs output for %s", dev)
+		}
+		blockCount, blockSize = string(count[1]), string(size[1])
+	case "xfs":
+		out, err := hostCommand("xfs_info", mountPath).Output()
+		if err != nil {
+			return 0, fmt.Errorf("xfs_info %s failed: %w", mountPath, err)
+		}
+		data := xfsInfoData.FindSubmatch(out)
+		if data == nil {
+			return 0, fmt.Errorf("Unexpected xfs_info output for %s", mountPath)
+		}
+		blockSize, blockCount = string(data[1]), string(data[2])
+	case "btrfs":
+		out, err := hostCommand("btrfs", "filesystem", "show", "--raw", mountPath).Output()
+		if err != nil {
+			return 0, fmt.Errorf("btrfs filesystem show %s failed: %w", mountPath, err)
+		}
+		size := btrfsDeviceSize.FindSubmatch(out)
+		if size == nil {
+			return 0, fmt.Errorf("Unexpected btrfs filesystem show output for %s", mountPath)
+		}
+		blockSize, blockCount = "1", string(size[1])
+	case "f2fs":
+		// f2fs blocks are always 4k
+		out, err := hostCommand("dump.f2fs", dev).Output()
 		if err != nil {
-			logger.WithError(err).Errorf("Error unmount %s", path)
+			return 0, fmt.Errorf("dump.f2fs %s failed: %w", dev, err)
+		}
+		count := f2fsBlockCount.FindSubmatch(out)
+		if count == nil {
+			return 0, fmt.Errorf("Unexpected dump.f2fs output for %s", dev)
 		}
+		blockSize, blockCount = "4096", string(count[1])
+	default:
+		return 0, fmt.Errorf("Don't know how to get size of %s filesystem", filesystem)
+	}
+
+	size, err := strconv.ParseInt(blockSize, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	count, err := strconv.ParseInt(blockCount, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return size * count, nil
+}
+
+// Grow a filesystem to the size of its device.
+// Must be mounted on mountPath, unless it can only be grown unmounted (f2fs).
+func growFilesystem(dev string, mountPath string, filesystem string) error {
+	var cmd *exec.Cmd
+
+	switch filesystem {
+	case "ext2", "ext3", "ext4":
+		cmd = hostCommand("resize2fs", dev)
+	case "xfs":
+		cmd = hostCommand("xfs_growfs", mountPath)
+	case "btrfs":
+		cmd = hostCommand("btrfs", "filesystem", "resize", "max", mountPath)
+	case "f2fs":
+		cmd = hostCommand("resize.f2fs", dev)
+	default:
+		return fmt.Errorf("Don't know how to grow %s filesystem", filesystem)
+	}
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Command: '%s' - err: '%w' - output: %s", strings.Join(cmd.Args, " "), err, out)
+	}
+	return nil
+}
+
+// Grow the filesystem if the device is bigger than it,
+// i.e. when the Cinder volume was extended.
+// Returns whether the filesystem was grown.
+func growFilesystemIfNeeded(dev string, mountPath string, filesystem string) (bool, error) {
+	devSize, err := getDeviceSize(dev)
+	if err != nil {
+		return false, err
+	}
+
+	fsSize, err := getFilesystemSize(dev, mountPath, filesystem)
+	if err != nil {
+		return false, err
+	}
+
+	// filesystems are aligned on their block size, ignore what can't be used anyway
+	if devSize-fsSize < 1024*1024 {
+		return false, nil
+	}
+
+	return true, growFilesystem(dev, mountPath, filesystem)
+}
+
+// Raw block volumes expose their device as this node in the volume directory
+const rawDeviceName = "device"
+
+func isBlockDevice(path string) bool {
+	stat, err := os.Stat(path)
+	return err == nil && stat.Mode()&os.ModeDevice != 0 && stat.Mode()&os.ModeCharDevice == 0
+}
+
+// Create a block device node at nodePath, pointing to the same device as dev
+func createDeviceNode(dev string, nodePath string) error {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(dev, &stat); err != nil {
+		return fmt.Errorf("Error reading device %s: %w", dev, err)
+	}
+	if stat.Mode&syscall.S_IFMT != syscall.S_IFBLK {
+		return fmt.Errorf("%s is not a block device", dev)
+	}
+
+	// remove stale node from a previous mount
+	if err := os.Remove(nodePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return syscall.Mknod(nodePath, syscall.S_IFBLK|0600, int(stat.Rdev))
+}
+
+// Write block device queue settings (read_ahead_kb, scheduler, nr_requests...)
+// to /sys/block/<device>/queue/
+func tuneDevice(dev string, settings map[string]string) error {
+	logger := log.WithFields(log.Fields{"dev": dev, "action": "tuneDevice"})
+
+	// by-id names are symlinks to the kernel device
+	realDev, err := filepath.EvalSymlinks(dev)
+	if err != nil {
+		return err
+	}
+	queueDir := filepath.Join("/sys/block", filepath.Base(realDev), "queue")
+
+	for name, value := range settings {
+		if strings.ContainsAny(name, "/.") {
+			return fmt.Errorf("Invalid queue setting name: %s", name)
+		}
+		logger.Debugf("Setting %s/%s to %s", queueDir, name, value)
+		if err := os.WriteFile(filepath.Join(queueDir, name), []byte(value), 0644); err != nil {
+			return fmt.Errorf("Error setting %s to %s: %w", name, value, err)
+		}
+	}
+
+	return nil
+}
+
+type diskUsage struct {
+	TotalBytes     uint64 `json:"totalBytes"`
+	UsedBytes      uint64 `json:"usedBytes"`
+	AvailableBytes uint64 `json:"availableBytes"`
+	TotalInodes    uint64 `json:"totalInodes"`
+	UsedInodes     uint64 `json:"usedInodes"`
+	FreeInodes     uint64 `json:"freeInodes"`
+}
+
+// Disk and inode usage of a mounted filesystem
+func getDiskUsage(path string) (*diskUsage, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return nil, err
+	}
+
+	bsize := uint64(stat.Bsize)
+	return &diskUsage{
+		TotalBytes:     stat.Blocks * bsize,
+		UsedBytes:      (stat.Blocks - stat.Bfree) * bsize,
+		AvailableBytes: stat.Bavail * bsize,
+		TotalInodes:    stat.Files,
+		UsedInodes:     stat.Files - stat.Ffree,
+		FreeInodes:     stat.Ffree,
+	}, nil
+}
+
+// Open a device with plain dm-crypt and a random key, read from /dev/urandom and only kept by the kernel:
+// its data can't be read again once the device is closed
+func openEphemeral(devName string, volumeName string, discard bool) (string, error) {
+	luksName := luksMapperName(volumeName)
+	args := []string{"open", "--type", "plain", "--cipher", "aes-xts-plain64", "--key-size", "512", "--key-file", "/dev/urandom"}
+	if discard {
+		args = append(args, "--allow-discards")
+	}
+	out, err := hostCommand("cryptsetup", append(args, devName, luksName)...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("cryptsetup open --type plain failed - %s", out)
 	}
-	return fmt.Errorf("Failed creating directory %s", path)
+	return luksName, nil
 }
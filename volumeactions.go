@@ -0,0 +1,87 @@
+package main
+
+import (
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+)
+
+// Cinder volume actions that gophercloud does not implement
+// Input:
+// * block storage client
+// * volume ID
+// * action body, i.e. {"os-force_detach": {...}}
+func volumeAction(client *gophercloud.ServiceClient, id string, body map[string]interface{}) error {
+	resp, err := client.Post(client.ServiceURL("volumes", id, "action"), body, nil, &gophercloud.RequestOpts{
+		OkCodes: []int{200, 202},
+	})
+	_, _, err = gophercloud.ParseResponse(resp, err)
+	return err
+}
+
+// Cinder-side detach, for attachments Nova can't remove
+// (server deleted, compute host down...). Requires admin rights by default.
+func forceDetach(client *gophercloud.ServiceClient, vol *volumes.Volume) error {
+	for _, att := range vol.Attachments {
+		err := volumeAction(client, vol.ID, map[string]interface{}{
+			"os-force_detach": map[string]interface{}{
+				"attachment_id": att.AttachmentID,
+				"connector":     nil,
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Set the Cinder status of a volume without doing anything else.
+// Requires admin rights by default.
+func resetStatus(client *gophercloud.ServiceClient, id string, status string) error {
+	return volumeAction(client, id, map[string]interface{}{
+		"os-reset_status": map[string]interface{}{
+			"status": status,
+		},
+	})
+}
+
+// Export a volume to the host described by connector, and return the connection info.
+// gophercloud's InitializeConnection only knows iSCSI and FC connector properties.
+func initializeConnection(client *gophercloud.ServiceClient, id string, connector map[string]interface{}) (map[string]interface{}, error) {
+	body := map[string]interface{}{
+		"os-initialize_connection": map[string]interface{}{
+			"connector": connector,
+		},
+	}
+
+	var result struct {
+		ConnectionInfo map[string]interface{} `json:"connection_info"`
+	}
+	resp, err := client.Post(client.ServiceURL("volumes", id, "action"), body, &result, &gophercloud.RequestOpts{
+		OkCodes: []int{200, 202},
+	})
+	if _, _, err = gophercloud.ParseResponse(resp, err); err != nil {
+		return nil, err
+	}
+	return result.ConnectionInfo, nil
+}
+
+// Stop exporting a volume to the host described by connector
+func terminateConnection(client *gophercloud.ServiceClient, id string, connector map[string]interface{}) error {
+	return volumeAction(client, id, map[string]interface{}{
+		"os-terminate_connection": map[string]interface{}{
+			"connector": connector,
+		},
+	})
+}
+
+// Set the Cinder read-only flag of a volume: attachments are then read-only,
+// and read-write ones are refused
+func setReadOnlyFlag(client *gophercloud.ServiceClient, id string, readOnly bool) error {
+	return volumeAction(client, id, map[string]interface{}{
+		"os-update_readonly_flag": map[string]interface{}{
+			"readonly": readOnly,
+		},
+	})
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// In-flight volume operations, to report where stuck ones are
+type watchdog struct {
+	mutex sync.Mutex
+	ops   map[string][]*trackedOp
+}
+
+type trackedOp struct {
+	action   string
+	start    time.Time
+	step     string
+	volumeID string
+	// result recorded for good, or operation given up by watch: whichever comes first
+	settled   bool
+	abandoned bool
+}
+
+// Context key of the operation watched
+type trackedOpKey struct{}
+
+func newWatchdog() *watchdog {
+	return &watchdog{ops: make(map[string][]*trackedOp)}
+}
+
+func (w *watchdog) start(action string, name string) *trackedOp {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	op := &trackedOp{action: action, start: time.Now(), step: "queued"}
+	w.ops[name] = append(w.ops[name], op)
+	return op
+}
+
+func (w *watchdog) end(name string, op *trackedOp) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	ops := w.ops[name]
+	for i := range ops {
+		if ops[i] == op {
+			ops = append(ops[:i], ops[i+1:]...)
+			break
+		}
+	}
+	if len(ops) == 0 {
+		delete(w.ops, name)
+	} else {
+		w.ops[name] = ops
+	}
+}
+
+// Record the current step of the running operation on a volume
+// (the oldest one, others wait for their turn)
+func (w *watchdog) step(name string, step string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if ops := w.ops[name]; len(ops) > 0 {
+		ops[0].step = step
+	}
+}
+
+func (w *watchdog) getStep(op *trackedOp) string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return op.step
+}
+
+// Record the Cinder volume ID of the running operation on a volume, once known
+func (w *watchdog) identify(name string, id string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if ops := w.ops[name]; len(ops) > 0 {
+		ops[0].volumeID = id
+	}
+}
+
+func (w *watchdog) getVolumeID(op *trackedOp) string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return op.volumeID
+}
+
+// Settle the watched operation of ctx before it records its result: false when it was given up meanwhile,
+// and the caller must undo what it did, Docker having been told it failed
+func (w *watchdog) settle(ctx context.Context) bool {
+	op, ok := ctx.Value(trackedOpKey{}).(*trackedOp)
+	if !ok {
+		return true
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if op.abandoned {
+		return false
+	}
+	op.settled = true
+	return true
+}
+
+// Give up on an operation, unless it already settled
+func (w *watchdog) abandon(op *trackedOp) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if op.settled {
+		return false
+	}
+	op.abandoned = true
+	return true
+}
+
+// Run an operation on a volume, logging its progress.
+// run is given the context of the operation, cancelled when it ends.
+// Its error is returned with the details of the operation.
+func (d plugin) track(action string, name string, run func(ctx context.Context) error) error {
+	op := d.watchdog.start(action, name)
+	defer d.watchdog.end(name, op)
+	defer d.logProgress(action, name, op)()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	return d.describeError(action, name, op, run(ctx))
+}
+
+// Log the step of an operation every logProgress seconds, until the returned function is called
+func (d plugin) logProgress(action string, name string, op *trackedOp) func() {
+	if d.config.LogProgress <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Duration(d.config.LogProgress) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				log.WithFields(log.Fields{
+					"name":    name,
+					"action":  action,
+					"step":    d.watchdog.getStep(op),
+					"elapsed": time.Since(op.start).Round(time.Second).String(),
+				}).Info("Operation in progress")
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// Run an operation on a volume, giving up on it after timeoutOperation seconds:
+// Docker gets an error, and a diagnostic is logged. The context of the operation is
+// cancelled, so waits and commands stop; a step ignoring it keeps the volume busy until it ends,
+// and an operation completing then must undo its work (see settle).
+func (d plugin) watch(action string, name string, run func(ctx context.Context) error) error {
+	if d.config.TimeoutOperation <= 0 {
+		return d.track(action, name, run)
+	}
+
+	op := d.watchdog.start(action, name)
+	stopProgress := d.logProgress(action, name, op)
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), trackedOpKey{}, op))
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		defer d.watchdog.end(name, op)
+		defer stopProgress()
+		done <- run(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return d.describeError(action, name, op, err)
+	case <-time.After(time.Duration(d.config.TimeoutOperation) * time.Second):
+	}
+	// settled just now: its result is on its way
+	if !d.watchdog.abandon(op) {
+		return d.describeError(action, name, op, <-done)
+	}
+
+	step := d.watchdog.getStep(op)
+	log.WithFields(log.Fields{
+		"name":       name,
+		"action":     action,
+		"step":       step,
+		"goroutines": goroutineDump(),
+	}).Errorf("Operation stuck for %ds, giving up", d.config.TimeoutOperation)
+
+	return d.describeError(action, name, op, fmt.Errorf("%s of volume %s aborted after %ds, stuck at step: %s", action, name, d.config.TimeoutOperation, step))
+}
+
+// Stack traces of all goroutines
+func goroutineDump() string {
+	buf := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return string(buf[:n])
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/attachments"
+	"github.com/gophercloud/gophercloud/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/pagination"
+)
+
+// World Wide Name of a volume's disk on this host, from the connection info of its Cinder attachment,
+// when its driver reports one: hypervisors exposing disks with a WWN rather than a serial derived
+// from the volume ID (i.e. VMware, some Fibre Channel backends)
+func (d plugin) attachmentWWN(ctx context.Context, vol *volumes.Volume) string {
+	client := *d.block(ctx)
+	if client.Microversion == "" {
+		client.Microversion = attachmentsMicroversion
+	}
+
+	var wwn string
+	pager := attachments.List(&client, attachments.ListOpts{VolumeID: vol.ID, InstanceID: d.machineID()})
+	pager.EachPage(func(page pagination.Page) (bool, error) {
+		list, err := attachments.ExtractAttachments(page)
+		if err != nil {
+			return false, err
+		}
+		for _, att := range list {
+			// listed without their connection info
+			attachment, err := attachments.Get(&client, att.ID).Extract()
+			if err != nil {
+				return false, err
+			}
+			data, _ := attachment.ConnectionInfo["data"].(map[string]interface{})
+			for _, key := range []string{"volume_wwn", "wwn"} {
+				if value, ok := data[key].(string); ok && value != "" {
+					wwn = normalizeWWN(value)
+					return false, nil
+				}
+			}
+		}
+		return true, nil
+	})
+	return wwn
+}
+
+// WWN without its notation: 0x6000c29..., naa.6000c29..., wwn-0x6000c29... are the same one
+func normalizeWWN(wwn string) string {
+	wwn = strings.ToLower(strings.TrimSpace(wwn))
+	for _, prefix := range []string{"wwn-", "0x", "naa.", "eui.", "t10."} {
+		wwn = strings.TrimPrefix(wwn, prefix)
+	}
+	return strings.NewReplacer("-", "", ":", "").Replace(wwn)
+}
+
+// WWN of a block device (i.e. /dev/sdb), from sysfs
+func deviceWWN(dev string) string {
+	target, err := filepath.EvalSymlinks(dev)
+	if err != nil {
+		return ""
+	}
+	sys := filepath.Join("/sys/class/block", filepath.Base(target))
+	for _, file := range []string{"device/wwid", "wwid"} {
+		if out, err := os.ReadFile(filepath.Join(sys, file)); err == nil {
+			return normalizeWWN(string(out))
+		}
+	}
+	return ""
+}
+
+// Disk with a WWN: its udev link, else from sysfs.
+// Disks already in use (mounted, or held by a mapping) are never it: a WWN wrongly reported can't hand out a host disk.
+func findDeviceByWWN(wwn string) (string, error) {
+	link := "/dev/disk/by-id/wwn-0x" + wwn
+	if isBlockDevice(link) {
+		if deviceInUse(link) {
+			return "", fmt.Errorf("Device %s with WWN %s is already in use on this host", link, wwn)
+		}
+		return link, nil
+	}
+
+	entries, err := os.ReadDir("/sys/block")
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		dev := filepath.Join("/dev", entry.Name())
+		if deviceWWN(dev) == wwn && isBlockDevice(dev) {
+			if deviceInUse(dev) {
+				return "", fmt.Errorf("Device %s with WWN %s is already in use on this host", dev, wwn)
+			}
+			return dev, nil
+		}
+	}
+	return "", nil
+}
+
+// Whether a disk or one of its partitions is mounted, or held by another device (LUKS, LVM, RAID)
+func deviceInUse(dev string) bool {
+	target, err := filepath.EvalSymlinks(dev)
+	if err != nil {
+		return false
+	}
+	name := filepath.Base(target)
+	devices := map[string]bool{name: true}
+	if entries, err := os.ReadDir(filepath.Join("/sys/class/block", name)); err == nil {
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), name) {
+				devices[entry.Name()] = true
+			}
+		}
+	}
+
+	for device := range devices {
+		if holders, err := os.ReadDir(filepath.Join("/sys/class/block", device, "holders")); err == nil && len(holders) > 0 {
+			return true
+		}
+	}
+
+	mounts, err := os.ReadFile(procMounts())
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(mounts), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || !strings.HasPrefix(fields[0], "/dev/") {
+			continue
+		}
+		if source, err := filepath.EvalSymlinks(fields[0]); err == nil && devices[filepath.Base(source)] {
+			return true
+		}
+	}
+	return false
+}